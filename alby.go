@@ -3,10 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -15,6 +20,13 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	albyListPageSize = 100
+	// the Alby API has no push mechanism for other apps, so wallets are polled for new payments
+	albyNotificationsPollInterval = 30 * time.Second
+	albyNotificationsPollPageSize = 20
+)
+
 type AlbyOAuthService struct {
 	cfg       *Config
 	oauthConf *oauth2.Config
@@ -49,7 +61,34 @@ func NewAlbyOauthService(svc *Service, e *echo.Echo) (result *AlbyOAuthService,
 	return albySvc, err
 }
 
-func (svc *AlbyOAuthService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string) (preimage string, err error) {
+func (svc *AlbyOAuthService) FetchUserToken(ctx context.Context, app App) (token *oauth2.Token, err error) {
+	user := app.User
+	tok, err := svc.oauthConf.TokenSource(ctx, &oauth2.Token{
+		AccessToken:  user.AccessToken,
+		RefreshToken: user.RefreshToken,
+		Expiry:       user.Expiry,
+	}).Token()
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"appId":  app.ID,
+			"userId": app.User.ID,
+		}).Errorf("Token error: %v", err)
+		return nil, err
+	}
+	// we always update the user's token for future use
+	// the oauth library handles the token refreshing
+	user.AccessToken = tok.AccessToken
+	user.RefreshToken = tok.RefreshToken
+	user.Expiry = tok.Expiry // TODO; probably needs some calculation
+	err = svc.db.Save(&user).Error
+	if err != nil {
+		svc.Logger.WithError(err).Error("Error saving user")
+		return nil, err
+	}
+	return tok, nil
+}
+
+func (svc *AlbyOAuthService) GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error) {
 	app := App{}
 	err = svc.db.Preload("User").First(&app, &App{
 		NostrPubkey: senderPubkey,
@@ -57,39 +96,436 @@ func (svc *AlbyOAuthService) SendPaymentSync(ctx context.Context, senderPubkey,
 	if err != nil {
 		svc.Logger.WithFields(logrus.Fields{
 			"senderPubkey": senderPubkey,
-			"bolt11":       payReq,
 		}).Errorf("App not found: %v", err)
-		return "", err
+		return 0, err
+	}
+	tok, err := svc.FetchUserToken(ctx, app)
+	if err != nil {
+		return 0, err
+	}
+	client := svc.oauthConf.Client(ctx, tok)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/balance", svc.cfg.AlbyAPIURL), nil)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Error creating request /balance")
+		return 0, err
+	}
+
+	req.Header.Set("User-Agent", "NWC")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"appId":        app.ID,
+			"userId":       app.User.ID,
+		}).Errorf("Failed to fetch balance: %v", err)
+		return 0, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		responsePayload := &BalanceResponse{}
+		err = json.NewDecoder(resp.Body).Decode(responsePayload)
+		if err != nil {
+			return 0, err
+		}
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"appId":        app.ID,
+			"userId":       app.User.ID,
+		}).Info("Balance fetch successful")
+		// the Alby API returns the balance in sats
+		return responsePayload.Balance * 1000, nil
+	}
+
+	errorPayload := &ErrorResponse{}
+	err = json.NewDecoder(resp.Body).Decode(errorPayload)
+	svc.Logger.WithFields(logrus.Fields{
+		"senderPubkey":  senderPubkey,
+		"appId":         app.ID,
+		"userId":        app.User.ID,
+		"APIHttpStatus": resp.StatusCode,
+	}).Errorf("Balance fetch failed %s", string(errorPayload.Message))
+	return 0, errors.New(errorPayload.Message)
+}
+
+func (svc *AlbyOAuthService) GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error) {
+	app := App{}
+	err = svc.db.Preload("User").First(&app, &App{
+		NostrPubkey: senderPubkey,
+	}).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+		}).Errorf("App not found: %v", err)
+		return nil, err
+	}
+	tok, err := svc.FetchUserToken(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	client := svc.oauthConf.Client(ctx, tok)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/user/me", svc.cfg.AlbyAPIURL), nil)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Error creating request /user/me")
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", "NWC")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"appId":        app.ID,
+			"userId":       app.User.ID,
+		}).Errorf("Failed to fetch account info: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		me := &AlbyMe{}
+		err = json.NewDecoder(resp.Body).Decode(me)
+		if err != nil {
+			return nil, err
+		}
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"appId":        app.ID,
+			"userId":       app.User.ID,
+		}).Info("Account info fetch successful")
+		// Alby accounts are custodial: the pubkey is the one used for keysend payments to the account.
+		// The Alby API does not return the alias, network or block height of the node, so they are left empty.
+		return &NodeInfo{
+			Pubkey: me.KeysendPubkey,
+		}, nil
+	}
+
+	errorPayload := &ErrorResponse{}
+	err = json.NewDecoder(resp.Body).Decode(errorPayload)
+	svc.Logger.WithFields(logrus.Fields{
+		"senderPubkey":  senderPubkey,
+		"appId":         app.ID,
+		"userId":        app.User.ID,
+		"APIHttpStatus": resp.StatusCode,
+	}).Errorf("Account info fetch failed %s", string(errorPayload.Message))
+	return nil, errors.New(errorPayload.Message)
+}
+
+func (svc *AlbyOAuthService) SubscribePayments(ctx context.Context) (notifications <-chan PaymentNotification, err error) {
+	notificationsChan := make(chan PaymentNotification)
+	go pollUserPayments(ctx, svc.db, svc.Logger, svc, albyNotificationsPollInterval, albyNotificationsPollPageSize, notificationsChan)
+	return notificationsChan, nil
+}
+
+func (svc *AlbyOAuthService) CreateInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	app := App{}
+	err = svc.db.Preload("User").First(&app, &App{
+		NostrPubkey: senderPubkey,
+	}).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"amount":       amount,
+		}).Errorf("App not found: %v", err)
+		return nil, err
+	}
+
+	// amount provided in msat, but Alby API currently only supports sats.
+	if amount%1000 != 0 {
+		return nil, errors.New("Alby only supports invoices with whole sat amounts")
+	}
+	// the Alby API does not support a custom expiry
+	if expiry != 0 {
+		return nil, fmt.Errorf("%w: Alby does not support a custom invoice expiry", ErrNotImplemented)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"senderPubkey":    senderPubkey,
+		"amount":          amount,
+		"description":     description,
+		"descriptionHash": descriptionHash,
+		"expiry":          expiry,
+		"appId":           app.ID,
+		"userId":          app.User.ID,
+	}).Info("Processing make invoice request")
+	tok, err := svc.FetchUserToken(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	client := svc.oauthConf.Client(ctx, tok)
+
+	body := bytes.NewBuffer([]byte{})
+	payload := &MakeInvoiceRequest{
+		Amount:          amount / 1000,
+		Description:     description,
+		DescriptionHash: descriptionHash,
+	}
+	err = json.NewEncoder(body).Encode(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/invoices", svc.cfg.AlbyAPIURL), body)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Error creating request /invoices")
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", "NWC")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"amount":       amount,
+			"appId":        app.ID,
+			"userId":       app.User.ID,
+		}).Errorf("Failed to make invoice: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		responsePayload := &AlbyInvoice{}
+		err = json.NewDecoder(resp.Body).Decode(responsePayload)
+		if err != nil {
+			return nil, err
+		}
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey":   senderPubkey,
+			"amount":         amount,
+			"appId":          app.ID,
+			"userId":         app.User.ID,
+			"paymentRequest": responsePayload.PaymentRequest,
+			"paymentHash":    responsePayload.PaymentHash,
+		}).Info("Make invoice successful")
+		return albyInvoiceToTransaction(responsePayload), nil
+	}
+
+	errorPayload := &ErrorResponse{}
+	err = json.NewDecoder(resp.Body).Decode(errorPayload)
+	svc.Logger.WithFields(logrus.Fields{
+		"senderPubkey":  senderPubkey,
+		"amount":        amount,
+		"appId":         app.ID,
+		"userId":        app.User.ID,
+		"APIHttpStatus": resp.StatusCode,
+	}).Errorf("Make invoice failed %s", string(errorPayload.Message))
+	return nil, errors.New(errorPayload.Message)
+}
+
+func (svc *AlbyOAuthService) LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error) {
+	app := App{}
+	err = svc.db.Preload("User").First(&app, &App{
+		NostrPubkey: senderPubkey,
+	}).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"paymentHash":  paymentHash,
+		}).Errorf("App not found: %v", err)
+		return nil, err
+	}
+
 	svc.Logger.WithFields(logrus.Fields{
 		"senderPubkey": senderPubkey,
-		"bolt11":       payReq,
+		"paymentHash":  paymentHash,
 		"appId":        app.ID,
 		"userId":       app.User.ID,
-	}).Info("Processing payment request")
-	user := app.User
-	tok, err := svc.oauthConf.TokenSource(ctx, &oauth2.Token{
-		AccessToken:  user.AccessToken,
-		RefreshToken: user.RefreshToken,
-		Expiry:       user.Expiry,
-	}).Token()
+	}).Info("Processing lookup invoice request")
+	tok, err := svc.FetchUserToken(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	client := svc.oauthConf.Client(ctx, tok)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/invoices/%s", svc.cfg.AlbyAPIURL, url.PathEscape(paymentHash)), nil)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Error creating request /invoices")
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", "NWC")
+
+	resp, err := client.Do(req)
 	if err != nil {
 		svc.Logger.WithFields(logrus.Fields{
 			"senderPubkey": senderPubkey,
-			"bolt11":       payReq,
+			"paymentHash":  paymentHash,
 			"appId":        app.ID,
 			"userId":       app.User.ID,
-		}).Errorf("Token error: %v", err)
+		}).Errorf("Failed to lookup invoice: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrTransactionNotFound
+	}
+
+	if resp.StatusCode < 300 {
+		responsePayload := &AlbyInvoice{}
+		err = json.NewDecoder(resp.Body).Decode(responsePayload)
+		if err != nil {
+			return nil, err
+		}
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey":   senderPubkey,
+			"paymentHash":    paymentHash,
+			"appId":          app.ID,
+			"userId":         app.User.ID,
+			"paymentRequest": responsePayload.PaymentRequest,
+			"settled":        responsePayload.Settled,
+		}).Info("Lookup invoice successful")
+		return albyInvoiceToTransaction(responsePayload), nil
+	}
+
+	errorPayload := &ErrorResponse{}
+	err = json.NewDecoder(resp.Body).Decode(errorPayload)
+	svc.Logger.WithFields(logrus.Fields{
+		"senderPubkey":  senderPubkey,
+		"paymentHash":   paymentHash,
+		"appId":         app.ID,
+		"userId":        app.User.ID,
+		"APIHttpStatus": resp.StatusCode,
+	}).Errorf("Lookup invoice failed %s", string(errorPayload.Message))
+	return nil, errors.New(errorPayload.Message)
+}
+
+func (svc *AlbyOAuthService) ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, transactionType string) (transactions []Nip47Transaction, err error) {
+	app := App{}
+	err = svc.db.Preload("User").First(&app, &App{
+		NostrPubkey: senderPubkey,
+	}).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+		}).Errorf("App not found: %v", err)
+		return nil, err
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"senderPubkey": senderPubkey,
+		"from":         from,
+		"until":        until,
+		"limit":        limit,
+		"offset":       offset,
+		"unpaid":       unpaid,
+		"type":         transactionType,
+		"appId":        app.ID,
+		"userId":       app.User.ID,
+	}).Info("Processing list transactions request")
+	tok, err := svc.FetchUserToken(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	client := svc.oauthConf.Client(ctx, tok)
+
+	endpoint := "/invoices"
+	if transactionType != "" {
+		endpoint = fmt.Sprintf("/invoices/%s", transactionType)
+	}
+
+	// the unpaid filter is applied after fetching, so we page through
+	// the results until we have enough matching transactions.
+	wanted := uint64(0)
+	if limit > 0 {
+		wanted = offset + limit
+	}
+	matching := uint64(0)
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Add("page", strconv.Itoa(page))
+		query.Add("items", strconv.Itoa(albyListPageSize))
+		if from != 0 {
+			query.Add("q[created_at_gt]", strconv.FormatUint(from, 10))
+		}
+		if until != 0 {
+			query.Add("q[created_at_lt]", strconv.FormatUint(until, 10))
+		}
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s%s?%s", svc.cfg.AlbyAPIURL, endpoint, query.Encode()), nil)
+		if err != nil {
+			svc.Logger.WithError(err).Errorf("Error creating request %s", endpoint)
+			return nil, err
+		}
+
+		req.Header.Set("User-Agent", "NWC")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"senderPubkey": senderPubkey,
+				"appId":        app.ID,
+				"userId":       app.User.ID,
+			}).Errorf("Failed to list transactions: %v", err)
+			return nil, err
+		}
+
+		if resp.StatusCode >= 300 {
+			errorPayload := &ErrorResponse{}
+			err = json.NewDecoder(resp.Body).Decode(errorPayload)
+			resp.Body.Close()
+			svc.Logger.WithFields(logrus.Fields{
+				"senderPubkey":  senderPubkey,
+				"appId":         app.ID,
+				"userId":        app.User.ID,
+				"APIHttpStatus": resp.StatusCode,
+			}).Errorf("List transactions failed %s", string(errorPayload.Message))
+			return nil, errors.New(errorPayload.Message)
+		}
+
+		invoices := []AlbyInvoice{}
+		err = json.NewDecoder(resp.Body).Decode(&invoices)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for i := range invoices {
+			transaction := albyInvoiceToTransaction(&invoices[i])
+			transactions = append(transactions, *transaction)
+			if matchesTransactionFilter(transaction, from, until, unpaid, transactionType) {
+				matching++
+			}
+		}
+		if len(invoices) < albyListPageSize || (wanted > 0 && matching >= wanted) {
+			break
+		}
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"senderPubkey": senderPubkey,
+		"appId":        app.ID,
+		"userId":       app.User.ID,
+	}).Info("List transactions successful")
+	return filterTransactions(transactions, from, until, limit, offset, unpaid, transactionType), nil
+}
+
+func (svc *AlbyOAuthService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string) (preimage string, err error) {
+	app := App{}
+	err = svc.db.Preload("User").First(&app, &App{
+		NostrPubkey: senderPubkey,
+	}).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"bolt11":       payReq,
+		}).Errorf("App not found: %v", err)
 		return "", err
 	}
-	// we always update the user's token for future use
-	// the oauth library handles the token refreshing
-	user.AccessToken = tok.AccessToken
-	user.RefreshToken = tok.RefreshToken
-	user.Expiry = tok.Expiry // TODO; probably needs some calculation
-	err = svc.db.Save(&user).Error
+	svc.Logger.WithFields(logrus.Fields{
+		"senderPubkey": senderPubkey,
+		"bolt11":       payReq,
+		"appId":        app.ID,
+		"userId":       app.User.ID,
+	}).Info("Processing payment request")
+	tok, err := svc.FetchUserToken(ctx, app)
 	if err != nil {
-		svc.Logger.WithError(err).Error("Error saving user")
 		return "", err
 	}
 	client := svc.oauthConf.Client(ctx, tok)
@@ -119,6 +555,7 @@ func (svc *AlbyOAuthService) SendPaymentSync(ctx context.Context, senderPubkey,
 		}).Errorf("Failed to pay invoice: %v", err)
 		return "", err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode < 300 {
 		responsePayload := &PayResponse{}
@@ -147,6 +584,119 @@ func (svc *AlbyOAuthService) SendPaymentSync(ctx context.Context, senderPubkey,
 	}
 }
 
+// Alby chooses the preimage of keysend payments
+func (svc *AlbyOAuthService) SupportsKeysend() (keysend bool, customPreimage bool) {
+	return true, false
+}
+
+func (svc *AlbyOAuthService) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, customRecords []TLVRecord) (respPreimage string, err error) {
+	app := App{}
+	err = svc.db.Preload("User").First(&app, &App{
+		NostrPubkey: senderPubkey,
+	}).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"destination":  destination,
+		}).Errorf("App not found: %v", err)
+		return "", err
+	}
+
+	// amount provided in msat, but Alby API currently only supports sats.
+	if amount%1000 != 0 {
+		return "", errors.New("Alby only supports keysend payments with whole sat amounts")
+	}
+	if preimage != "" {
+		return "", fmt.Errorf("%w: Alby does not support keysend payments with a custom preimage", ErrNotImplemented)
+	}
+
+	// NIP-47 TLV values are hex encoded, the Alby API expects the raw value as a JSON string.
+	customRecordsMap := make(map[string]string)
+	for _, record := range customRecords {
+		decodedValue, err := hex.DecodeString(record.Value)
+		if err != nil {
+			return "", fmt.Errorf("Invalid value for TLV record %d: %w", record.Type, err)
+		}
+		// invalid UTF-8 would be replaced when encoding the JSON request
+		if !utf8.Valid(decodedValue) {
+			return "", fmt.Errorf("%w: Alby only supports TLV records with UTF-8 values, record %d is binary", ErrNotImplemented, record.Type)
+		}
+		customRecordsMap[strconv.FormatUint(record.Type, 10)] = string(decodedValue)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"senderPubkey": senderPubkey,
+		"destination":  destination,
+		"amount":       amount,
+		"appId":        app.ID,
+		"userId":       app.User.ID,
+	}).Info("Processing keysend request")
+	tok, err := svc.FetchUserToken(ctx, app)
+	if err != nil {
+		return "", err
+	}
+	client := svc.oauthConf.Client(ctx, tok)
+
+	body := bytes.NewBuffer([]byte{})
+	payload := &KeysendRequest{
+		Amount:        amount / 1000,
+		Destination:   destination,
+		CustomRecords: customRecordsMap,
+	}
+	err = json.NewEncoder(body).Encode(payload)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/payments/keysend", svc.cfg.AlbyAPIURL), body)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Error creating request /payments/keysend")
+		return "", err
+	}
+
+	req.Header.Set("User-Agent", "NWC")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"destination":  destination,
+			"appId":        app.ID,
+			"userId":       app.User.ID,
+		}).Errorf("Failed to send keysend payment: %v", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		responsePayload := &PayResponse{}
+		err = json.NewDecoder(resp.Body).Decode(responsePayload)
+		if err != nil {
+			return "", err
+		}
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"destination":  destination,
+			"appId":        app.ID,
+			"userId":       app.User.ID,
+			"paymentHash":  responsePayload.PaymentHash,
+		}).Info("Keysend payment successful")
+		return responsePayload.Preimage, nil
+	}
+
+	errorPayload := &ErrorResponse{}
+	err = json.NewDecoder(resp.Body).Decode(errorPayload)
+	svc.Logger.WithFields(logrus.Fields{
+		"senderPubkey":  senderPubkey,
+		"destination":   destination,
+		"appId":         app.ID,
+		"userId":        app.User.ID,
+		"APIHttpStatus": resp.StatusCode,
+	}).Errorf("Keysend payment failed %s", string(errorPayload.Message))
+	return "", errors.New(errorPayload.Message)
+}
+
 func (svc *AlbyOAuthService) AuthHandler(c echo.Context) error {
 	// clear current session
 	sess, _ := session.Get(CookieName, c)
@@ -186,6 +736,7 @@ func (svc *AlbyOAuthService) CallbackHandler(c echo.Context) error {
 		svc.Logger.WithError(err).Error("Failed to fetch /me")
 		return err
 	}
+	defer res.Body.Close()
 	me := AlbyMe{}
 	err = json.NewDecoder(res.Body).Decode(&me)
 	if err != nil {
@@ -212,3 +763,35 @@ func (svc *AlbyOAuthService) CallbackHandler(c echo.Context) error {
 	sess.Save(c.Request(), c.Response())
 	return c.Redirect(302, "/")
 }
+
+func albyInvoiceToTransaction(invoice *AlbyInvoice) *Nip47Transaction {
+	state := NIP_47_TRANSACTION_STATE_PENDING
+	switch {
+	case invoice.Settled:
+		state = NIP_47_TRANSACTION_STATE_SETTLED
+	case invoice.State == "FAILED" || invoice.State == "ERROR":
+		state = NIP_47_TRANSACTION_STATE_FAILED
+	case !invoice.ExpiresAt.IsZero() && invoice.ExpiresAt.Before(time.Now()):
+		state = NIP_47_TRANSACTION_STATE_EXPIRED
+	}
+
+	transaction := &Nip47Transaction{
+		Type:            invoice.Type,
+		State:           state,
+		Invoice:         invoice.PaymentRequest,
+		Description:     invoice.Memo,
+		DescriptionHash: invoice.DescriptionHash,
+		Preimage:        invoice.Preimage,
+		PaymentHash:     invoice.PaymentHash,
+		Amount:          invoice.Amount * 1000,
+		FeesPaid:        invoice.FeesPaid * 1000,
+		CreatedAt:       invoice.CreatedAt.Unix(),
+	}
+	if !invoice.ExpiresAt.IsZero() {
+		transaction.ExpiresAt = invoice.ExpiresAt.Unix()
+	}
+	if invoice.Settled && !invoice.SettledAt.IsZero() {
+		transaction.SettledAt = invoice.SettledAt.Unix()
+	}
+	return transaction
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	clnPaymentTimeoutSeconds = 50
+	clnResubscribeDelay      = 10 * time.Second
+	// waitanyinvoice is a long poll, it is restarted after this many seconds
+	clnWaitInvoiceTimeoutSeconds = 60
+	// returned by waitanyinvoice if no invoice was paid within the timeout
+	clnErrorCodeWaitTimeout = 904
+	// wait has no timeout, the request is restarted after this duration
+	clnWaitPaymentsTimeout = 60 * time.Second
+	// every part of a multi-part payment completes, the payment is only notified once within this duration
+	clnNotifiedPaymentsTTL = time.Hour
+	// longer than the payments and the long polls
+	clnHTTPTimeout = 2 * time.Minute
+)
+
+// CLNService talks to Core Lightning through the REST API of the clnrest plugin (CLN 23.08 or newer).
+// All apps share the wallet of the node.
+type CLNService struct {
+	address    string
+	rune       string
+	httpClient *http.Client
+	db         *gorm.DB
+	Logger     *logrus.Logger
+}
+
+type clnErrorResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type clnError struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+func (err *clnError) Error() string {
+	return fmt.Sprintf("CLN %s failed: %s", err.Method, err.Message)
+}
+
+type clnInvoice struct {
+	Label              string `json:"label"`
+	Bolt11             string `json:"bolt11"`
+	PaymentHash        string `json:"payment_hash"`
+	Status             string `json:"status"`
+	Description        string `json:"description"`
+	AmountMsat         int64  `json:"amount_msat"`
+	AmountReceivedMsat int64  `json:"amount_received_msat"`
+	PaymentPreimage    string `json:"payment_preimage"`
+	PayIndex           uint64 `json:"pay_index"`
+	PaidAt             int64  `json:"paid_at"`
+	ExpiresAt          int64  `json:"expires_at"`
+}
+
+type clnPay struct {
+	Bolt11         string `json:"bolt11"`
+	Description    string `json:"description"`
+	PaymentHash    string `json:"payment_hash"`
+	Status         string `json:"status"`
+	Preimage       string `json:"preimage"`
+	AmountMsat     int64  `json:"amount_msat"`
+	AmountSentMsat int64  `json:"amount_sent_msat"`
+	CreatedAt      int64  `json:"created_at"`
+	CompletedAt    int64  `json:"completed_at"`
+}
+
+// clnWaitResponse is the result of wait for the sendpays subsystem
+type clnWaitResponse struct {
+	Updated uint64            `json:"updated"`
+	Details clnSendpayDetails `json:"details"`
+	// replaces details in newer CLN versions
+	Sendpays clnSendpayDetails `json:"sendpays"`
+}
+
+type clnSendpayDetails struct {
+	Status      string `json:"status"`
+	PaymentHash string `json:"payment_hash"`
+}
+
+type clnPayResponse struct {
+	PaymentPreimage string `json:"payment_preimage"`
+	Status          string `json:"status"`
+}
+
+func (svc *CLNService) AuthHandler(c echo.Context) error {
+	user := &User{}
+	err := svc.db.FirstOrInit(user, User{AlbyIdentifier: "cln"}).Error
+	if err != nil {
+		return err
+	}
+
+	sess, _ := session.Get(CookieName, c)
+	sess.Values["user_id"] = user.ID
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(302, "/")
+}
+
+// call runs a CLN RPC method and decodes its result into result
+func (svc *CLNService) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/v1/%s", svc.address, method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "NWC")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Rune", svc.rune)
+
+	resp, err := svc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		errorPayload := &clnErrorResponse{}
+		err = json.NewDecoder(resp.Body).Decode(errorPayload)
+		if err != nil || errorPayload.Message == "" {
+			errorPayload.Message = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		}
+		return &clnError{Method: method, Code: errorPayload.Code, Message: errorPayload.Message}
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (svc *CLNService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string) (preimage string, err error) {
+	resp := &clnPayResponse{}
+	err = svc.call(ctx, "pay", map[string]interface{}{
+		"bolt11":    payReq,
+		"retry_for": clnPaymentTimeoutSeconds,
+	}, resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.Status != "complete" {
+		return "", fmt.Errorf("Payment is %s", resp.Status)
+	}
+	return resp.PaymentPreimage, nil
+}
+
+// CLN chooses the preimage of keysend payments
+func (svc *CLNService) SupportsKeysend() (keysend bool, customPreimage bool) {
+	return true, false
+}
+
+func (svc *CLNService) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, customRecords []TLVRecord) (respPreimage string, err error) {
+	if preimage != "" {
+		return "", fmt.Errorf("%w: CLN does not support keysend payments with a custom preimage", ErrNotImplemented)
+	}
+	extraTlvs := map[string]string{}
+	for _, record := range customRecords {
+		extraTlvs[strconv.FormatUint(record.Type, 10)] = record.Value
+	}
+	resp := &clnPayResponse{}
+	err = svc.call(ctx, "keysend", map[string]interface{}{
+		"destination": destination,
+		"amount_msat": amount,
+		"extratlvs":   extraTlvs,
+		"retry_for":   clnPaymentTimeoutSeconds,
+	}, resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.Status != "complete" {
+		return "", fmt.Errorf("Payment is %s", resp.Status)
+	}
+	return resp.PaymentPreimage, nil
+}
+
+func (svc *CLNService) GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error) {
+	resp := &struct {
+		Channels []struct {
+			State         string `json:"state"`
+			OurAmountMsat int64  `json:"our_amount_msat"`
+		} `json:"channels"`
+	}{}
+	err = svc.call(ctx, "listfunds", map[string]interface{}{}, resp)
+	if err != nil {
+		return 0, err
+	}
+	for _, channel := range resp.Channels {
+		if channel.State == "CHANNELD_NORMAL" {
+			balance += channel.OurAmountMsat
+		}
+	}
+	return balance, nil
+}
+
+func (svc *CLNService) GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error) {
+	resp := &struct {
+		Id          string `json:"id"`
+		Alias       string `json:"alias"`
+		Color       string `json:"color"`
+		Network     string `json:"network"`
+		BlockHeight uint32 `json:"blockheight"`
+	}{}
+	err = svc.call(ctx, "getinfo", map[string]interface{}{}, resp)
+	if err != nil {
+		return nil, err
+	}
+	network := resp.Network
+	if network == "bitcoin" {
+		network = "mainnet"
+	}
+	// getinfo does not return the block hash
+	return &NodeInfo{
+		Alias:       resp.Alias,
+		Color:       resp.Color,
+		Pubkey:      resp.Id,
+		Network:     network,
+		BlockHeight: resp.BlockHeight,
+	}, nil
+}
+
+func (svc *CLNService) CreateInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	// CLN computes the description hash itself, so it needs the description
+	if descriptionHash != "" && description == "" {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey":    senderPubkey,
+			"amount":          amount,
+			"descriptionHash": descriptionHash,
+			"expiry":          expiry,
+		}).Errorf("Description hash without description")
+		return nil, errors.New("CLN requires the description to create an invoice with a description hash")
+	}
+	if descriptionHash != "" {
+		hash := sha256.Sum256([]byte(description))
+		if !strings.EqualFold(hex.EncodeToString(hash[:]), descriptionHash) {
+			svc.Logger.WithFields(logrus.Fields{
+				"senderPubkey":    senderPubkey,
+				"amount":          amount,
+				"descriptionHash": descriptionHash,
+				"expiry":          expiry,
+			}).Errorf("Description hash does not match the description")
+			return nil, errors.New("The description hash must be the SHA256 hash of the description")
+		}
+	}
+
+	params := map[string]interface{}{
+		"amount_msat": amount,
+		// labels must be unique
+		"label":        fmt.Sprintf("nwc-%d", time.Now().UnixNano()),
+		"description":  description,
+		"deschashonly": descriptionHash != "",
+	}
+	if expiry > 0 {
+		params["expiry"] = expiry
+	}
+	resp := &struct {
+		Bolt11      string `json:"bolt11"`
+		PaymentHash string `json:"payment_hash"`
+		ExpiresAt   int64  `json:"expires_at"`
+	}{}
+	err = svc.call(ctx, "invoice", params, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Nip47Transaction{
+		Type:            "incoming",
+		State:           NIP_47_TRANSACTION_STATE_PENDING,
+		Invoice:         resp.Bolt11,
+		Description:     description,
+		DescriptionHash: descriptionHash,
+		PaymentHash:     resp.PaymentHash,
+		Amount:          amount,
+		CreatedAt:       time.Now().Unix(),
+		ExpiresAt:       resp.ExpiresAt,
+	}, nil
+}
+
+func (svc *CLNService) LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error) {
+	paymentHashBytes, err := hex.DecodeString(paymentHash)
+	if err != nil || len(paymentHashBytes) != 32 {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"paymentHash":  paymentHash,
+		}).Errorf("Invalid payment hash")
+		return nil, errors.New("Payment hash must be 32 bytes hex")
+	}
+
+	invoices, err := svc.listInvoices(ctx, map[string]interface{}{"payment_hash": paymentHash})
+	if err != nil {
+		return nil, err
+	}
+	if len(invoices) > 0 {
+		return clnInvoiceToTransaction(&invoices[0]), nil
+	}
+
+	// not one of our invoices, check if it is a payment we made
+	pays, err := svc.listPays(ctx, map[string]interface{}{"payment_hash": paymentHash})
+	if err != nil {
+		return nil, err
+	}
+	if len(pays) == 0 {
+		return nil, ErrTransactionNotFound
+	}
+	return clnPayToTransaction(&pays[0]), nil
+}
+
+func (svc *CLNService) ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, transactionType string) (transactions []Nip47Transaction, err error) {
+	// CLN cannot filter by date, so all invoices and payments are loaded
+	if transactionType != "outgoing" {
+		invoices, err := svc.listInvoices(ctx, map[string]interface{}{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range invoices {
+			transactions = append(transactions, *clnInvoiceToTransaction(&invoices[i]))
+		}
+	}
+	if transactionType != "incoming" {
+		params := map[string]interface{}{}
+		if !unpaid {
+			params["status"] = "complete"
+		}
+		pays, err := svc.listPays(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		for i := range pays {
+			transactions = append(transactions, *clnPayToTransaction(&pays[i]))
+		}
+	}
+	return filterTransactions(transactions, from, until, limit, offset, unpaid, transactionType), nil
+}
+
+func (svc *CLNService) listInvoices(ctx context.Context, params map[string]interface{}) ([]clnInvoice, error) {
+	resp := &struct {
+		Invoices []clnInvoice `json:"invoices"`
+	}{}
+	err := svc.call(ctx, "listinvoices", params, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Invoices, nil
+}
+
+func (svc *CLNService) listPays(ctx context.Context, params map[string]interface{}) ([]clnPay, error) {
+	resp := &struct {
+		Pays []clnPay `json:"pays"`
+	}{}
+	err := svc.call(ctx, "listpays", params, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Pays, nil
+}
+
+func (svc *CLNService) SubscribePayments(ctx context.Context) (notifications <-chan PaymentNotification, err error) {
+	// start after the latest paid invoice and payment, only new payments are notified
+	invoices, err := svc.listInvoices(ctx, map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	payIndex := uint64(0)
+	for _, invoice := range invoices {
+		if invoice.PayIndex > payIndex {
+			payIndex = invoice.PayIndex
+		}
+	}
+
+	// a next value of 0 returns the current index
+	update, err := svc.waitSendpays(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	notificationsChan := make(chan PaymentNotification)
+	go svc.waitInvoices(ctx, payIndex, notificationsChan)
+	go svc.waitPayments(ctx, update.Updated, notificationsChan)
+	return notificationsChan, nil
+}
+
+func (svc *CLNService) waitInvoices(ctx context.Context, payIndex uint64, notifications chan<- PaymentNotification) {
+	for {
+		invoice := &clnInvoice{}
+		err := svc.call(ctx, "waitanyinvoice", map[string]interface{}{
+			"lastpay_index": payIndex,
+			"timeout":       clnWaitInvoiceTimeoutSeconds,
+		}, invoice)
+		if err == nil {
+			payIndex = invoice.PayIndex
+			if invoice.Status != "paid" {
+				continue
+			}
+			select {
+			case notifications <- PaymentNotification{
+				Type:        NIP_47_PAYMENT_RECEIVED_NOTIFICATION,
+				Transaction: *clnInvoiceToTransaction(invoice),
+			}:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		var clnErr *clnError
+		if errors.As(err, &clnErr) && clnErr.Code == clnErrorCodeWaitTimeout {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		svc.Logger.WithError(err).Error("Failed to wait for invoices")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(clnResubscribeDelay):
+		}
+	}
+}
+
+// waitPayments notifies the payments which completed after the updated index of the payments reached updatedIndex
+func (svc *CLNService) waitPayments(ctx context.Context, updatedIndex uint64, notifications chan<- PaymentNotification) {
+	notified := map[string]time.Time{}
+	for {
+		update, err := svc.waitSendpays(ctx, updatedIndex+1)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			svc.Logger.WithError(err).Error("Failed to wait for payments")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(clnResubscribeDelay):
+			}
+			continue
+		}
+		updatedIndex = update.Updated
+
+		details := update.Sendpays
+		if details.PaymentHash == "" {
+			details = update.Details
+		}
+		if details.Status != "complete" {
+			continue
+		}
+		for paymentHash, notifiedAt := range notified {
+			if time.Since(notifiedAt) > clnNotifiedPaymentsTTL {
+				delete(notified, paymentHash)
+			}
+		}
+		if _, ok := notified[details.PaymentHash]; ok {
+			continue
+		}
+		pays, err := svc.listPays(ctx, map[string]interface{}{"payment_hash": details.PaymentHash, "status": "complete"})
+		if err != nil || len(pays) == 0 {
+			svc.Logger.WithField("paymentHash", details.PaymentHash).WithError(err).Error("Failed to load completed payment")
+			continue
+		}
+		notified[details.PaymentHash] = time.Now()
+		select {
+		case notifications <- PaymentNotification{
+			Type:        NIP_47_PAYMENT_SENT_NOTIFICATION,
+			Transaction: *clnPayToTransaction(&pays[0]),
+		}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// waitSendpays waits until the updated index of the payments reaches nextValue
+func (svc *CLNService) waitSendpays(ctx context.Context, nextValue uint64) (*clnWaitResponse, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, clnWaitPaymentsTimeout)
+	defer cancel()
+	resp := &clnWaitResponse{}
+	err := svc.call(waitCtx, "wait", map[string]interface{}{
+		"subsystem": "sendpays",
+		"indexname": "updated",
+		"nextvalue": nextValue,
+	}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func clnInvoiceToTransaction(invoice *clnInvoice) *Nip47Transaction {
+	var descriptionHash string
+	var createdAt, settledAt int64
+	paymentRequest, err := decodepay.Decodepay(invoice.Bolt11)
+	if err == nil {
+		descriptionHash = paymentRequest.DescriptionHash
+		createdAt = int64(paymentRequest.CreatedAt)
+	}
+
+	state := NIP_47_TRANSACTION_STATE_PENDING
+	preimage := ""
+	switch invoice.Status {
+	case "paid":
+		state = NIP_47_TRANSACTION_STATE_SETTLED
+		preimage = invoice.PaymentPreimage
+		settledAt = invoice.PaidAt
+	case "expired":
+		state = NIP_47_TRANSACTION_STATE_EXPIRED
+	}
+
+	amount := invoice.AmountMsat
+	if amount == 0 {
+		amount = invoice.AmountReceivedMsat
+	}
+	return &Nip47Transaction{
+		Type:            "incoming",
+		State:           state,
+		Invoice:         invoice.Bolt11,
+		Description:     invoice.Description,
+		DescriptionHash: descriptionHash,
+		Preimage:        preimage,
+		PaymentHash:     invoice.PaymentHash,
+		Amount:          amount,
+		CreatedAt:       createdAt,
+		ExpiresAt:       invoice.ExpiresAt,
+		SettledAt:       settledAt,
+	}
+}
+
+func clnPayToTransaction(pay *clnPay) *Nip47Transaction {
+	description := pay.Description
+	var descriptionHash string
+	var expiresAt, settledAt, feesPaid int64
+	if pay.Bolt11 != "" {
+		paymentRequest, err := decodepay.Decodepay(pay.Bolt11)
+		if err == nil {
+			if description == "" {
+				description = paymentRequest.Description
+			}
+			descriptionHash = paymentRequest.DescriptionHash
+			expiresAt = int64(paymentRequest.CreatedAt + paymentRequest.Expiry)
+		}
+	}
+
+	state := NIP_47_TRANSACTION_STATE_PENDING
+	preimage := ""
+	switch pay.Status {
+	case "complete":
+		state = NIP_47_TRANSACTION_STATE_SETTLED
+		preimage = pay.Preimage
+		settledAt = pay.CompletedAt
+		feesPaid = pay.AmountSentMsat - pay.AmountMsat
+	case "failed":
+		state = NIP_47_TRANSACTION_STATE_FAILED
+	}
+
+	return &Nip47Transaction{
+		Type:            "outgoing",
+		State:           state,
+		Invoice:         pay.Bolt11,
+		Description:     description,
+		DescriptionHash: descriptionHash,
+		Preimage:        preimage,
+		PaymentHash:     pay.PaymentHash,
+		Amount:          pay.AmountMsat,
+		FeesPaid:        feesPaid,
+		CreatedAt:       pay.CreatedAt,
+		ExpiresAt:       expiresAt,
+		SettledAt:       settledAt,
+	}
+}
+
+// newHTTPClientWithCert trusts the certificate of the node in addition to the system certificates,
+// clnrest and LND use self-signed certificates by default. A timeout of 0 means no timeout.
+func newHTTPClientWithCert(certFile string, timeout time.Duration) (*http.Client, error) {
+	if certFile == "" {
+		return &http.Client{Timeout: timeout}, nil
+	}
+	cert, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	certPool, err := x509.SystemCertPool()
+	if err != nil {
+		certPool = x509.NewCertPool()
+	}
+	if !certPool.AppendCertsFromPEM(cert) {
+		return nil, fmt.Errorf("No certificate found in %s", certFile)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: certPool},
+		},
+		Timeout: timeout,
+	}, nil
+}
+
+func NewCLNService(ctx context.Context, svc *Service, e *echo.Echo) (result *CLNService, err error) {
+	if svc.cfg.CLNAddress == "" || svc.cfg.CLNRune == "" {
+		return nil, errors.New("CLN_ADDRESS and CLN_RUNE are required for the CLN backend")
+	}
+	httpClient, err := newHTTPClientWithCert(svc.cfg.CLNCertFile, clnHTTPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	clnService := &CLNService{
+		address:    strings.TrimSuffix(svc.cfg.CLNAddress, "/"),
+		rune:       svc.cfg.CLNRune,
+		httpClient: httpClient,
+		Logger:     svc.Logger,
+		db:         svc.db,
+	}
+	info, err := clnService.GetInfo(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	//add default user to db
+	user := &User{}
+	err = svc.db.FirstOrInit(user, User{AlbyIdentifier: "cln"}).Error
+	if err != nil {
+		return nil, err
+	}
+	err = svc.db.Save(user).Error
+	if err != nil {
+		return nil, err
+	}
+
+	e.GET("/cln/auth", clnService.AuthHandler)
+	svc.Logger.Infof("Connected to CLN - alias %s", info.Alias)
+
+	return clnService, nil
+}
@@ -1,31 +1,79 @@
 package main
 
+import "fmt"
+
 const (
-	AlbyBackendType = "ALBY"
-	LNDBackendType  = "LND"
-	CookieName      = "alby_nwc_session"
+	AlbyBackendType     = "ALBY"
+	LNDBackendType      = "LND"
+	LNDRestBackendType  = "LND_REST"
+	CLNBackendType      = "CLN"
+	LNbitsBackendType   = "LNBITS"
+	PhoenixdBackendType = "PHOENIXD"
+	CookieName          = "alby_nwc_session"
 )
 
 type Config struct {
-	NostrSecretKey          string `envconfig:"NOSTR_PRIVKEY"`
-	CookieSecret            string `envconfig:"COOKIE_SECRET" required:"true"`
-	CookieDomain            string `envconfig:"COOKIE_DOMAIN"`
-	ClientPubkey            string `envconfig:"CLIENT_NOSTR_PUBKEY"`
-	Relay                   string `envconfig:"RELAY" default:"wss://relay.getalby.com/v1"`
-	LNBackendType           string `envconfig:"LN_BACKEND_TYPE" default:"ALBY"`
-	LNDAddress              string `envconfig:"LND_ADDRESS"`
-	LNDCertFile             string `envconfig:"LND_CERT_FILE"`
-	LNDMacaroonFile         string `envconfig:"LND_MACAROON_FILE"`
-	AlbyAPIURL              string `envconfig:"ALBY_API_URL" default:"https://api.getalby.com"`
-	AlbyClientId            string `envconfig:"ALBY_CLIENT_ID"`
-	AlbyClientSecret        string `envconfig:"ALBY_CLIENT_SECRET"`
-	OAuthRedirectUrl        string `envconfig:"OAUTH_REDIRECT_URL"`
-	OAuthAuthUrl            string `envconfig:"OAUTH_AUTH_URL" default:"https://getalby.com/oauth"`
-	OAuthTokenUrl           string `envconfig:"OAUTH_TOKEN_URL" default:"https://api.getalby.com/oauth/token"`
-	Port                    string `envconfig:"PORT" default:"8080"`
-	DatabaseUri             string `envconfig:"DATABASE_URI" default:"nostr-wallet-connect.db"`
-	DatabaseMaxConns        int    `envconfig:"DATABASE_MAX_CONNS" default:"10"`
-	DatabaseMaxIdleConns    int    `envconfig:"DATABASE_MAX_IDLE_CONNS" default:"5"`
-	DatabaseConnMaxLifetime int    `envconfig:"DATABASE_CONN_MAX_LIFETIME" default:"1800"` // 30 minutes
+	NostrSecretKey          string   `envconfig:"NOSTR_PRIVKEY"`
+	CookieSecret            string   `envconfig:"COOKIE_SECRET" required:"true"`
+	CookieDomain            string   `envconfig:"COOKIE_DOMAIN"`
+	ClientPubkey            string   `envconfig:"CLIENT_NOSTR_PUBKEY"`
+	Relays                  []string `envconfig:"RELAY" default:"wss://relay.getalby.com/v1"` // comma separated
+	AuthRelays              []string `envconfig:"RELAY_AUTH"`                                 // comma separated
+	LNBackendType           string   `envconfig:"LN_BACKEND_TYPE" default:"ALBY"`
+	LNDAddress              string   `envconfig:"LND_ADDRESS"`
+	LNDCertFile             string   `envconfig:"LND_CERT_FILE"`
+	LNDMacaroonFile         string   `envconfig:"LND_MACAROON_FILE"`
+	LNDPaymentTimeout       int      `envconfig:"LND_PAYMENT_TIMEOUT" default:"50"`       // seconds
+	LNDFeeLimitPpm          int64    `envconfig:"LND_FEE_LIMIT_PPM" default:"10000"`      // 1%
+	LNDFeeLimitMinMsat      int64    `envconfig:"LND_FEE_LIMIT_MIN_MSAT" default:"10000"` // 10 sats
+	CLNAddress              string   `envconfig:"CLN_ADDRESS"`
+	CLNRune                 string   `envconfig:"CLN_RUNE"`
+	CLNCertFile             string   `envconfig:"CLN_CERT_FILE"`
+	LNbitsURL               string   `envconfig:"LNBITS_URL"`
+	LNbitsAdminKey          string   `envconfig:"LNBITS_ADMIN_KEY"` // if empty, every user connects their own wallet
+	PhoenixdAddress         string   `envconfig:"PHOENIXD_ADDRESS" default:"http://127.0.0.1:9740"`
+	PhoenixdAuthorization   string   `envconfig:"PHOENIXD_AUTHORIZATION"`
+	AlbyAPIURL              string   `envconfig:"ALBY_API_URL" default:"https://api.getalby.com"`
+	AlbyClientId            string   `envconfig:"ALBY_CLIENT_ID"`
+	AlbyClientSecret        string   `envconfig:"ALBY_CLIENT_SECRET"`
+	OAuthRedirectUrl        string   `envconfig:"OAUTH_REDIRECT_URL"`
+	OAuthAuthUrl            string   `envconfig:"OAUTH_AUTH_URL" default:"https://getalby.com/oauth"`
+	OAuthTokenUrl           string   `envconfig:"OAUTH_TOKEN_URL" default:"https://api.getalby.com/oauth/token"`
+	Port                    string   `envconfig:"PORT" default:"8080"`
+	DatabaseUri             string   `envconfig:"DATABASE_URI" default:"nostr-wallet-connect.db"`
+	DatabaseMaxConns        int      `envconfig:"DATABASE_MAX_CONNS" default:"10"`
+	DatabaseMaxIdleConns    int      `envconfig:"DATABASE_MAX_IDLE_CONNS" default:"5"`
+	DatabaseConnMaxLifetime int      `envconfig:"DATABASE_CONN_MAX_LIFETIME" default:"1800"` // 30 minutes
+	StoredEventMaxAge       int      `envconfig:"STORED_EVENT_MAX_AGE" default:"300"`        // 5 minutes
+	EventTimeWindow         int      `envconfig:"EVENT_TIME_WINDOW" default:"300"`           // 5 minutes
+	EventWorkers            int      `envconfig:"EVENT_WORKERS" default:"5"`
+	EventQueueSize          int      `envconfig:"EVENT_QUEUE_SIZE" default:"10"` // per app
+	EventQueueTotalSize     int      `envconfig:"EVENT_QUEUE_TOTAL_SIZE" default:"1000"`
 	IdentityPubkey          string
 }
+
+// SingleUser is true if all apps share the wallet of the node and nobody needs to log in
+func (cfg *Config) SingleUser() bool {
+	switch cfg.LNBackendType {
+	case LNDBackendType, LNDRestBackendType, CLNBackendType, PhoenixdBackendType:
+		return true
+	case LNbitsBackendType:
+		return cfg.LNbitsAdminKey != ""
+	}
+	return false
+}
+
+// Validate checks the settings which depend on each other
+func (cfg *Config) Validate() error {
+	// stored events are validated like live ones, older events would be rejected anyway
+	if cfg.StoredEventMaxAge > cfg.EventTimeWindow {
+		return fmt.Errorf("STORED_EVENT_MAX_AGE (%d) must not be greater than EVENT_TIME_WINDOW (%d)", cfg.StoredEventMaxAge, cfg.EventTimeWindow)
+	}
+	if cfg.EventWorkers <= 0 {
+		return fmt.Errorf("EVENT_WORKERS (%d) must be greater than 0", cfg.EventWorkers)
+	}
+	if cfg.EventQueueSize <= 0 || cfg.EventQueueTotalSize <= 0 {
+		return fmt.Errorf("EVENT_QUEUE_SIZE (%d) and EVENT_QUEUE_TOTAL_SIZE (%d) must be greater than 0", cfg.EventQueueSize, cfg.EventQueueTotalSize)
+	}
+	return nil
+}
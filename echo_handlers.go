@@ -8,11 +8,13 @@ import (
 	"html/template"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	echologrus "github.com/davrux/echo-logrus/v4"
 	"github.com/gorilla/sessions"
@@ -55,6 +57,10 @@ func (svc *Service) RegisterSharedRoutes(e *echo.Echo) {
 	templates["alby/index.html"] = template.Must(template.ParseFS(embeddedViews, "views/backends/alby/index.html", "views/layout.html"))
 	templates["about.html"] = template.Must(template.ParseFS(embeddedViews, "views/about.html", "views/layout.html"))
 	templates["lnd/index.html"] = template.Must(template.ParseFS(embeddedViews, "views/backends/lnd/index.html", "views/layout.html"))
+	templates["lnd_rest/index.html"] = templates["lnd/index.html"]
+	templates["cln/index.html"] = template.Must(template.ParseFS(embeddedViews, "views/backends/cln/index.html", "views/layout.html"))
+	templates["lnbits/index.html"] = template.Must(template.ParseFS(embeddedViews, "views/backends/lnbits/index.html", "views/layout.html"))
+	templates["phoenixd/index.html"] = template.Must(template.ParseFS(embeddedViews, "views/backends/phoenixd/index.html", "views/layout.html"))
 	e.Renderer = &TemplateRegistry{
 		templates: templates,
 	}
@@ -80,6 +86,7 @@ func (svc *Service) RegisterSharedRoutes(e *echo.Echo) {
 	e.POST("/apps/delete/:id", svc.AppsDeleteHandler)
 	e.GET("/logout", svc.LogoutHandler)
 	e.GET("/about", svc.AboutHandler)
+	e.GET("/api/health", svc.HealthHandler)
 	e.GET("/", svc.IndexHandler)
 }
 
@@ -103,7 +110,10 @@ func (svc *Service) IndexHandler(c echo.Context) error {
 	if user != nil {
 		return c.Redirect(302, "/apps")
 	}
-	return c.Render(http.StatusOK, fmt.Sprintf("%s/index.html", strings.ToLower(svc.cfg.LNBackendType)), map[string]interface{}{})
+	csrf, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	return c.Render(http.StatusOK, fmt.Sprintf("%s/index.html", strings.ToLower(svc.cfg.LNBackendType)), map[string]interface{}{
+		"Csrf": csrf,
+	})
 }
 
 func (svc *Service) AboutHandler(c echo.Context) error {
@@ -116,6 +126,50 @@ func (svc *Service) AboutHandler(c echo.Context) error {
 	})
 }
 
+// HealthHandler reports the relay connections, it fails if no relay is connected.
+// The state of every relay is only shown to a logged in user, for the relays the user's apps are reached on.
+func (svc *Service) HealthHandler(c echo.Context) error {
+	relays := []RelayHealth{}
+	if svc.relayPool != nil {
+		relays = svc.relayPool.Health()
+	}
+	status := http.StatusServiceUnavailable
+	connectedRelays := 0
+	for _, relay := range relays {
+		if relay.Connected {
+			status = http.StatusOK
+			connectedRelays++
+		}
+	}
+	var pendingEvents int64
+	svc.db.Model(&OutboxEvent{}).Where("state = ?", "pending").Count(&pendingEvents)
+	response := map[string]interface{}{
+		"healthy":          status == http.StatusOK,
+		"relays_connected": connectedRelays,
+		"relays_total":     len(relays),
+		"pending_events":   pendingEvents,
+	}
+
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		userRelays := append([]string{}, svc.cfg.Relays...)
+		for i := range user.Apps {
+			userRelays = append(userRelays, svc.getRelays(&user.Apps[i])...)
+		}
+		relayDetails := []RelayHealth{}
+		for _, relay := range relays {
+			if containsString(userRelays, relay.Url) {
+				relayDetails = append(relayDetails, relay)
+			}
+		}
+		response["relays"] = relayDetails
+	}
+	return c.JSON(status, response)
+}
+
 func (svc *Service) AppsListHandler(c echo.Context) error {
 	user, err := svc.GetUser(c)
 	if err != nil {
@@ -163,8 +217,36 @@ func (svc *Service) AppsShowHandler(c echo.Context) error {
 	var eventsCount int64
 	svc.db.Model(&NostrEvent{}).Where("app_id = ?", app.ID).Count(&eventsCount)
 
+	// delivery of the responses and notifications of the app
+	var pendingEventsCount, failedEventsCount, retriesCount int64
+	svc.db.Model(&OutboxEvent{}).Where("app_id = ? AND state = ?", app.ID, "pending").Count(&pendingEventsCount)
+	svc.db.Model(&OutboxEvent{}).Where("app_id = ? AND state = ?", app.ID, "failed").Count(&failedEventsCount)
+	svc.db.Model(&OutboxEvent{}).Where("app_id = ?", app.ID).Select("COALESCE(SUM(retries), 0)").Scan(&retriesCount)
+
+	appPermissions := []AppPermission{}
+	svc.db.Where("app_id = ?", app.ID).Find(&appPermissions)
+
+	requestMethods := []string{}
 	appPermission := AppPermission{}
-	svc.db.Where("app_id = ? AND request_method = ?", app.ID, NIP_47_PAY_INVOICE_METHOD).First(&appPermission)
+	for _, permission := range appPermissions {
+		description := nip47MethodDescriptions[permission.RequestMethod]
+		if rateLimit := getRateLimitString(&permission); rateLimit != "" {
+			description = fmt.Sprintf("%s (%s)", description, rateLimit)
+		}
+		requestMethods = append(requestMethods, description)
+		if permission.RequestMethod == NIP_47_PAY_INVOICE_METHOD || (permission.RequestMethod == NIP_47_PAY_KEYSEND_METHOD && appPermission.ID == 0) {
+			appPermission = permission
+		}
+	}
+	if len(appPermissions) == 0 {
+		// apps without any permissions can use every method
+		for _, requestMethod := range strings.Fields(NIP_47_CAPABILITIES) {
+			// multi_pay_* methods are covered by the pay_* permissions
+			if description, ok := nip47MethodDescriptions[requestMethod]; ok {
+				requestMethods = append(requestMethods, description)
+			}
+		}
+	}
 
 	renewsIn := ""
 	budgetUsage := int64(0)
@@ -177,17 +259,35 @@ func (svc *Service) AppsShowHandler(c echo.Context) error {
 	}
 
 	return c.Render(http.StatusOK, "apps/show.html", map[string]interface{}{
-		"App":           app,
-		"AppPermission": appPermission,
-		"User":          user,
-		"LastEvent":     lastEvent,
-		"EventsCount":   eventsCount,
-		"BudgetUsage":   budgetUsage,
-		"RenewsIn":      renewsIn,
-		"Csrf":          csrf,
+		"App":                app,
+		"AppPermission":      appPermission,
+		"RequestMethods":     requestMethods,
+		"User":               user,
+		"LastEvent":          lastEvent,
+		"EventsCount":        eventsCount,
+		"PendingEventsCount": pendingEventsCount,
+		"FailedEventsCount":  failedEventsCount,
+		"RetriesCount":       retriesCount,
+		"BudgetUsage":        budgetUsage,
+		"RenewsIn":           renewsIn,
+		"Csrf":               csrf,
 	})
 }
 
+func getRateLimitString(appPermission *AppPermission) string {
+	limits := []string{}
+	if appPermission.RateLimitPerMinute > 0 {
+		limits = append(limits, fmt.Sprintf("%d per minute", appPermission.RateLimitPerMinute))
+	}
+	if appPermission.RateLimitPerHour > 0 {
+		limits = append(limits, fmt.Sprintf("%d per hour", appPermission.RateLimitPerHour))
+	}
+	if len(limits) == 0 {
+		return ""
+	}
+	return "max. " + strings.Join(limits, ", ")
+}
+
 func getEndOfBudgetString(endOfBudget time.Time) (result string) {
 	if endOfBudget.IsZero() {
 		return "--"
@@ -224,6 +324,25 @@ func (svc *Service) AppsNewHandler(c echo.Context) error {
 	if expiresAtTimestamp, err := strconv.Atoi(expiresAt); err == nil {
     expiresAt = time.Unix(int64(expiresAtTimestamp), 0).Format(time.RFC3339)
 	}
+	requestMethods := c.QueryParam("request_methods") // space separated list of NIP-47 methods
+	if requestMethods == "" {
+		requestMethods = NIP_47_CAPABILITIES + " " + NIP_47_NOTIFICATIONS_PERMISSION
+	}
+	enabledRequestMethods := make(map[string]bool)
+	for _, requestMethod := range strings.Fields(requestMethods) {
+		enabledRequestMethods[requestMethod] = true
+	}
+	nip44Only := c.QueryParam("encryption") == NIP_47_ENCRYPTION_NIP44_V2
+	relays, err := parseRelays(strings.Join(c.QueryParams()["relay"], " ")) // the relays the app listens on, can be repeated
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"pubkey": pubkey,
+			"name":   appName,
+		}).Errorf("Invalid relays: %v", err)
+		return c.Redirect(302, "/apps")
+	}
+	rateLimitPerMinute := c.QueryParam("rate_limit_per_minute")
+	rateLimitPerHour := c.QueryParam("rate_limit_per_hour")
 	disabled := c.QueryParam("editable") == "false"
 	budgetEnabled := maxAmount != "" || budgetRenewal != ""
 	csrf, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
@@ -245,16 +364,23 @@ func (svc *Service) AppsNewHandler(c echo.Context) error {
 	}
 
 	return c.Render(http.StatusOK, "apps/new.html", map[string]interface{}{
-		"User":          user,
-		"Name":          appName,
-		"Pubkey":        pubkey,
-		"ReturnTo":      returnTo,
-		"MaxAmount":     maxAmount,
-		"BudgetRenewal": budgetRenewal,
-		"ExpiresAt":     expiresAt,
-		"BudgetEnabled": budgetEnabled,
-		"Disabled":      disabled,
-		"Csrf":          csrf,
+		"User":                    user,
+		"Name":                    appName,
+		"Pubkey":                  pubkey,
+		"ReturnTo":                returnTo,
+		"MaxAmount":               maxAmount,
+		"BudgetRenewal":           budgetRenewal,
+		"ExpiresAt":               expiresAt,
+		"BudgetEnabled":           budgetEnabled,
+		"RequestMethods":          enabledRequestMethods,
+		"Nip47MethodDescriptions": nip47MethodDescriptions,
+		"Nip44Only":               nip44Only,
+		"Relays":                  strings.Join(relays, " "),
+		"DefaultRelays":           strings.Join(svc.cfg.Relays, " "),
+		"RateLimitPerMinute":      rateLimitPerMinute,
+		"RateLimitPerHour":        rateLimitPerHour,
+		"Disabled":                disabled,
+		"Csrf":                    csrf,
 	})
 }
 
@@ -282,10 +408,29 @@ func (svc *Service) AppsCreateHandler(c echo.Context) error {
 			return c.Redirect(302, "/apps")
 		}
 	}
-	app := App{Name: name, NostrPubkey: pairingPublicKey}
+	relays, err := parseRelays(c.FormValue("Relays"))
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"pairingPublicKey": pairingPublicKey,
+			"name":             name,
+		}).Errorf("Invalid relays: %v", err)
+		return c.Redirect(302, "/apps")
+	}
+	app := App{Name: name, NostrPubkey: pairingPublicKey, Nip44Only: c.FormValue("Nip44Only") == "true", Relays: relays}
 	maxAmount, _ := strconv.Atoi(c.FormValue("MaxAmount"))
 	budgetRenewal := c.FormValue("BudgetRenewal")
 	expiresAt, _ := time.Parse(time.RFC3339, c.FormValue("ExpiresAt"))
+	rateLimitPerMinute, _ := strconv.Atoi(c.FormValue("RateLimitPerMinute"))
+	rateLimitPerHour, _ := strconv.Atoi(c.FormValue("RateLimitPerHour"))
+	formParams, _ := c.FormParams()
+	requestMethods := formParams["RequestMethods"]
+	if len(requestMethods) == 0 {
+		svc.Logger.WithFields(logrus.Fields{
+			"pairingPublicKey": pairingPublicKey,
+			"name":             name,
+		}).Error("Won't create an app without request methods")
+		return c.Redirect(302, "/apps")
+	}
 	if !expiresAt.IsZero() {
 		expiresAt = time.Date(expiresAt.Year(), expiresAt.Month(), expiresAt.Day(), 23, 59, 59, 0, expiresAt.Location())
 	}
@@ -296,14 +441,26 @@ func (svc *Service) AppsCreateHandler(c echo.Context) error {
 			return err
 		}
 
-		if maxAmount > 0 || !expiresAt.IsZero() {
+		for _, requestMethod := range requestMethods {
+			//if we don't know this method, we refuse to create the app
+			if _, ok := nip47MethodDescriptions[requestMethod]; !ok {
+				return fmt.Errorf("Did not recognize request method: %s", requestMethod)
+			}
 			appPermission := AppPermission{
 				App:           app,
-				RequestMethod: NIP_47_PAY_INVOICE_METHOD,
-				MaxAmount:     maxAmount,
-				BudgetRenewal: budgetRenewal,
+				RequestMethod: requestMethod,
 				ExpiresAt:     expiresAt,
 			}
+			//the budget only applies to methods that spend funds
+			if requestMethod == NIP_47_PAY_INVOICE_METHOD || requestMethod == NIP_47_PAY_KEYSEND_METHOD {
+				appPermission.MaxAmount = maxAmount
+				appPermission.BudgetRenewal = budgetRenewal
+			}
+			//notifications and list_all_transactions are not requested by the app
+			if requestMethod != NIP_47_NOTIFICATIONS_PERMISSION && requestMethod != NIP_47_LIST_ALL_TRANSACTIONS_PERMISSION {
+				appPermission.RateLimitPerMinute = rateLimitPerMinute
+				appPermission.RateLimitPerHour = rateLimitPerHour
+			}
 
 			err = tx.Create(&appPermission).Error
 			if err != nil {
@@ -323,11 +480,18 @@ func (svc *Service) AppsCreateHandler(c echo.Context) error {
 		return c.Redirect(302, "/apps")
 	}
 
+	//start listening on relays no other app uses yet
+	if svc.relayPool != nil {
+		svc.relayPool.AddRelays(app.Relays...)
+	}
+
 	if c.FormValue("returnTo") != "" {
 		returnToUrl, err := url.Parse(c.FormValue("returnTo"))
 		if err == nil {
 			query := returnToUrl.Query()
-			query.Add("relay", svc.cfg.Relay)
+			for _, relay := range svc.getRelays(&app) {
+				query.Add("relay", relay)
+			}
 			query.Add("pubkey", svc.cfg.IdentityPubkey)
 			if user.LightningAddress != "" {
 				query.Add("lud16", user.LightningAddress)
@@ -337,11 +501,15 @@ func (svc *Service) AppsCreateHandler(c echo.Context) error {
 		}
 	}
 
-	var lud16 string
+	pairingQuery := []string{}
+	for _, relay := range svc.getRelays(&app) {
+		pairingQuery = append(pairingQuery, "relay="+url.QueryEscape(relay))
+	}
+	pairingQuery = append(pairingQuery, "secret="+pairingSecretKey)
 	if user.LightningAddress != "" {
-		lud16 = fmt.Sprintf("&lud16=%s", user.LightningAddress)
+		pairingQuery = append(pairingQuery, "lud16="+url.QueryEscape(user.LightningAddress))
 	}
-	pairingUri := template.URL(fmt.Sprintf("nostr+walletconnect://%s?relay=%s&secret=%s%s", svc.cfg.IdentityPubkey, svc.cfg.Relay, pairingSecretKey, lud16))
+	pairingUri := template.URL(fmt.Sprintf("nostr+walletconnect://%s?%s", svc.cfg.IdentityPubkey, strings.Join(pairingQuery, "&")))
 	return c.Render(http.StatusOK, "apps/create.html", map[string]interface{}{
 		"User":          user,
 		"PairingUri":    pairingUri,
@@ -362,6 +530,10 @@ func (svc *Service) AppsDeleteHandler(c echo.Context) error {
 	app := App{}
 	svc.db.Where("user_id = ?", user.ID).First(&app, c.Param("id"))
 	svc.db.Delete(&app)
+	//stop listening on relays no other app uses anymore
+	if svc.relayPool != nil {
+		svc.relayPool.RemoveRelays(svc.getUnusedRelays(app.Relays)...)
+	}
 	return c.Redirect(302, "/apps")
 }
 
@@ -374,3 +546,44 @@ func (svc *Service) LogoutHandler(c echo.Context) error {
 	sess.Save(c.Request(), c.Response())
 	return c.Redirect(302, "/")
 }
+
+// parseRelays parses a comma or space separated list of relay URLs.
+// The relays are chosen by the app, so only public wss:// relays are accepted to not let it reach internal services.
+func parseRelays(value string) (relays []string, err error) {
+	for _, relay := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		relayUrl, err := url.Parse(relay)
+		if err != nil || relayUrl.Scheme != "wss" || relayUrl.Hostname() == "" {
+			return nil, fmt.Errorf("Invalid relay URL: %s", relay)
+		}
+		if !isPublicHost(relayUrl.Hostname()) {
+			return nil, fmt.Errorf("Relay URL is not public: %s", relay)
+		}
+		relays = append(relays, relay)
+	}
+	return relays, nil
+}
+
+// lookupRelayHost resolves the host of a relay, it can be replaced in tests
+var lookupRelayHost = net.LookupIP
+
+// isPublicHost returns false if the host is or resolves to a loopback, private, link-local or unspecified address
+func isPublicHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		ips, err = lookupRelayHost(host)
+		if err != nil || len(ips) == 0 {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/getAlby/nostr-wallet-connect/nip44"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// getEncryption returns the encryption scheme used by a request.
+// Clients can announce it with an "encryption" tag, otherwise it is detected from the content:
+// NIP-04 payloads always contain the "?iv=" separator, NIP-44 payloads are plain base64.
+func getEncryption(event *nostr.Event) string {
+	if tag := event.Tags.GetFirst([]string{"encryption"}); tag != nil {
+		for _, encryption := range strings.Fields(tag.Value()) {
+			if encryption == NIP_47_ENCRYPTION_NIP44_V2 || encryption == NIP_47_ENCRYPTION_NIP04 {
+				return encryption
+			}
+		}
+	}
+	if strings.Contains(event.Content, "?iv=") {
+		return NIP_47_ENCRYPTION_NIP04
+	}
+	return NIP_47_ENCRYPTION_NIP44_V2
+}
+
+// ss is the ECDH shared secret from nip04.ComputeSharedSecret; NIP-44 derives its conversation key from it
+func decryptContent(encryption string, content string, ss []byte) (string, error) {
+	switch encryption {
+	case NIP_47_ENCRYPTION_NIP04:
+		return nip04.Decrypt(content, ss)
+	case NIP_47_ENCRYPTION_NIP44_V2:
+		return nip44.Decrypt(content, nip44.GenerateConversationKey(ss))
+	}
+	return "", errors.New("Unsupported encryption: " + encryption)
+}
+
+func encryptContent(encryption string, content string, ss []byte) (string, error) {
+	switch encryption {
+	case NIP_47_ENCRYPTION_NIP04:
+		return nip04.Encrypt(content, ss)
+	case NIP_47_ENCRYPTION_NIP44_V2:
+		return nip44.Encrypt(content, nip44.GenerateConversationKey(ss))
+	}
+	return "", errors.New("Unsupported encryption: " + encryption)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// requests of pubkeys without an app share one queue, so they cannot grow the queue without limit
+const unknownAppQueueKey = ""
+
+// eventQueue buffers incoming requests per app pubkey and hands them out round-robin,
+// so a single app sending a flood of requests cannot starve the others.
+type eventQueue struct {
+	mutex   sync.Mutex
+	maxSize int
+	// the maximum number of events of all apps
+	maxTotalSize int
+	totalSize    int
+	queues       map[string][]RelayEvent
+	// pubkeys with queued events, in the order they are served
+	order []string
+	// signals workers that events are queued
+	notify chan struct{}
+}
+
+func newEventQueue(maxSize int, maxTotalSize int) *eventQueue {
+	return &eventQueue{
+		maxSize:      maxSize,
+		maxTotalSize: maxTotalSize,
+		queues:       make(map[string][]RelayEvent),
+		notify:       make(chan struct{}, 1),
+	}
+}
+
+// push queues the event, it returns false if the queue of the pubkey or the whole queue is full
+func (queue *eventQueue) push(pubkey string, relayEvent RelayEvent) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	pending := queue.queues[pubkey]
+	if len(pending) >= queue.maxSize || queue.totalSize >= queue.maxTotalSize {
+		return false
+	}
+	if len(pending) == 0 {
+		queue.order = append(queue.order, pubkey)
+	}
+	queue.queues[pubkey] = append(pending, relayEvent)
+	queue.totalSize++
+	queue.signal()
+	return true
+}
+
+// pop blocks until an event is queued or ctx is canceled
+func (queue *eventQueue) pop(ctx context.Context) (RelayEvent, bool) {
+	for {
+		queue.mutex.Lock()
+		if len(queue.order) > 0 {
+			pubkey := queue.order[0]
+			queue.order = queue.order[1:]
+			pending := queue.queues[pubkey]
+			relayEvent := pending[0]
+			queue.totalSize--
+			if len(pending) > 1 {
+				queue.queues[pubkey] = pending[1:]
+				// serve the other apps first
+				queue.order = append(queue.order, pubkey)
+			} else {
+				delete(queue.queues, pubkey)
+			}
+			// wake up another worker for the remaining events
+			if len(queue.order) > 0 {
+				queue.signal()
+			}
+			queue.mutex.Unlock()
+			return relayEvent, true
+		}
+		queue.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return RelayEvent{}, false
+		case <-queue.notify:
+		}
+	}
+}
+
+func (queue *eventQueue) signal() {
+	select {
+	case queue.notify <- struct{}{}:
+	default:
+	}
+}
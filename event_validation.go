@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	ErrInvalidEventId        = errors.New("Event id does not match the event")
+	ErrInvalidEventSignature = errors.New("Event signature is invalid")
+	ErrEventTooOld           = errors.New("Event is too old")
+	ErrEventInTheFuture      = errors.New("Event is too far in the future")
+	ErrEventExpired          = errors.New("Event is expired")
+)
+
+// verifyEvent rejects forged events. Relays are not trusted to verify events,
+// and forged events are dropped without a reply, so they cannot make the service sign and publish events.
+func verifyEvent(event *nostr.Event) error {
+	if event.GetID() != event.ID {
+		return ErrInvalidEventId
+	}
+	ok, err := event.CheckSignature()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEventSignature, err)
+	}
+	if !ok {
+		return ErrInvalidEventSignature
+	}
+	return nil
+}
+
+// validateEvent rejects forged and stale requests.
+// Requests must not be replayed long after they were created.
+func validateEvent(event *nostr.Event, timeWindow time.Duration, now time.Time) error {
+	err := verifyEvent(event)
+	if err != nil {
+		return err
+	}
+
+	if event.CreatedAt.Before(now.Add(-timeWindow)) {
+		return ErrEventTooOld
+	}
+	if event.CreatedAt.After(now.Add(timeWindow)) {
+		return ErrEventInTheFuture
+	}
+
+	// NIP-40
+	if tag := event.Tags.GetFirst([]string{"expiration"}); tag != nil {
+		expiration, err := strconv.ParseInt(tag.Value(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid expiration tag %q", ErrEventExpired, tag.Value())
+		}
+		if now.Unix() >= expiration {
+			return ErrEventExpired
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandleGetBalanceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+	nostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", event.ID).First(&nostrEvent).Error
+	if err != nil {
+		return nil, err
+	}
+
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, 0)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+			Code:    code,
+			Message: message,
+		}}, nostr.Tags{}, ss)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":   event.ID,
+		"eventKind": event.Kind,
+		"appId":     app.ID,
+	}).Info("Fetching balance")
+
+	balance, err := svc.lnClient.GetBalance(ctx, event.PubKey)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Infof("Failed to fetch balance: %v", err)
+		nostrEvent.State = "error"
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			Error: &Nip47Error{
+				Code:    NIP_47_ERROR_INTERNAL,
+				Message: fmt.Sprintf("Something went wrong while fetching balance: %s", err.Error()),
+			},
+		}, nostr.Tags{}, ss)
+	}
+
+	nostrEvent.State = "executed"
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: NIP_47_GET_BALANCE_METHOD,
+		Result: Nip47BalanceResponse{
+			Balance: balance,
+		},
+	}, nostr.Tags{}, ss)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// the creation time of a transaction in the backend can differ slightly from the one of its row
+	appTransactionsCreatedAtMargin = time.Minute
+	listTransactionsDefaultLimit   = 20
+	listTransactionsMaxLimit       = 100
+)
+
+func (svc *Service) HandleListTransactionsEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+	nostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", event.ID).First(&nostrEvent).Error
+	if err != nil {
+		return nil, err
+	}
+
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, 0)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+			Code:    code,
+			Message: message,
+		}}, nostr.Tags{}, ss)
+	}
+
+	listParams := &Nip47ListTransactionsParams{}
+	err = json.Unmarshal(request.Params, listParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if listParams.Limit == 0 {
+		listParams.Limit = listTransactionsDefaultLimit
+	}
+	if listParams.Limit > listTransactionsMaxLimit {
+		listParams.Limit = listTransactionsMaxLimit
+	}
+
+	// unless explicitly allowed, an app only sees the transactions it created
+	canListAllTransactions := svc.hasExplicitPermission(&app, NIP_47_LIST_ALL_TRANSACTIONS_PERMISSION)
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":   event.ID,
+		"eventKind": event.Kind,
+		"appId":     app.ID,
+		"from":      listParams.From,
+		"until":     listParams.Until,
+		"limit":     listParams.Limit,
+		"offset":    listParams.Offset,
+		"unpaid":    listParams.Unpaid,
+		"type":      listParams.Type,
+		"scoped":    !canListAllTransactions,
+	}).Info("Fetching transactions")
+
+	var transactions []Nip47Transaction
+	if canListAllTransactions {
+		transactions, err = svc.lnClient.ListTransactions(ctx, event.PubKey, listParams.From, listParams.Until, listParams.Limit, listParams.Offset, listParams.Unpaid, listParams.Type)
+	} else {
+		transactions, err = svc.listAppTransactions(ctx, &app, event, listParams)
+	}
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Infof("Failed to fetch transactions: %v", err)
+		nostrEvent.State = "error"
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			Error: &Nip47Error{
+				Code:    NIP_47_ERROR_INTERNAL,
+				Message: fmt.Sprintf("Something went wrong while fetching transactions: %s", err.Error()),
+			},
+		}, nostr.Tags{}, ss)
+	}
+
+	nostrEvent.State = "executed"
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: NIP_47_LIST_TRANSACTIONS_METHOD,
+		Result: Nip47ListTransactionsResponse{
+			Transactions: transactions,
+		},
+	}, nostr.Tags{}, ss)
+}
+
+// listAppTransactions returns the payments and invoices the app created, newest first.
+// Rows are read in batches until enough transactions match the filters, and only transactions
+// which did not reach a final state yet are looked up in the LN backend.
+func (svc *Service) listAppTransactions(ctx context.Context, app *App, event *nostr.Event, listParams *Nip47ListTransactionsParams) (transactions []Nip47Transaction, err error) {
+	wanted := listParams.Offset + listParams.Limit
+	seen := make(map[string]bool)
+	for rowsOffset := uint64(0); ; rowsOffset += wanted {
+		rows, err := svc.findAppTransactionRows(app, listParams, rowsOffset, wanted)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			transaction, err := svc.getAppTransaction(ctx, event, row)
+			if err != nil {
+				return nil, err
+			}
+			if transaction == nil || seen[transaction.PaymentHash] {
+				continue
+			}
+			seen[transaction.PaymentHash] = true
+			if matchesTransactionFilter(transaction, listParams.From, listParams.Until, listParams.Unpaid, listParams.Type) {
+				transactions = append(transactions, *transaction)
+			}
+		}
+		if uint64(len(transactions)) >= wanted || uint64(len(rows)) < wanted {
+			break
+		}
+	}
+	return filterTransactions(transactions, listParams.From, listParams.Until, listParams.Limit, listParams.Offset, listParams.Unpaid, listParams.Type), nil
+}
+
+// appTransactionRow is a payment or invoice created by an app
+type appTransactionRow struct {
+	Kind      string
+	ID        uint
+	CreatedAt time.Time
+}
+
+// findAppTransactionRows returns the payments and invoices of the app which can match the filters, newest first
+func (svc *Service) findAppTransactionRows(app *App, listParams *Nip47ListTransactionsParams, offset, limit uint64) (rows []appTransactionRow, err error) {
+	conditions := "app_id = ?"
+	args := []interface{}{app.ID}
+	if listParams.From != 0 {
+		conditions += " AND created_at >= ?"
+		args = append(args, time.Unix(int64(listParams.From), 0).Add(-appTransactionsCreatedAtMargin))
+	}
+	if listParams.Until != 0 {
+		conditions += " AND created_at <= ?"
+		args = append(args, time.Unix(int64(listParams.Until), 0).Add(appTransactionsCreatedAtMargin))
+	}
+
+	queries := []string{}
+	queryArgs := []interface{}{}
+	if listParams.Type != "incoming" {
+		query := "SELECT 'payment' AS kind, id, created_at FROM payments WHERE " + conditions
+		if !listParams.Unpaid {
+			query += " AND state = 'succeeded'"
+		}
+		queries = append(queries, query)
+		queryArgs = append(queryArgs, args...)
+	}
+	if listParams.Type != "outgoing" {
+		queries = append(queries, "SELECT 'invoice' AS kind, id, created_at FROM invoices WHERE "+conditions)
+		queryArgs = append(queryArgs, args...)
+	}
+	if len(queries) == 0 {
+		return rows, nil
+	}
+
+	queryArgs = append(queryArgs, limit, offset)
+	err = svc.db.Raw(strings.Join(queries, " UNION ALL ")+" ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?", queryArgs...).Scan(&rows).Error
+	return rows, err
+}
+
+// getAppTransaction returns the transaction of the payment or invoice, or nil if the LN backend does not know it.
+// Transactions in a final state are stored, so they are not looked up again.
+func (svc *Service) getAppTransaction(ctx context.Context, event *nostr.Event, row appTransactionRow) (*Nip47Transaction, error) {
+	var paymentHash string
+	var transaction *Nip47Transaction
+	var storeTransaction func(transaction *Nip47Transaction) error
+	if row.Kind == "payment" {
+		payment := Payment{}
+		err := svc.db.First(&payment, row.ID).Error
+		if err != nil {
+			return nil, err
+		}
+		paymentHash, transaction = payment.PaymentHash, payment.Nip47Transaction
+		storeTransaction = func(transaction *Nip47Transaction) error {
+			return svc.db.Model(&payment).Updates(&Payment{Nip47Transaction: transaction}).Error
+		}
+	} else {
+		invoice := Invoice{}
+		err := svc.db.First(&invoice, row.ID).Error
+		if err != nil {
+			return nil, err
+		}
+		paymentHash, transaction = invoice.PaymentHash, invoice.Nip47Transaction
+		storeTransaction = func(transaction *Nip47Transaction) error {
+			return svc.db.Model(&invoice).Updates(&Invoice{Nip47Transaction: transaction}).Error
+		}
+	}
+	if transaction != nil {
+		return transaction, nil
+	}
+	if paymentHash == "" {
+		return nil, nil
+	}
+
+	transaction, err := svc.lnClient.LookupInvoice(ctx, event.PubKey, paymentHash)
+	if errors.Is(err, ErrTransactionNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isFinalTransactionState(transaction.State) {
+		err = storeTransaction(transaction)
+		if err != nil {
+			svc.Logger.WithError(err).WithField("paymentHash", paymentHash).Error("Failed to store transaction")
+		}
+	}
+	return transaction, nil
+}
+
+// isFinalTransactionState returns true if a transaction in the state cannot change anymore
+func isFinalTransactionState(state string) bool {
+	return state == NIP_47_TRANSACTION_STATE_SETTLED || state == NIP_47_TRANSACTION_STATE_EXPIRED || state == NIP_47_TRANSACTION_STATE_FAILED
+}
+
+// isAppTransaction returns true if the app created the invoice or sent the payment with the payment hash
+func (svc *Service) isAppTransaction(app *App, paymentHash string) (bool, error) {
+	var invoicesCount int64
+	err := svc.db.Model(&Invoice{}).Where("app_id = ? AND payment_hash = ?", app.ID, paymentHash).Count(&invoicesCount).Error
+	if err != nil || invoicesCount > 0 {
+		return invoicesCount > 0, err
+	}
+	var paymentsCount int64
+	err = svc.db.Model(&Payment{}).Where("app_id = ? AND payment_hash = ?", app.ID, paymentHash).Count(&paymentsCount).Error
+	return paymentsCount > 0, err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandleLookupInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+	nostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", event.ID).First(&nostrEvent).Error
+	if err != nil {
+		return nil, err
+	}
+
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, 0)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+			Code:    code,
+			Message: message,
+		}}, nostr.Tags{}, ss)
+	}
+
+	lookupInvoiceParams := &Nip47LookupInvoiceParams{}
+	err = json.Unmarshal(request.Params, lookupInvoiceParams)
+	if err != nil {
+		return nil, err
+	}
+
+	paymentHash := lookupInvoiceParams.PaymentHash
+	if paymentHash == "" && lookupInvoiceParams.Invoice != "" {
+		paymentRequest, err := decodepay.Decodepay(lookupInvoiceParams.Invoice)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"eventId":   event.ID,
+				"eventKind": event.Kind,
+				"appId":     app.ID,
+				"bolt11":    lookupInvoiceParams.Invoice,
+			}).Errorf("Failed to decode bolt11 invoice: %v", err)
+			return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+				Code:    NIP_47_ERROR_OTHER,
+				Message: fmt.Sprintf("Failed to decode bolt11 invoice: %s", err.Error()),
+			}}, nostr.Tags{}, ss)
+		}
+		paymentHash = paymentRequest.PaymentHash
+	}
+	if paymentHash == "" {
+		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+			Code:    NIP_47_ERROR_OTHER,
+			Message: "Either payment_hash or invoice is required",
+		}}, nostr.Tags{}, ss)
+	}
+
+	// unless explicitly allowed, an app only sees the transactions it created
+	canLookupAllTransactions := svc.hasExplicitPermission(&app, NIP_47_LIST_ALL_TRANSACTIONS_PERMISSION)
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":     event.ID,
+		"eventKind":   event.Kind,
+		"appId":       app.ID,
+		"paymentHash": paymentHash,
+		"scoped":      !canLookupAllTransactions,
+	}).Info("Looking up invoice")
+
+	var transaction *Nip47Transaction
+	if !canLookupAllTransactions {
+		var isAppTransaction bool
+		isAppTransaction, err = svc.isAppTransaction(&app, paymentHash)
+		if err == nil && !isAppTransaction {
+			err = ErrTransactionNotFound
+		}
+	}
+	if err == nil {
+		transaction, err = svc.lnClient.LookupInvoice(ctx, event.PubKey, paymentHash)
+	}
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":     event.ID,
+			"eventKind":   event.Kind,
+			"appId":       app.ID,
+			"paymentHash": paymentHash,
+		}).Infof("Failed to lookup invoice: %v", err)
+		nostrEvent.State = "error"
+		svc.db.Save(&nostrEvent)
+		if errors.Is(err, ErrTransactionNotFound) {
+			return svc.createResponse(event, Nip47Response{
+				Error: &Nip47Error{
+					Code:    NIP_47_ERROR_NOT_FOUND,
+					Message: fmt.Sprintf("Invoice not found: %s", paymentHash),
+				},
+			}, nostr.Tags{}, ss)
+		}
+		return svc.createResponse(event, Nip47Response{
+			Error: &Nip47Error{
+				Code:    NIP_47_ERROR_INTERNAL,
+				Message: fmt.Sprintf("Something went wrong while looking up invoice: %s", err.Error()),
+			},
+		}, nostr.Tags{}, ss)
+	}
+
+	nostrEvent.State = "executed"
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: NIP_47_LOOKUP_INVOICE_METHOD,
+		Result:     transaction,
+	}, nostr.Tags{}, ss)
+}
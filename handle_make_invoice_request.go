@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandleMakeInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+	nostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", event.ID).First(&nostrEvent).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// make invoice does not spend funds, so it does not count towards the budget
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, 0)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+			Code:    code,
+			Message: message,
+		}}, nostr.Tags{}, ss)
+	}
+
+	makeInvoiceParams := &Nip47MakeInvoiceParams{}
+	err = json.Unmarshal(request.Params, makeInvoiceParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if makeInvoiceParams.Amount <= 0 {
+		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+			Code:    NIP_47_ERROR_OTHER,
+			Message: "Invoice amount must be greater than 0",
+		}}, nostr.Tags{}, ss)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":         event.ID,
+		"eventKind":       event.Kind,
+		"appId":           app.ID,
+		"amount":          makeInvoiceParams.Amount,
+		"description":     makeInvoiceParams.Description,
+		"descriptionHash": makeInvoiceParams.DescriptionHash,
+		"expiry":          makeInvoiceParams.Expiry,
+	}).Info("Making invoice")
+
+	transaction, err := svc.lnClient.CreateInvoice(ctx, event.PubKey, makeInvoiceParams.Amount, makeInvoiceParams.Description, makeInvoiceParams.DescriptionHash, makeInvoiceParams.Expiry)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":         event.ID,
+			"eventKind":       event.Kind,
+			"appId":           app.ID,
+			"amount":          makeInvoiceParams.Amount,
+			"description":     makeInvoiceParams.Description,
+			"descriptionHash": makeInvoiceParams.DescriptionHash,
+			"expiry":          makeInvoiceParams.Expiry,
+		}).Infof("Failed to make invoice: %v", err)
+		nostrEvent.State = "error"
+		svc.db.Save(&nostrEvent)
+		code := NIP_47_ERROR_INTERNAL
+		if errors.Is(err, ErrNotImplemented) {
+			code = NIP_47_ERROR_NOT_IMPLEMENTED
+		}
+		return svc.createResponse(event, Nip47Response{
+			Error: &Nip47Error{
+				Code:    code,
+				Message: fmt.Sprintf("Something went wrong while making invoice: %s", err.Error()),
+			},
+		}, nostr.Tags{}, ss)
+	}
+
+	invoice := Invoice{
+		App:             app,
+		NostrEvent:      nostrEvent,
+		AmountMsat:      makeInvoiceParams.Amount,
+		Description:     makeInvoiceParams.Description,
+		DescriptionHash: makeInvoiceParams.DescriptionHash,
+		PaymentRequest:  transaction.Invoice,
+		PaymentHash:     transaction.PaymentHash,
+	}
+	if transaction.ExpiresAt != 0 {
+		invoice.ExpiresAt = time.Unix(transaction.ExpiresAt, 0)
+	}
+	err = svc.db.Create(&invoice).Error
+	if err != nil {
+		return nil, err
+	}
+
+	nostrEvent.State = "executed"
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: NIP_47_MAKE_INVOICE_METHOD,
+		Result:     transaction,
+	}, nostr.Tags{}, ss)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nbd-wtf/go-nostr"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/sirupsen/logrus"
+)
+
+// maximum number of payments of a multi_pay_* request that are sent at the same time
+const multiPayConcurrency = 5
+
+// multiPayment is a single item of a multi_pay_* request, identified by its "d" tag.
+type multiPayment struct {
+	dTag string
+	pay  func() (preimage string, err error)
+}
+
+func (svc *Service) HandleMultiPayInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (results []*nostr.Event, err error) {
+	nostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", event.ID).First(&nostrEvent).Error
+	if err != nil {
+		return nil, err
+	}
+
+	multiPayParams := &Nip47MultiPayInvoiceParams{}
+	err = json.Unmarshal(request.Params, multiPayParams)
+	if err != nil {
+		return nil, err
+	}
+
+	payments := []multiPayment{}
+	totalAmount := int64(0)
+	for _, invoiceParams := range multiPayParams.Invoices {
+		bolt11 := invoiceParams.Invoice
+		paymentRequest, err := decodepay.Decodepay(bolt11)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"eventId":   event.ID,
+				"eventKind": event.Kind,
+				"appId":     app.ID,
+				"bolt11":    bolt11,
+			}).Errorf("Failed to decode bolt11 invoice: %v", err)
+			dTag := invoiceParams.Id
+			if dTag == "" {
+				dTag = bolt11
+			}
+			resp, err := svc.createResponse(event, Nip47Response{
+				ResultType: request.Method,
+				Error: &Nip47Error{
+					Code:    NIP_47_ERROR_OTHER,
+					Message: fmt.Sprintf("Failed to decode bolt11 invoice: %s", err.Error()),
+				},
+			}, nostr.Tags{[]string{"d", dTag}}, ss)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, resp)
+			continue
+		}
+
+		dTag := invoiceParams.Id
+		if dTag == "" {
+			dTag = paymentRequest.PaymentHash
+		}
+		totalAmount += paymentRequest.MSatoshi
+		payments = append(payments, multiPayment{
+			dTag: dTag,
+			pay: func() (string, error) {
+				return svc.payInvoice(ctx, app, nostrEvent, event, bolt11, paymentRequest)
+			},
+		})
+	}
+
+	// the whole batch has to fit in the budget before we start paying
+	hasPermission, code, message := svc.hasPermission(&app, event, NIP_47_PAY_INVOICE_METHOD, totalAmount)
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+		permissionResults, err := svc.createMultiPayErrorResponses(event, request.Method, payments, code, message, ss)
+		if err != nil {
+			return nil, err
+		}
+		return append(results, permissionResults...), nil
+	}
+
+	paymentResults, succeeded := svc.runMultiPay(event, request.Method, payments, "paying invoice", ss)
+	results = append(results, paymentResults...)
+	svc.db.Model(&nostrEvent).Update("state", getMultiPayState(succeeded))
+	return results, nil
+}
+
+// getMultiPayState returns the state of a multi_pay_* event, which is only executed if a payment succeeded.
+func getMultiPayState(succeeded int) string {
+	if succeeded == 0 {
+		return "error"
+	}
+	return "executed"
+}
+
+// runMultiPay sends the payments with bounded concurrency and creates one response per payment.
+// It also returns the number of payments which succeeded.
+func (svc *Service) runMultiPay(event *nostr.Event, method string, payments []multiPayment, action string, ss []byte) (results []*nostr.Event, succeeded int) {
+	responses := make([]*nostr.Event, len(payments))
+	var succeededCount atomic.Int64
+	semaphore := make(chan struct{}, multiPayConcurrency)
+	var wg sync.WaitGroup
+	for i, payment := range payments {
+		wg.Add(1)
+		go func(i int, payment multiPayment) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			content := Nip47Response{ResultType: method}
+			preimage, err := payment.pay()
+			if err != nil {
+				content.Error = &Nip47Error{
+					Code:    getPaymentErrorCode(err),
+					Message: fmt.Sprintf("Something went wrong while %s: %s", action, err.Error()),
+				}
+			} else {
+				succeededCount.Add(1)
+				content.Result = Nip47PayResponse{
+					Preimage: preimage,
+				}
+			}
+
+			resp, err := svc.createResponse(event, content, nostr.Tags{[]string{"d", payment.dTag}}, ss)
+			if err != nil {
+				svc.Logger.WithFields(logrus.Fields{
+					"eventId":   event.ID,
+					"eventKind": event.Kind,
+					"dTag":      payment.dTag,
+				}).Errorf("Failed to create response: %v", err)
+				return
+			}
+			responses[i] = resp
+		}(i, payment)
+	}
+	wg.Wait()
+
+	results = []*nostr.Event{}
+	for _, resp := range responses {
+		if resp != nil {
+			results = append(results, resp)
+		}
+	}
+	return results, int(succeededCount.Load())
+}
+
+func (svc *Service) createMultiPayErrorResponses(event *nostr.Event, method string, payments []multiPayment, code string, message string, ss []byte) (results []*nostr.Event, err error) {
+	for _, payment := range payments {
+		resp, err := svc.createResponse(event, Nip47Response{
+			ResultType: method,
+			Error: &Nip47Error{
+				Code:    code,
+				Message: message,
+			},
+		}, nostr.Tags{[]string{"d", payment.dTag}}, ss)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, resp)
+	}
+	return results, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandleMultiPayKeysendEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (results []*nostr.Event, err error) {
+	nostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", event.ID).First(&nostrEvent).Error
+	if err != nil {
+		return nil, err
+	}
+
+	multiPayParams := &Nip47MultiPayKeysendParams{}
+	err = json.Unmarshal(request.Params, multiPayParams)
+	if err != nil {
+		return nil, err
+	}
+
+	payments := []multiPayment{}
+	totalAmount := int64(0)
+	for _, keysendElement := range multiPayParams.Keysends {
+		keysendParams := keysendElement.Nip47KeysendParams
+		dTag := keysendElement.Id
+		if dTag == "" {
+			dTag = keysendParams.Pubkey
+		}
+
+		if validationErr := validateKeysendParams(&keysendParams); validationErr != "" {
+			resp, err := svc.createResponse(event, Nip47Response{
+				ResultType: request.Method,
+				Error: &Nip47Error{
+					Code:    NIP_47_ERROR_OTHER,
+					Message: validationErr,
+				},
+			}, nostr.Tags{[]string{"d", dTag}}, ss)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, resp)
+			continue
+		}
+
+		totalAmount += keysendParams.Amount
+		payments = append(payments, multiPayment{
+			dTag: dTag,
+			pay: func() (string, error) {
+				return svc.payKeysend(ctx, app, nostrEvent, event, &keysendParams)
+			},
+		})
+	}
+
+	// the whole batch has to fit in the budget before we start paying
+	hasPermission, code, message := svc.hasPermission(&app, event, NIP_47_PAY_KEYSEND_METHOD, totalAmount)
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+		permissionResults, err := svc.createMultiPayErrorResponses(event, request.Method, payments, code, message, ss)
+		if err != nil {
+			return nil, err
+		}
+		return append(results, permissionResults...), nil
+	}
+
+	paymentResults, succeeded := svc.runMultiPay(event, request.Method, payments, "sending keysend payment", ss)
+	results = append(results, paymentResults...)
+	svc.db.Model(&nostrEvent).Update("state", getMultiPayState(succeeded))
+	return results, nil
+}
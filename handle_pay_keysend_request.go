@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandlePayKeysendEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+	nostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", event.ID).First(&nostrEvent).Error
+	if err != nil {
+		return nil, err
+	}
+
+	keysendParams := &Nip47KeysendParams{}
+	err = json.Unmarshal(request.Params, keysendParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if validationErr := validateKeysendParams(keysendParams); validationErr != "" {
+		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+			Code:    NIP_47_ERROR_OTHER,
+			Message: validationErr,
+		}}, nostr.Tags{}, ss)
+	}
+
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, keysendParams.Amount)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+			Code:    code,
+			Message: message,
+		}}, nostr.Tags{}, ss)
+	}
+
+	preimage, err := svc.payKeysend(ctx, app, nostrEvent, event, keysendParams)
+	if err != nil {
+		nostrEvent.State = "error"
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			Error: &Nip47Error{
+				Code:    getPaymentErrorCode(err),
+				Message: fmt.Sprintf("Something went wrong while sending keysend payment: %s", err.Error()),
+			},
+		}, nostr.Tags{}, ss)
+	}
+	nostrEvent.State = "executed"
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: NIP_47_PAY_KEYSEND_METHOD,
+		Result: Nip47PayResponse{
+			Preimage: preimage,
+		},
+	}, nostr.Tags{}, ss)
+}
+
+// payKeysend records the keysend payment against the app and sends it through the LN backend.
+// The params must be validated, permissions must be checked by the caller.
+// The preimage is chosen here if the backend accepts it, so the payment can be looked up if the backend does not return.
+// Otherwise the payment hash is only known once the backend returns the preimage.
+func (svc *Service) payKeysend(ctx context.Context, app App, nostrEvent NostrEvent, event *nostr.Event, keysendParams *Nip47KeysendParams) (preimage string, err error) {
+	// rejected before the payment is recorded, so it never counts towards the budget
+	keysend, customPreimage := svc.lnClient.SupportsKeysend()
+	if !keysend {
+		return "", fmt.Errorf("%w: the wallet cannot send keysend payments", ErrNotImplemented)
+	}
+	if !customPreimage && keysendParams.Preimage != "" {
+		return "", fmt.Errorf("%w: the wallet cannot send keysend payments with a custom preimage", ErrNotImplemented)
+	}
+
+	requestPreimage := keysendParams.Preimage
+	if customPreimage && requestPreimage == "" {
+		requestPreimage, err = generatePreimage()
+		if err != nil {
+			return "", err
+		}
+	}
+	paymentHash := ""
+	if requestPreimage != "" {
+		paymentHash, err = preimageToPaymentHash(requestPreimage)
+		if err != nil {
+			return "", err
+		}
+	}
+	payment := Payment{App: app, NostrEvent: nostrEvent, PaymentHash: paymentHash, Amount: uint(keysendParams.Amount / 1000), State: "pending"}
+	insertPaymentResult := svc.db.Create(&payment)
+	if insertPaymentResult.Error != nil {
+		return "", insertPaymentResult.Error
+	}
+	svc.inFlightPayments.Store(payment.ID, true)
+	defer svc.inFlightPayments.Delete(payment.ID)
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":     event.ID,
+		"eventKind":   event.Kind,
+		"appId":       app.ID,
+		"destination": keysendParams.Pubkey,
+		"amount":      keysendParams.Amount,
+	}).Info("Sending keysend payment")
+
+	preimage, err = svc.lnClient.SendKeysend(ctx, event.PubKey, keysendParams.Amount, keysendParams.Pubkey, requestPreimage, keysendParams.TLVRecords)
+	if payment.PaymentHash == "" && preimage != "" {
+		payment.PaymentHash, _ = preimageToPaymentHash(preimage)
+	}
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":     event.ID,
+			"eventKind":   event.Kind,
+			"appId":       app.ID,
+			"destination": keysendParams.Pubkey,
+			"amount":      keysendParams.Amount,
+		}).Infof("Failed to send keysend payment: %v", err)
+		return svc.completePayment(ctx, &payment, "", err)
+	}
+	return svc.completePayment(ctx, &payment, preimage, nil)
+}
+
+func validateKeysendParams(keysendParams *Nip47KeysendParams) string {
+	if keysendParams.Amount <= 0 {
+		return "Keysend amount must be greater than 0"
+	}
+	pubkey, err := hex.DecodeString(keysendParams.Pubkey)
+	if err != nil || len(pubkey) != 33 {
+		return fmt.Sprintf("Invalid destination pubkey: %s", keysendParams.Pubkey)
+	}
+	if keysendParams.Preimage != "" {
+		preimage, err := hex.DecodeString(keysendParams.Preimage)
+		if err != nil || len(preimage) != 32 {
+			return "Preimage must be 32 bytes hex"
+		}
+	}
+	for _, record := range keysendParams.TLVRecords {
+		if _, err := hex.DecodeString(record.Value); err != nil {
+			return fmt.Sprintf("Invalid value for TLV record %d", record.Type)
+		}
+	}
+	return ""
+}
+
+func generatePreimage() (string, error) {
+	preimage := make([]byte, 32)
+	_, err := rand.Read(preimage)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(preimage), nil
+}
+
+func preimageToPaymentHash(preimage string) (string, error) {
+	preimageBytes, err := hex.DecodeString(preimage)
+	if err != nil {
+		return "", err
+	}
+	paymentHash := sha256.Sum256(preimageBytes)
+	return hex.EncodeToString(paymentHash[:]), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrPaymentInProgress = errors.New("A payment of this invoice is already in progress")
+	ErrPaymentFailed     = errors.New("An earlier payment of this invoice failed")
+)
+
+func (svc *Service) HandlePayInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+	nostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", event.ID).First(&nostrEvent).Error
+	if err != nil {
+		return nil, err
+	}
+
+	payParams := &Nip47PayParams{}
+	err = json.Unmarshal(request.Params, payParams)
+	if err != nil {
+		return nil, err
+	}
+
+	bolt11 := payParams.Invoice
+	paymentRequest, err := decodepay.Decodepay(bolt11)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+			"bolt11":    bolt11,
+		}).Errorf("Failed to decode bolt11 invoice: %v", err)
+		//todo: create & send response
+		return nil, err
+	}
+
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, paymentRequest.MSatoshi)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+			Code:    code,
+			Message: message,
+		}}, nostr.Tags{}, ss)
+	}
+
+	preimage, err := svc.payInvoice(ctx, app, nostrEvent, event, bolt11, paymentRequest)
+	if err != nil {
+		// a plain save would clear the link to a duplicated payment
+		svc.db.Model(&nostrEvent).Update("state", "error")
+		return svc.createResponse(event, Nip47Response{
+			Error: &Nip47Error{
+				Code:    getPaymentErrorCode(err),
+				Message: fmt.Sprintf("Something went wrong while paying invoice: %s", err.Error()),
+			},
+		}, nostr.Tags{}, ss)
+	}
+	svc.db.Model(&nostrEvent).Update("state", "executed")
+	return svc.createResponse(event, Nip47Response{
+		ResultType: NIP_47_PAY_INVOICE_METHOD,
+		Result: Nip47PayResponse{
+			Preimage: preimage,
+		},
+	}, nostr.Tags{}, ss)
+}
+
+// payInvoice records the payment against the app and pays it through the LN backend.
+// An invoice the user already paid is not paid again, the outcome of the earlier payment is returned instead.
+// Permissions must be checked by the caller.
+func (svc *Service) payInvoice(ctx context.Context, app App, nostrEvent NostrEvent, event *nostr.Event, bolt11 string, paymentRequest decodepay.Bolt11) (preimage string, err error) {
+	// the check and the insert must not interleave with a concurrent request for the same invoice
+	svc.paymentsMutex.Lock()
+	existingPayment := Payment{}
+	findPaymentResult := svc.db.Joins("JOIN apps ON apps.id = payments.app_id").
+		Where("payments.payment_hash = ? AND apps.user_id = ?", paymentRequest.PaymentHash, app.UserId).
+		Order("payments.id").Limit(1).Find(&existingPayment)
+	if findPaymentResult.Error != nil {
+		svc.paymentsMutex.Unlock()
+		return "", findPaymentResult.Error
+	}
+	if findPaymentResult.RowsAffected > 0 {
+		svc.paymentsMutex.Unlock()
+		return svc.getDuplicatePaymentResult(app, nostrEvent, event, existingPayment)
+	}
+	payment := Payment{App: app, NostrEvent: nostrEvent, PaymentRequest: bolt11, PaymentHash: paymentRequest.PaymentHash, Amount: uint(paymentRequest.MSatoshi / 1000), State: "pending"}
+	insertPaymentResult := svc.db.Create(&payment)
+	svc.paymentsMutex.Unlock()
+	if insertPaymentResult.Error != nil {
+		return "", insertPaymentResult.Error
+	}
+	svc.inFlightPayments.Store(payment.ID, true)
+	defer svc.inFlightPayments.Delete(payment.ID)
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":   event.ID,
+		"eventKind": event.Kind,
+		"appId":     app.ID,
+		"bolt11":    bolt11,
+	}).Info("Sending payment")
+
+	preimage, err = svc.lnClient.SendPaymentSync(ctx, event.PubKey, bolt11)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+			"bolt11":    bolt11,
+		}).Infof("Failed to send payment: %v", err)
+	}
+	return svc.completePayment(ctx, &payment, preimage, err)
+}
+
+// getDuplicatePaymentResult links the request to the request which paid the invoice first and returns the outcome of that payment
+func (svc *Service) getDuplicatePaymentResult(app App, nostrEvent NostrEvent, event *nostr.Event, existingPayment Payment) (preimage string, err error) {
+	svc.db.Model(&nostrEvent).Update("duplicate_of_id", existingPayment.NostrEventId)
+	logger := svc.Logger.WithFields(logrus.Fields{
+		"eventId":          event.ID,
+		"eventKind":        event.Kind,
+		"appId":            app.ID,
+		"paymentHash":      existingPayment.PaymentHash,
+		"paymentId":        existingPayment.ID,
+		"paymentState":     existingPayment.State,
+		"duplicateOfEvent": existingPayment.NostrEventId,
+	})
+
+	switch existingPayment.State {
+	case "succeeded":
+		logger.Info("Invoice was already paid, returning the preimage of the earlier payment")
+		return existingPayment.Preimage, nil
+	case "pending":
+		logger.Info("Invoice is already being paid")
+		return "", ErrPaymentInProgress
+	}
+	logger.Info("Earlier payment of the invoice failed")
+	return "", ErrPaymentFailed
+}
+
+func getPaymentErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrPaymentInProgress), errors.Is(err, ErrPaymentPending):
+		return NIP_47_ERROR_PAYMENT_IN_PROGRESS
+	case errors.Is(err, ErrPaymentFailed):
+		return NIP_47_ERROR_PAYMENT_FAILED
+	case errors.Is(err, ErrNotImplemented):
+		return NIP_47_ERROR_NOT_IMPLEMENTED
+	}
+	return NIP_47_ERROR_INTERNAL
+}
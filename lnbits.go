@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	lnbitsListPageSize              = 100
+	lnbitsNotificationsPollInterval = 30 * time.Second
+	lnbitsNotificationsPollPageSize = 20
+)
+
+var ErrLNbitsWalletNotConnected = errors.New("No LNbits wallet connected")
+
+// LNbitsService uses the wallet API of an LNbits instance.
+// Either all apps share the wallet of LNBITS_ADMIN_KEY, or every user connects their own wallet with its admin key.
+type LNbitsService struct {
+	cfg        *Config
+	httpClient *http.Client
+	db         *gorm.DB
+	Logger     *logrus.Logger
+}
+
+type lnbitsWallet struct {
+	// only returned for admin keys
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Balance int64  `json:"balance"`
+}
+
+type lnbitsPayment struct {
+	CheckingId string `json:"checking_id"`
+	Pending    bool   `json:"pending"`
+	// success, pending or failed, not returned by older versions
+	Status string `json:"status"`
+	// negative for outgoing payments
+	Amount      int64      `json:"amount"`
+	Fee         int64      `json:"fee"`
+	Memo        string     `json:"memo"`
+	Time        lnbitsTime `json:"time"`
+	Bolt11      string     `json:"bolt11"`
+	Preimage    string     `json:"preimage"`
+	PaymentHash string     `json:"payment_hash"`
+	Expiry      lnbitsTime `json:"expiry"`
+}
+
+// lnbitsTime is a unix timestamp or, in newer versions, an ISO 8601 date
+type lnbitsTime int64
+
+func (t *lnbitsTime) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "" || value == "null" {
+		*t = 0
+		return nil
+	}
+	if timestamp, err := strconv.ParseFloat(value, 64); err == nil {
+		*t = lnbitsTime(timestamp)
+		return nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999", "2006-01-02 15:04:05.999999"} {
+		parsed, err := time.Parse(layout, value)
+		if err == nil {
+			*t = lnbitsTime(parsed.Unix())
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid LNbits time %s", value)
+}
+
+type lnbitsErrorResponse struct {
+	Detail string `json:"detail"`
+}
+
+type lnbitsError struct {
+	StatusCode int
+	Detail     string
+}
+
+func (err *lnbitsError) Error() string {
+	return fmt.Sprintf("LNbits request failed: %s", err.Detail)
+}
+
+// AuthHandler logs in the user of the configured wallet, or shows the form to connect a wallet
+func (svc *LNbitsService) AuthHandler(c echo.Context) error {
+	sess, _ := session.Get(CookieName, c)
+	if svc.cfg.LNbitsAdminKey != "" {
+		user := &User{}
+		err := svc.db.FirstOrInit(user, User{AlbyIdentifier: "lnbits"}).Error
+		if err != nil {
+			return err
+		}
+		sess.Values["user_id"] = user.ID
+		sess.Save(c.Request(), c.Response())
+		return c.Redirect(302, "/")
+	}
+
+	// clear current session
+	if sess.Values["user_id"] != nil {
+		delete(sess.Values, "user_id")
+		sess.Options.MaxAge = 0
+		sess.Options.SameSite = http.SameSiteLaxMode
+		if svc.cfg.CookieDomain != "" {
+			sess.Options.Domain = svc.cfg.CookieDomain
+		}
+		sess.Save(c.Request(), c.Response())
+	}
+	csrf, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	return c.Render(http.StatusOK, "lnbits/index.html", map[string]interface{}{
+		"Csrf": csrf,
+	})
+}
+
+// ConnectWalletHandler logs in the user of the wallet the admin key belongs to
+func (svc *LNbitsService) ConnectWalletHandler(c echo.Context) error {
+	adminKey := strings.TrimSpace(c.FormValue("admin_key"))
+	wallet := &lnbitsWallet{}
+	err := svc.call(c.Request().Context(), adminKey, "GET", "/api/v1/wallet", nil, wallet)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to fetch LNbits wallet")
+		return c.Redirect(302, "/lnbits/auth")
+	}
+	if wallet.Id == "" {
+		svc.Logger.Error("LNbits key is not an admin key")
+		return c.Redirect(302, "/lnbits/auth")
+	}
+
+	user := User{}
+	svc.db.FirstOrInit(&user, User{AlbyIdentifier: "lnbits:" + wallet.Id})
+	user.LNbitsAdminKey = adminKey
+	svc.db.Save(&user)
+
+	sess, _ := session.Get(CookieName, c)
+	sess.Options.MaxAge = 0
+	sess.Options.SameSite = http.SameSiteLaxMode
+	if svc.cfg.CookieDomain != "" {
+		sess.Options.Domain = svc.cfg.CookieDomain
+	}
+	sess.Values["user_id"] = user.ID
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(302, "/")
+}
+
+// getAdminKey returns the admin key of the wallet of the app
+func (svc *LNbitsService) getAdminKey(senderPubkey string) (string, error) {
+	if svc.cfg.LNbitsAdminKey != "" {
+		return svc.cfg.LNbitsAdminKey, nil
+	}
+	app := App{}
+	err := svc.db.Preload("User").First(&app, &App{
+		NostrPubkey: senderPubkey,
+	}).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+		}).Errorf("App not found: %v", err)
+		return "", err
+	}
+	if app.User.LNbitsAdminKey == "" {
+		return "", ErrLNbitsWalletNotConnected
+	}
+	return app.User.LNbitsAdminKey, nil
+}
+
+// call sends a request to the LNbits API and decodes the response into result
+func (svc *LNbitsService) call(ctx context.Context, adminKey, method, path string, payload interface{}, result interface{}) error {
+	body := &bytes.Buffer{}
+	if payload != nil {
+		err := json.NewEncoder(body).Encode(payload)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, svc.cfg.LNbitsURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "NWC")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", adminKey)
+
+	resp, err := svc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		errorPayload := &lnbitsErrorResponse{}
+		err = json.NewDecoder(resp.Body).Decode(errorPayload)
+		if err != nil || errorPayload.Detail == "" {
+			errorPayload.Detail = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		}
+		return &lnbitsError{StatusCode: resp.StatusCode, Detail: errorPayload.Detail}
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (svc *LNbitsService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string) (preimage string, err error) {
+	adminKey, err := svc.getAdminKey(senderPubkey)
+	if err != nil {
+		return "", err
+	}
+	resp := &struct {
+		PaymentHash string `json:"payment_hash"`
+	}{}
+	err = svc.call(ctx, adminKey, "POST", "/api/v1/payments", map[string]interface{}{
+		"out":    true,
+		"bolt11": payReq,
+	}, resp)
+	if err != nil {
+		return "", err
+	}
+
+	// the preimage is not part of the response
+	transaction, err := svc.lookupPayment(ctx, adminKey, resp.PaymentHash)
+	if err != nil {
+		return "", err
+	}
+	if transaction.State != NIP_47_TRANSACTION_STATE_SETTLED {
+		return "", fmt.Errorf("Payment is %s", transaction.State)
+	}
+	return transaction.Preimage, nil
+}
+
+func (svc *LNbitsService) SupportsKeysend() (keysend bool, customPreimage bool) {
+	return false, false
+}
+
+func (svc *LNbitsService) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, customRecords []TLVRecord) (respPreimage string, err error) {
+	return "", fmt.Errorf("%w: keysend payments are not supported by LNbits", ErrNotImplemented)
+}
+
+func (svc *LNbitsService) GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error) {
+	adminKey, err := svc.getAdminKey(senderPubkey)
+	if err != nil {
+		return 0, err
+	}
+	wallet := &lnbitsWallet{}
+	err = svc.call(ctx, adminKey, "GET", "/api/v1/wallet", nil, wallet)
+	if err != nil {
+		return 0, err
+	}
+	return wallet.Balance, nil
+}
+
+func (svc *LNbitsService) GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error) {
+	// LNbits does not expose the node behind the wallet
+	return &NodeInfo{
+		Alias: "LNbits",
+	}, nil
+}
+
+func (svc *LNbitsService) CreateInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	adminKey, err := svc.getAdminKey(senderPubkey)
+	if err != nil {
+		return nil, err
+	}
+	// amount provided in msat, but LNbits only supports sats
+	payload := map[string]interface{}{
+		"out":    false,
+		"amount": amount / 1000,
+		"unit":   "sat",
+		"memo":   description,
+	}
+	if descriptionHash != "" {
+		payload["description_hash"] = descriptionHash
+	}
+	if expiry > 0 {
+		payload["expiry"] = expiry
+	}
+	resp := &struct {
+		PaymentHash    string `json:"payment_hash"`
+		PaymentRequest string `json:"payment_request"`
+	}{}
+	err = svc.call(ctx, adminKey, "POST", "/api/v1/payments", payload, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	transaction = &Nip47Transaction{
+		Type:            "incoming",
+		State:           NIP_47_TRANSACTION_STATE_PENDING,
+		Invoice:         resp.PaymentRequest,
+		Description:     description,
+		DescriptionHash: descriptionHash,
+		PaymentHash:     resp.PaymentHash,
+		Amount:          amount,
+		CreatedAt:       time.Now().Unix(),
+	}
+	paymentRequest, err := decodepay.Decodepay(resp.PaymentRequest)
+	if err == nil {
+		transaction.Amount = paymentRequest.MSatoshi
+		transaction.CreatedAt = int64(paymentRequest.CreatedAt)
+		transaction.ExpiresAt = int64(paymentRequest.CreatedAt + paymentRequest.Expiry)
+	}
+	return transaction, nil
+}
+
+func (svc *LNbitsService) LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error) {
+	paymentHashBytes, err := hex.DecodeString(paymentHash)
+	if err != nil || len(paymentHashBytes) != 32 {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"paymentHash":  paymentHash,
+		}).Errorf("Invalid payment hash")
+		return nil, errors.New("Payment hash must be 32 bytes hex")
+	}
+	adminKey, err := svc.getAdminKey(senderPubkey)
+	if err != nil {
+		return nil, err
+	}
+	return svc.lookupPayment(ctx, adminKey, paymentHash)
+}
+
+func (svc *LNbitsService) lookupPayment(ctx context.Context, adminKey, paymentHash string) (transaction *Nip47Transaction, err error) {
+	resp := &struct {
+		Paid     bool          `json:"paid"`
+		Preimage string        `json:"preimage"`
+		Details  lnbitsPayment `json:"details"`
+	}{}
+	err = svc.call(ctx, adminKey, "GET", "/api/v1/payments/"+url.PathEscape(paymentHash), nil, resp)
+	var lnbitsErr *lnbitsError
+	if errors.As(err, &lnbitsErr) && lnbitsErr.StatusCode == http.StatusNotFound {
+		return nil, ErrTransactionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	transaction = lnbitsPaymentToTransaction(&resp.Details)
+	if resp.Paid {
+		transaction.State = NIP_47_TRANSACTION_STATE_SETTLED
+		transaction.Preimage = resp.Preimage
+	}
+	return transaction, nil
+}
+
+func (svc *LNbitsService) ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, transactionType string) (transactions []Nip47Transaction, err error) {
+	adminKey, err := svc.getAdminKey(senderPubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	// payments are returned newest first, we page through them until we are past `from` or have enough matching transactions
+	wanted := uint64(0)
+	if limit > 0 {
+		wanted = offset + limit
+	}
+	matching := uint64(0)
+	for pageOffset := 0; ; pageOffset += lnbitsListPageSize {
+		payments := []lnbitsPayment{}
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(lnbitsListPageSize))
+		query.Set("offset", strconv.Itoa(pageOffset))
+		query.Set("sortby", "time")
+		query.Set("direction", "desc")
+		err = svc.call(ctx, adminKey, "GET", "/api/v1/payments?"+query.Encode(), nil, &payments)
+		if err != nil {
+			return nil, err
+		}
+		pastFrom := false
+		for i := range payments {
+			transaction := lnbitsPaymentToTransaction(&payments[i])
+			if from != 0 && transaction.CreatedAt < int64(from) {
+				pastFrom = true
+				continue
+			}
+			if matchesTransactionFilter(transaction, from, until, unpaid, transactionType) {
+				transactions = append(transactions, *transaction)
+				matching++
+			}
+		}
+		if pastFrom || (wanted > 0 && matching >= wanted) || len(payments) < lnbitsListPageSize {
+			break
+		}
+	}
+	return filterTransactions(transactions, from, until, limit, offset, unpaid, transactionType), nil
+}
+
+func (svc *LNbitsService) SubscribePayments(ctx context.Context) (notifications <-chan PaymentNotification, err error) {
+	notificationsChan := make(chan PaymentNotification)
+	go pollUserPayments(ctx, svc.db, svc.Logger, svc, lnbitsNotificationsPollInterval, lnbitsNotificationsPollPageSize, notificationsChan)
+	return notificationsChan, nil
+}
+
+func lnbitsPaymentToTransaction(payment *lnbitsPayment) *Nip47Transaction {
+	transactionType := "incoming"
+	amount := payment.Amount
+	if amount < 0 {
+		transactionType = "outgoing"
+		amount = -amount
+	}
+	fee := payment.Fee
+	if fee < 0 {
+		fee = -fee
+	}
+
+	var descriptionHash string
+	if payment.Bolt11 != "" {
+		paymentRequest, err := decodepay.Decodepay(payment.Bolt11)
+		if err == nil {
+			descriptionHash = paymentRequest.DescriptionHash
+		}
+	}
+
+	state := NIP_47_TRANSACTION_STATE_PENDING
+	switch {
+	case payment.Status == "success" || (payment.Status == "" && !payment.Pending):
+		state = NIP_47_TRANSACTION_STATE_SETTLED
+	case payment.Status == "failed":
+		state = NIP_47_TRANSACTION_STATE_FAILED
+	case payment.Expiry != 0 && int64(payment.Expiry) < time.Now().Unix():
+		state = NIP_47_TRANSACTION_STATE_EXPIRED
+	}
+
+	transaction := &Nip47Transaction{
+		Type:            transactionType,
+		State:           state,
+		Invoice:         payment.Bolt11,
+		Description:     payment.Memo,
+		DescriptionHash: descriptionHash,
+		PaymentHash:     payment.PaymentHash,
+		Amount:          amount,
+		FeesPaid:        fee,
+		CreatedAt:       int64(payment.Time),
+		ExpiresAt:       int64(payment.Expiry),
+	}
+	// the preimage of unpaid invoices must not be shared
+	if state == NIP_47_TRANSACTION_STATE_SETTLED {
+		transaction.Preimage = payment.Preimage
+	}
+	return transaction
+}
+
+func NewLNbitsService(ctx context.Context, svc *Service, e *echo.Echo) (result *LNbitsService, err error) {
+	if svc.cfg.LNbitsURL == "" {
+		return nil, errors.New("LNBITS_URL is required for the LNbits backend")
+	}
+	lnbitsService := &LNbitsService{
+		cfg:        svc.cfg,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+		Logger:     svc.Logger,
+		db:         svc.db,
+	}
+	svc.cfg.LNbitsURL = strings.TrimSuffix(svc.cfg.LNbitsURL, "/")
+
+	if svc.cfg.LNbitsAdminKey != "" {
+		wallet := &lnbitsWallet{}
+		err = lnbitsService.call(ctx, svc.cfg.LNbitsAdminKey, "GET", "/api/v1/wallet", nil, wallet)
+		if err != nil {
+			return nil, err
+		}
+		//add default user to db
+		user := &User{}
+		err = svc.db.FirstOrInit(user, User{AlbyIdentifier: "lnbits"}).Error
+		if err != nil {
+			return nil, err
+		}
+		err = svc.db.Save(user).Error
+		if err != nil {
+			return nil, err
+		}
+		svc.Logger.Infof("Connected to LNbits - wallet %s", wallet.Name)
+	}
+
+	e.GET("/lnbits/auth", lnbitsService.AuthHandler)
+	e.POST("/lnbits/auth", lnbitsService.ConnectWalletHandler)
+
+	return lnbitsService, nil
+}
@@ -2,27 +2,94 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 
-	"github.com/getAlby/lndhub.go/lnd"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/macaroons"
+	"github.com/lightningnetwork/lnd/record"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"gopkg.in/macaroon.v2"
 )
 
+var (
+	ErrTransactionNotFound = errors.New("Transaction not found")
+	// returned if the outcome of a payment is not known yet, it is reconciled once the payment resolved
+	ErrPaymentPending = errors.New("The payment did not complete yet")
+	// returned if the LN backend does not support a requested option
+	ErrNotImplemented = errors.New("Not supported by the wallet")
+)
+
+const (
+	lndListPageSize = 100
+	// TrackPayments is only available from LND 0.16, so outgoing payments are polled
+	lndPaymentsPollInterval = 10 * time.Second
+	lndResubscribeDelay     = 10 * time.Second
+)
+
+// how long to wait for HTLCs which are still pending after the payment timeout
+var lndPaymentPendingGracePeriod = 10 * time.Second
+
 type LNClient interface {
 	SendPaymentSync(ctx context.Context, senderPubkey, payReq string) (preimage string, err error)
+	GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error)
+	CreateInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error)
+	LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error)
+	ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, transactionType string) (transactions []Nip47Transaction, err error)
+	// SupportsKeysend returns if the backend can send keysend payments and if it accepts the preimage of the payment.
+	SupportsKeysend() (keysend bool, customPreimage bool)
+	// SendKeysend needs the preimage if the backend supports custom preimages, so the payment hash is stored before sending.
+	// Other backends choose the preimage and return ErrNotImplemented if one is given.
+	SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, customRecords []TLVRecord) (respPreimage string, err error)
+	GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error)
+	SubscribePayments(ctx context.Context) (notifications <-chan PaymentNotification, err error)
 }
 
-// wrap it again :sweat_smile:
-// todo: drop dependency on lndhub package
 type LNDService struct {
-	client *lnd.LNDWrapper
-	db     *gorm.DB
-	Logger *logrus.Logger
+	client         lnrpc.LightningClient
+	routerClient   routerrpc.RouterClient
+	paymentOptions lndPaymentOptions
+	db             *gorm.DB
+	Logger         *logrus.Logger
+}
+
+// lndPaymentOptions limits the routing fees and the time spent on a payment
+type lndPaymentOptions struct {
+	timeoutSeconds  int32
+	feeLimitPpm     int64
+	feeLimitMinMsat int64
+}
+
+func newLNDPaymentOptions(cfg *Config) lndPaymentOptions {
+	return lndPaymentOptions{
+		timeoutSeconds:  int32(cfg.LNDPaymentTimeout),
+		feeLimitPpm:     cfg.LNDFeeLimitPpm,
+		feeLimitMinMsat: cfg.LNDFeeLimitMinMsat,
+	}
+}
+
+// feeLimitMsat allows feeLimitPpm of the amount as routing fees, but at least feeLimitMinMsat
+func (options lndPaymentOptions) feeLimitMsat(amount int64) int64 {
+	feeLimit := amount * options.feeLimitPpm / 1000000
+	if feeLimit < options.feeLimitMinMsat {
+		feeLimit = options.feeLimitMinMsat
+	}
+	return feeLimit
 }
 
 func (svc *LNDService) AuthHandler(c echo.Context) error {
@@ -39,23 +106,531 @@ func (svc *LNDService) AuthHandler(c echo.Context) error {
 }
 
 func (svc *LNDService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string) (preimage string, err error) {
-	resp, err := svc.client.SendPaymentSync(ctx, &lnrpc.SendRequest{PaymentRequest: payReq})
+	paymentRequest, err := decodepay.Decodepay(payReq)
 	if err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(resp.PaymentPreimage), nil
+	payment, err := svc.sendPayment(ctx, &routerrpc.SendPaymentRequest{
+		PaymentRequest: payReq,
+		FeeLimitMsat:   svc.paymentOptions.feeLimitMsat(paymentRequest.MSatoshi),
+	})
+	if err != nil {
+		return "", err
+	}
+	return payment.PaymentPreimage, nil
 }
 
-func NewLNDService(ctx context.Context, svc *Service, e *echo.Echo) (result *LNDService, err error) {
-	lndClient, err := lnd.NewLNDclient(lnd.LNDoptions{
-		Address:      svc.cfg.LNDAddress,
-		CertFile:     svc.cfg.LNDCertFile,
-		MacaroonFile: svc.cfg.LNDMacaroonFile,
+func (svc *LNDService) SupportsKeysend() (keysend bool, customPreimage bool) {
+	return true, true
+}
+
+func (svc *LNDService) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, customRecords []TLVRecord) (respPreimage string, err error) {
+	destBytes, err := hex.DecodeString(destination)
+	if err != nil {
+		return "", err
+	}
+	// the caller chooses the preimage, so the payment can be looked up if LND does not return
+	if preimage == "" {
+		return "", errors.New("LND keysend payments need a preimage")
+	}
+	preimageBytes, err := hex.DecodeString(preimage)
+	if err != nil {
+		return "", err
+	}
+	paymentHash := sha256.Sum256(preimageBytes)
+
+	destCustomRecords := map[uint64][]byte{}
+	for _, record := range customRecords {
+		decodedValue, err := hex.DecodeString(record.Value)
+		if err != nil {
+			return "", fmt.Errorf("Invalid value for TLV record %d: %w", record.Type, err)
+		}
+		destCustomRecords[record.Type] = decodedValue
+	}
+	destCustomRecords[record.KeySendType] = preimageBytes
+
+	payment, err := svc.sendPayment(ctx, &routerrpc.SendPaymentRequest{
+		Dest:              destBytes,
+		AmtMsat:           amount,
+		PaymentHash:       paymentHash[:],
+		DestFeatures:      []lnrpc.FeatureBit{lnrpc.FeatureBit_TLV_ONION_REQ},
+		DestCustomRecords: destCustomRecords,
+		FeeLimitMsat:      svc.paymentOptions.feeLimitMsat(amount),
 	})
+	if err != nil {
+		return "", err
+	}
+	return payment.PaymentPreimage, nil
+}
+
+// sendPayment sends the payment and follows its status until it succeeded or failed.
+// LND stops trying new routes after the timeout, but HTLCs which are already on their way can stay pending for a long time.
+// Then ErrPaymentPending is returned instead of blocking the request, the payment is reconciled once it resolved.
+func (svc *LNDService) sendPayment(ctx context.Context, req *routerrpc.SendPaymentRequest) (*lnrpc.Payment, error) {
+	req.TimeoutSeconds = svc.paymentOptions.timeoutSeconds
+	trackCtx, cancel := context.WithTimeout(ctx, time.Duration(req.TimeoutSeconds)*time.Second+lndPaymentPendingGracePeriod)
+	defer cancel()
+	stream, err := svc.routerClient.SendPaymentV2(trackCtx, req)
 	if err != nil {
 		return nil, err
 	}
-	info, err := lndClient.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+
+	var payment *lnrpc.Payment
+	for {
+		update, err := stream.Recv()
+		if err != nil {
+			if payment != nil && trackCtx.Err() != nil && ctx.Err() == nil {
+				svc.Logger.WithFields(logrus.Fields{
+					"paymentHash":   payment.PaymentHash,
+					"inflightHtlcs": countInflightHTLCs(payment),
+				}).Info("Payment is still in flight")
+				return nil, ErrPaymentPending
+			}
+			return nil, err
+		}
+		payment = update
+		switch payment.Status {
+		case lnrpc.Payment_SUCCEEDED:
+			return payment, nil
+		case lnrpc.Payment_FAILED:
+			return nil, fmt.Errorf("Payment failed: %s", payment.FailureReason.String())
+		}
+	}
+}
+
+func countInflightHTLCs(payment *lnrpc.Payment) int {
+	count := 0
+	for _, htlc := range payment.Htlcs {
+		if htlc.Status == lnrpc.HTLCAttempt_IN_FLIGHT {
+			count++
+		}
+	}
+	return count
+}
+
+func (svc *LNDService) GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error) {
+	resp, err := svc.client.ChannelBalance(ctx, &lnrpc.ChannelBalanceRequest{})
+	if err != nil {
+		return 0, err
+	}
+	// empty amounts can be left out of the response
+	if resp.LocalBalance == nil {
+		return 0, nil
+	}
+	return int64(resp.LocalBalance.Msat), nil
+}
+
+func (svc *LNDService) GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error) {
+	resp, err := svc.client.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+	network := ""
+	if len(resp.Chains) > 0 {
+		network = resp.Chains[0].Network
+	}
+	return &NodeInfo{
+		Alias:       resp.Alias,
+		Color:       resp.Color,
+		Pubkey:      resp.IdentityPubkey,
+		Network:     network,
+		BlockHeight: resp.BlockHeight,
+		BlockHash:   resp.BlockHash,
+	}, nil
+}
+
+func (svc *LNDService) CreateInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	var descriptionHashBytes []byte
+	if descriptionHash != "" {
+		descriptionHashBytes, err = hex.DecodeString(descriptionHash)
+		if err != nil || len(descriptionHashBytes) != 32 {
+			svc.Logger.WithFields(logrus.Fields{
+				"senderPubkey":    senderPubkey,
+				"amount":          amount,
+				"description":     description,
+				"descriptionHash": descriptionHash,
+				"expiry":          expiry,
+			}).Errorf("Invalid description hash")
+			return nil, errors.New("Description hash must be 32 bytes hex")
+		}
+	}
+
+	resp, err := svc.client.AddInvoice(ctx, &lnrpc.Invoice{ValueMsat: amount, Memo: description, DescriptionHash: descriptionHashBytes, Expiry: expiry})
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt := time.Now()
+	if expiry == 0 {
+		// LND's default invoice expiry
+		expiry = 86400
+	}
+	return &Nip47Transaction{
+		Type:            "incoming",
+		Invoice:         resp.PaymentRequest,
+		Description:     description,
+		DescriptionHash: descriptionHash,
+		PaymentHash:     hex.EncodeToString(resp.RHash),
+		Amount:          amount,
+		CreatedAt:       createdAt.Unix(),
+		ExpiresAt:       createdAt.Add(time.Duration(expiry) * time.Second).Unix(),
+	}, nil
+}
+
+func (svc *LNDService) LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error) {
+	paymentHashBytes, err := hex.DecodeString(paymentHash)
+	if err != nil || len(paymentHashBytes) != 32 {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"paymentHash":  paymentHash,
+		}).Errorf("Invalid payment hash")
+		return nil, errors.New("Payment hash must be 32 bytes hex")
+	}
+
+	invoice, err := svc.client.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: paymentHashBytes})
+	if err == nil {
+		return lndInvoiceToTransaction(invoice), nil
+	}
+	if status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+
+	// not one of our invoices, check if it is a payment we made
+	payment, err := svc.trackPayment(ctx, paymentHashBytes)
+	if err != nil {
+		return nil, err
+	}
+	return lndPaymentToTransaction(payment), nil
+}
+
+// trackPayment returns the current state of an outgoing payment, including its pending HTLCs
+func (svc *LNDService) trackPayment(ctx context.Context, paymentHash []byte) (*lnrpc.Payment, error) {
+	// the first update is the current state, we are not interested in later ones
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := svc.routerClient.TrackPaymentV2(ctx, &routerrpc.TrackPaymentRequest{PaymentHash: paymentHash})
+	if err == nil {
+		var payment *lnrpc.Payment
+		payment, err = stream.Recv()
+		if err == nil {
+			return payment, nil
+		}
+	}
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrTransactionNotFound
+	}
+	return nil, err
+}
+
+func (svc *LNDService) listInvoices(ctx context.Context, req *lnrpc.ListInvoiceRequest) (*lnrpc.ListInvoiceResponse, error) {
+	return svc.client.ListInvoices(ctx, req)
+}
+
+func (svc *LNDService) listPayments(ctx context.Context, req *lnrpc.ListPaymentsRequest) (*lnrpc.ListPaymentsResponse, error) {
+	return svc.client.ListPayments(ctx, req)
+}
+
+// lndTransactionsClient lists the invoices and payments of LND, it is implemented by the gRPC and the REST client
+type lndTransactionsClient interface {
+	listInvoices(ctx context.Context, req *lnrpc.ListInvoiceRequest) (*lnrpc.ListInvoiceResponse, error)
+	listPayments(ctx context.Context, req *lnrpc.ListPaymentsRequest) (*lnrpc.ListPaymentsResponse, error)
+}
+
+func (svc *LNDService) ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, transactionType string) (transactions []Nip47Transaction, err error) {
+	return lndListTransactions(ctx, svc, from, until, limit, offset, unpaid, transactionType)
+}
+
+func lndListTransactions(ctx context.Context, client lndTransactionsClient, from, until, limit, offset uint64, unpaid bool, transactionType string) (transactions []Nip47Transaction, err error) {
+	// LND cannot filter by creation date, so we page through the newest entries
+	// until we are past `from` or have enough matching transactions.
+	wanted := uint64(0)
+	if limit > 0 {
+		wanted = offset + limit
+	}
+
+	if transactionType != "outgoing" {
+		matching := uint64(0)
+		indexOffset := uint64(0)
+		for {
+			resp, err := client.listInvoices(ctx, &lnrpc.ListInvoiceRequest{
+				IndexOffset:    indexOffset,
+				NumMaxInvoices: lndListPageSize,
+				Reversed:       true,
+			})
+			if err != nil {
+				return nil, err
+			}
+			pastFrom := false
+			for _, invoice := range resp.Invoices {
+				transaction := lndInvoiceToTransaction(invoice)
+				if from != 0 && transaction.CreatedAt < int64(from) {
+					pastFrom = true
+					continue
+				}
+				if matchesTransactionFilter(transaction, from, until, unpaid, transactionType) {
+					transactions = append(transactions, *transaction)
+					matching++
+				}
+			}
+			if pastFrom || (wanted > 0 && matching >= wanted) || len(resp.Invoices) == 0 || resp.FirstIndexOffset <= 1 {
+				break
+			}
+			indexOffset = resp.FirstIndexOffset
+		}
+	}
+
+	if transactionType != "incoming" {
+		matching := uint64(0)
+		indexOffset := uint64(0)
+		for {
+			resp, err := client.listPayments(ctx, &lnrpc.ListPaymentsRequest{
+				IncludeIncomplete: unpaid,
+				IndexOffset:       indexOffset,
+				MaxPayments:       lndListPageSize,
+				Reversed:          true,
+			})
+			if err != nil {
+				return nil, err
+			}
+			pastFrom := false
+			for _, payment := range resp.Payments {
+				transaction := lndPaymentToTransaction(payment)
+				if from != 0 && transaction.CreatedAt < int64(from) {
+					pastFrom = true
+					continue
+				}
+				if matchesTransactionFilter(transaction, from, until, unpaid, transactionType) {
+					transactions = append(transactions, *transaction)
+					matching++
+				}
+			}
+			if pastFrom || (wanted > 0 && matching >= wanted) || len(resp.Payments) == 0 || resp.FirstIndexOffset <= 1 {
+				break
+			}
+			indexOffset = resp.FirstIndexOffset
+		}
+	}
+
+	return filterTransactions(transactions, from, until, limit, offset, unpaid, transactionType), nil
+}
+
+func (svc *LNDService) SubscribePayments(ctx context.Context) (notifications <-chan PaymentNotification, err error) {
+	// start after the latest payment, only new payments are notified
+	resp, err := svc.client.ListPayments(ctx, &lnrpc.ListPaymentsRequest{
+		Reversed:          true,
+		MaxPayments:       1,
+		IncludeIncomplete: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	paymentIndex := resp.LastIndexOffset
+
+	notificationsChan := make(chan PaymentNotification)
+	go svc.subscribeInvoices(ctx, notificationsChan)
+	go lndPollPayments(ctx, svc, svc.Logger, paymentIndex, notificationsChan)
+	return notificationsChan, nil
+}
+
+func (svc *LNDService) subscribeInvoices(ctx context.Context, notifications chan<- PaymentNotification) {
+	var settleIndex uint64
+	for {
+		stream, err := svc.client.SubscribeInvoices(ctx, &lnrpc.InvoiceSubscription{SettleIndex: settleIndex})
+		if err == nil {
+			for {
+				invoice, err := stream.Recv()
+				if err != nil {
+					svc.Logger.WithError(err).Error("Invoice subscription failed")
+					break
+				}
+				if invoice.State != lnrpc.Invoice_SETTLED || invoice.SettleIndex <= settleIndex {
+					continue
+				}
+				settleIndex = invoice.SettleIndex
+				select {
+				case notifications <- PaymentNotification{
+					Type:        NIP_47_PAYMENT_RECEIVED_NOTIFICATION,
+					Transaction: *lndInvoiceToTransaction(invoice),
+				}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		} else {
+			svc.Logger.WithError(err).Error("Failed to subscribe to invoices")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lndResubscribeDelay):
+		}
+	}
+}
+
+func lndPollPayments(ctx context.Context, client lndTransactionsClient, logger *logrus.Logger, paymentIndex uint64, notifications chan<- PaymentNotification) {
+	ticker := time.NewTicker(lndPaymentsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		resp, err := client.listPayments(ctx, &lnrpc.ListPaymentsRequest{
+			IndexOffset:       paymentIndex,
+			MaxPayments:       lndListPageSize,
+			IncludeIncomplete: true,
+		})
+		if err != nil {
+			logger.WithError(err).Error("Failed to poll payments")
+			continue
+		}
+		for _, payment := range resp.Payments {
+			// wait for in-flight payments to complete before moving past them
+			if payment.Status == lnrpc.Payment_IN_FLIGHT || payment.Status == lnrpc.Payment_UNKNOWN {
+				break
+			}
+			paymentIndex = payment.PaymentIndex
+			if payment.Status != lnrpc.Payment_SUCCEEDED {
+				continue
+			}
+			select {
+			case notifications <- PaymentNotification{
+				Type:        NIP_47_PAYMENT_SENT_NOTIFICATION,
+				Transaction: *lndPaymentToTransaction(payment),
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func lndInvoiceToTransaction(invoice *lnrpc.Invoice) *Nip47Transaction {
+	var settledAt int64
+	var preimage string
+	state := NIP_47_TRANSACTION_STATE_PENDING
+	expiresAt := invoice.CreationDate + invoice.Expiry
+	switch {
+	case invoice.State == lnrpc.Invoice_SETTLED:
+		state = NIP_47_TRANSACTION_STATE_SETTLED
+		settledAt = invoice.SettleDate
+		preimage = hex.EncodeToString(invoice.RPreimage)
+	case invoice.State == lnrpc.Invoice_CANCELED:
+		state = NIP_47_TRANSACTION_STATE_FAILED
+	case expiresAt < time.Now().Unix():
+		state = NIP_47_TRANSACTION_STATE_EXPIRED
+	}
+
+	return &Nip47Transaction{
+		Type:            "incoming",
+		State:           state,
+		Invoice:         invoice.PaymentRequest,
+		Description:     invoice.Memo,
+		DescriptionHash: hex.EncodeToString(invoice.DescriptionHash),
+		Preimage:        preimage,
+		PaymentHash:     hex.EncodeToString(invoice.RHash),
+		Amount:          invoice.ValueMsat,
+		CreatedAt:       invoice.CreationDate,
+		ExpiresAt:       expiresAt,
+		SettledAt:       settledAt,
+	}
+}
+
+func lndPaymentToTransaction(payment *lnrpc.Payment) *Nip47Transaction {
+	var description, descriptionHash, preimage string
+	var expiresAt, settledAt int64
+	if payment.PaymentRequest != "" {
+		paymentRequest, err := decodepay.Decodepay(payment.PaymentRequest)
+		if err == nil {
+			description = paymentRequest.Description
+			descriptionHash = paymentRequest.DescriptionHash
+			expiresAt = int64(paymentRequest.CreatedAt + paymentRequest.Expiry)
+		}
+	}
+
+	state := NIP_47_TRANSACTION_STATE_PENDING
+	switch payment.Status {
+	case lnrpc.Payment_SUCCEEDED:
+		state = NIP_47_TRANSACTION_STATE_SETTLED
+		preimage = payment.PaymentPreimage
+		// the payment is settled once the last successful HTLC resolved
+		var resolveTimeNs int64
+		for _, htlc := range payment.Htlcs {
+			if htlc.Status == lnrpc.HTLCAttempt_SUCCEEDED && htlc.ResolveTimeNs > resolveTimeNs {
+				resolveTimeNs = htlc.ResolveTimeNs
+			}
+		}
+		if resolveTimeNs > 0 {
+			settledAt = time.Unix(0, resolveTimeNs).Unix()
+		}
+	case lnrpc.Payment_FAILED:
+		state = NIP_47_TRANSACTION_STATE_FAILED
+	}
+
+	return &Nip47Transaction{
+		Type:            "outgoing",
+		State:           state,
+		Invoice:         payment.PaymentRequest,
+		Description:     description,
+		DescriptionHash: descriptionHash,
+		Preimage:        preimage,
+		PaymentHash:     payment.PaymentHash,
+		Amount:          payment.ValueMsat,
+		FeesPaid:        payment.FeeMsat,
+		CreatedAt:       time.Unix(0, payment.CreationTimeNs).Unix(),
+		ExpiresAt:       expiresAt,
+		SettledAt:       settledAt,
+	}
+}
+
+// newLNDConnection connects to the gRPC interface of LND, authenticated with the macaroon
+func newLNDConnection(address, certFile, macaroonFile string) (*grpc.ClientConn, error) {
+	// without a certificate file the system's certificates are used
+	creds := credentials.NewTLS(&tls.Config{})
+	if certFile != "" {
+		credsFromFile, err := credentials.NewClientTLSFromFile(certFile, "")
+		if err != nil {
+			return nil, err
+		}
+		creds = credsFromFile
+	}
+
+	if macaroonFile == "" {
+		return nil, errors.New("LND macaroon is missing")
+	}
+	macaroonData, err := os.ReadFile(macaroonFile)
+	if err != nil {
+		return nil, err
+	}
+	mac := &macaroon.Macaroon{}
+	err = mac.UnmarshalBinary(macaroonData)
+	if err != nil {
+		return nil, err
+	}
+	macCred, err := macaroons.NewMacaroonCredential(mac)
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.Dial(address, grpc.WithTransportCredentials(creds), grpc.WithPerRPCCredentials(macCred))
+}
+
+func NewLNDService(ctx context.Context, svc *Service, e *echo.Echo) (result *LNDService, err error) {
+	conn, err := newLNDConnection(svc.cfg.LNDAddress, svc.cfg.LNDCertFile, svc.cfg.LNDMacaroonFile)
+	if err != nil {
+		return nil, err
+	}
+	lndService := &LNDService{
+		client:         lnrpc.NewLightningClient(conn),
+		routerClient:   routerrpc.NewRouterClient(conn),
+		paymentOptions: newLNDPaymentOptions(svc.cfg),
+		Logger:         svc.Logger,
+		db:             svc.db,
+	}
+	info, err := lndService.client.GetInfo(ctx, &lnrpc.GetInfoRequest{})
 	if err != nil {
 		return nil, err
 	}
@@ -70,8 +645,6 @@ func NewLNDService(ctx context.Context, svc *Service, e *echo.Echo) (result *LND
 		return nil, err
 	}
 
-	lndService := &LNDService{client: lndClient, Logger: svc.Logger, db: svc.db}
-
 	e.GET("/lnd/auth", lndService.AuthHandler)
 	svc.Logger.Infof("Connected to LND - alias %s", info.Alias)
 
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/record"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gorm.io/gorm"
+)
+
+// LNDRestService talks to LND through its REST interface, for setups which do not expose gRPC.
+// Requests and responses are the lnrpc messages in their JSON encoding, so it behaves exactly like LNDService.
+type LNDRestService struct {
+	address        string
+	macaroon       string
+	httpClient     *http.Client
+	paymentOptions lndPaymentOptions
+	db             *gorm.DB
+	Logger         *logrus.Logger
+}
+
+type lndRestErrorResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// older versions also return the message as error
+	Error string `json:"error"`
+}
+
+type lndRestError struct {
+	StatusCode int
+	Code       int
+	Message    string
+}
+
+func (err *lndRestError) Error() string {
+	return fmt.Sprintf("LND request failed: %s", err.Message)
+}
+
+func newLNDRestError(statusCode int, errorResponse *lndRestErrorResponse) *lndRestError {
+	message := errorResponse.Message
+	if message == "" {
+		message = errorResponse.Error
+	}
+	if message == "" {
+		message = fmt.Sprintf("unexpected status %d", statusCode)
+	}
+	return &lndRestError{StatusCode: statusCode, Code: errorResponse.Code, Message: message}
+}
+
+var lndRestUnmarshalOptions = protojson.UnmarshalOptions{DiscardUnknown: true}
+
+// lndRestStream reads the messages of a streaming endpoint, every message is a JSON object with either a result or an error
+type lndRestStream struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (stream *lndRestStream) Recv(result proto.Message) error {
+	message := &struct {
+		Result json.RawMessage       `json:"result"`
+		Error  *lndRestErrorResponse `json:"error"`
+	}{}
+	err := stream.decoder.Decode(message)
+	if err != nil {
+		return err
+	}
+	if message.Error != nil {
+		return newLNDRestError(http.StatusOK, message.Error)
+	}
+	return lndRestUnmarshalOptions.Unmarshal(message.Result, result)
+}
+
+func (stream *lndRestStream) Close() error {
+	return stream.body.Close()
+}
+
+func (svc *LNDRestService) AuthHandler(c echo.Context) error {
+	user := &User{}
+	err := svc.db.FirstOrInit(user, User{AlbyIdentifier: "lnd"}).Error
+	if err != nil {
+		return err
+	}
+
+	sess, _ := session.Get(CookieName, c)
+	sess.Values["user_id"] = user.ID
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(302, "/")
+}
+
+// request sends the payload as JSON and returns the response if it was successful
+func (svc *LNDRestService) request(ctx context.Context, method, path string, payload proto.Message) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		payloadBytes, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(payloadBytes)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, svc.address+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "NWC")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Grpc-Metadata-macaroon", svc.macaroon)
+
+	resp, err := svc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		errorResponse := &lndRestErrorResponse{}
+		json.NewDecoder(resp.Body).Decode(errorResponse)
+		return nil, newLNDRestError(resp.StatusCode, errorResponse)
+	}
+	return resp, nil
+}
+
+// call sends a request to LND and decodes the response into result
+func (svc *LNDRestService) call(ctx context.Context, method, path string, payload proto.Message, result proto.Message) error {
+	resp, err := svc.request(ctx, method, path, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return lndRestUnmarshalOptions.Unmarshal(body, result)
+}
+
+// stream opens a streaming endpoint, the caller has to close the stream
+func (svc *LNDRestService) stream(ctx context.Context, method, path string, payload proto.Message) (*lndRestStream, error) {
+	resp, err := svc.request(ctx, method, path, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &lndRestStream{body: resp.Body, decoder: json.NewDecoder(resp.Body)}, nil
+}
+
+func (svc *LNDRestService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string) (preimage string, err error) {
+	paymentRequest, err := decodepay.Decodepay(payReq)
+	if err != nil {
+		return "", err
+	}
+	payment, err := svc.sendPayment(ctx, &routerrpc.SendPaymentRequest{
+		PaymentRequest: payReq,
+		FeeLimitMsat:   svc.paymentOptions.feeLimitMsat(paymentRequest.MSatoshi),
+	})
+	if err != nil {
+		return "", err
+	}
+	return payment.PaymentPreimage, nil
+}
+
+// sendPayment sends the payment and follows its status like LNDService.sendPayment,
+// ErrPaymentPending is returned if the payment is still in flight after the timeout.
+func (svc *LNDRestService) sendPayment(ctx context.Context, req *routerrpc.SendPaymentRequest) (*lnrpc.Payment, error) {
+	req.TimeoutSeconds = svc.paymentOptions.timeoutSeconds
+	trackCtx, cancel := context.WithTimeout(ctx, time.Duration(req.TimeoutSeconds)*time.Second+lndPaymentPendingGracePeriod)
+	defer cancel()
+	stream, err := svc.stream(trackCtx, "POST", "/v2/router/send", req)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var payment *lnrpc.Payment
+	for {
+		update := &lnrpc.Payment{}
+		err := stream.Recv(update)
+		if err != nil {
+			if payment != nil && trackCtx.Err() != nil && ctx.Err() == nil {
+				svc.Logger.WithFields(logrus.Fields{
+					"paymentHash":   payment.PaymentHash,
+					"inflightHtlcs": countInflightHTLCs(payment),
+				}).Info("Payment is still in flight")
+				return nil, ErrPaymentPending
+			}
+			return nil, err
+		}
+		payment = update
+		switch payment.Status {
+		case lnrpc.Payment_SUCCEEDED:
+			return payment, nil
+		case lnrpc.Payment_FAILED:
+			return nil, fmt.Errorf("Payment failed: %s", payment.FailureReason.String())
+		}
+	}
+}
+
+func (svc *LNDRestService) SupportsKeysend() (keysend bool, customPreimage bool) {
+	return true, true
+}
+
+func (svc *LNDRestService) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, customRecords []TLVRecord) (respPreimage string, err error) {
+	destBytes, err := hex.DecodeString(destination)
+	if err != nil {
+		return "", err
+	}
+	// the caller chooses the preimage, so the payment can be looked up if LND does not return
+	if preimage == "" {
+		return "", errors.New("LND keysend payments need a preimage")
+	}
+	preimageBytes, err := hex.DecodeString(preimage)
+	if err != nil {
+		return "", err
+	}
+	paymentHash := sha256.Sum256(preimageBytes)
+
+	destCustomRecords := map[uint64][]byte{}
+	for _, record := range customRecords {
+		decodedValue, err := hex.DecodeString(record.Value)
+		if err != nil {
+			return "", fmt.Errorf("Invalid value for TLV record %d: %w", record.Type, err)
+		}
+		destCustomRecords[record.Type] = decodedValue
+	}
+	destCustomRecords[record.KeySendType] = preimageBytes
+
+	payment, err := svc.sendPayment(ctx, &routerrpc.SendPaymentRequest{
+		Dest:              destBytes,
+		AmtMsat:           amount,
+		PaymentHash:       paymentHash[:],
+		DestFeatures:      []lnrpc.FeatureBit{lnrpc.FeatureBit_TLV_ONION_REQ},
+		DestCustomRecords: destCustomRecords,
+		FeeLimitMsat:      svc.paymentOptions.feeLimitMsat(amount),
+	})
+	if err != nil {
+		return "", err
+	}
+	return payment.PaymentPreimage, nil
+}
+
+func (svc *LNDRestService) GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error) {
+	resp := &lnrpc.ChannelBalanceResponse{}
+	err = svc.call(ctx, "GET", "/v1/balance/channels", nil, resp)
+	if err != nil {
+		return 0, err
+	}
+	// empty amounts can be left out of the response
+	if resp.LocalBalance == nil {
+		return 0, nil
+	}
+	return int64(resp.LocalBalance.Msat), nil
+}
+
+func (svc *LNDRestService) GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error) {
+	resp := &lnrpc.GetInfoResponse{}
+	err = svc.call(ctx, "GET", "/v1/getinfo", nil, resp)
+	if err != nil {
+		return nil, err
+	}
+	network := ""
+	if len(resp.Chains) > 0 {
+		network = resp.Chains[0].Network
+	}
+	return &NodeInfo{
+		Alias:       resp.Alias,
+		Color:       resp.Color,
+		Pubkey:      resp.IdentityPubkey,
+		Network:     network,
+		BlockHeight: resp.BlockHeight,
+		BlockHash:   resp.BlockHash,
+	}, nil
+}
+
+func (svc *LNDRestService) CreateInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	var descriptionHashBytes []byte
+	if descriptionHash != "" {
+		descriptionHashBytes, err = hex.DecodeString(descriptionHash)
+		if err != nil || len(descriptionHashBytes) != 32 {
+			svc.Logger.WithFields(logrus.Fields{
+				"senderPubkey":    senderPubkey,
+				"amount":          amount,
+				"description":     description,
+				"descriptionHash": descriptionHash,
+				"expiry":          expiry,
+			}).Errorf("Invalid description hash")
+			return nil, errors.New("Description hash must be 32 bytes hex")
+		}
+	}
+
+	resp := &lnrpc.AddInvoiceResponse{}
+	err = svc.call(ctx, "POST", "/v1/invoices", &lnrpc.Invoice{ValueMsat: amount, Memo: description, DescriptionHash: descriptionHashBytes, Expiry: expiry}, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt := time.Now()
+	if expiry == 0 {
+		// LND's default invoice expiry
+		expiry = 86400
+	}
+	return &Nip47Transaction{
+		Type:            "incoming",
+		Invoice:         resp.PaymentRequest,
+		Description:     description,
+		DescriptionHash: descriptionHash,
+		PaymentHash:     hex.EncodeToString(resp.RHash),
+		Amount:          amount,
+		CreatedAt:       createdAt.Unix(),
+		ExpiresAt:       createdAt.Add(time.Duration(expiry) * time.Second).Unix(),
+	}, nil
+}
+
+func (svc *LNDRestService) LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error) {
+	paymentHashBytes, err := hex.DecodeString(paymentHash)
+	if err != nil || len(paymentHashBytes) != 32 {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"paymentHash":  paymentHash,
+		}).Errorf("Invalid payment hash")
+		return nil, errors.New("Payment hash must be 32 bytes hex")
+	}
+
+	invoice := &lnrpc.Invoice{}
+	err = svc.call(ctx, "GET", "/v1/invoice/"+paymentHash, nil, invoice)
+	if err == nil {
+		return lndInvoiceToTransaction(invoice), nil
+	}
+	var lndErr *lndRestError
+	if !errors.As(err, &lndErr) || lndErr.StatusCode != http.StatusNotFound {
+		return nil, err
+	}
+
+	// not one of our invoices, check if it is a payment we made
+	payment, err := svc.trackPayment(ctx, paymentHashBytes)
+	if err != nil {
+		return nil, err
+	}
+	return lndPaymentToTransaction(payment), nil
+}
+
+// trackPayment returns the current state of an outgoing payment, including its pending HTLCs
+func (svc *LNDRestService) trackPayment(ctx context.Context, paymentHash []byte) (*lnrpc.Payment, error) {
+	// the first update is the current state, we are not interested in later ones
+	stream, err := svc.stream(ctx, "GET", "/v2/router/track/"+base64.URLEncoding.EncodeToString(paymentHash), nil)
+	if err == nil {
+		defer stream.Close()
+		payment := &lnrpc.Payment{}
+		err = stream.Recv(payment)
+		if err == nil {
+			return payment, nil
+		}
+	}
+	// the error is returned as status or, once the stream started, as message
+	var lndErr *lndRestError
+	if errors.As(err, &lndErr) && (lndErr.StatusCode == http.StatusNotFound || lndErr.Code == int(codes.NotFound)) {
+		return nil, ErrTransactionNotFound
+	}
+	return nil, err
+}
+
+func (svc *LNDRestService) listInvoices(ctx context.Context, req *lnrpc.ListInvoiceRequest) (*lnrpc.ListInvoiceResponse, error) {
+	query := url.Values{}
+	query.Set("index_offset", strconv.FormatUint(req.IndexOffset, 10))
+	query.Set("num_max_invoices", strconv.FormatUint(req.NumMaxInvoices, 10))
+	query.Set("reversed", strconv.FormatBool(req.Reversed))
+	resp := &lnrpc.ListInvoiceResponse{}
+	err := svc.call(ctx, "GET", "/v1/invoices?"+query.Encode(), nil, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (svc *LNDRestService) listPayments(ctx context.Context, req *lnrpc.ListPaymentsRequest) (*lnrpc.ListPaymentsResponse, error) {
+	query := url.Values{}
+	query.Set("include_incomplete", strconv.FormatBool(req.IncludeIncomplete))
+	query.Set("index_offset", strconv.FormatUint(req.IndexOffset, 10))
+	query.Set("max_payments", strconv.FormatUint(req.MaxPayments, 10))
+	query.Set("reversed", strconv.FormatBool(req.Reversed))
+	resp := &lnrpc.ListPaymentsResponse{}
+	err := svc.call(ctx, "GET", "/v1/payments?"+query.Encode(), nil, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (svc *LNDRestService) ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, transactionType string) (transactions []Nip47Transaction, err error) {
+	return lndListTransactions(ctx, svc, from, until, limit, offset, unpaid, transactionType)
+}
+
+func (svc *LNDRestService) SubscribePayments(ctx context.Context) (notifications <-chan PaymentNotification, err error) {
+	// start after the latest payment, only new payments are notified
+	resp, err := svc.listPayments(ctx, &lnrpc.ListPaymentsRequest{
+		Reversed:          true,
+		MaxPayments:       1,
+		IncludeIncomplete: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	paymentIndex := resp.LastIndexOffset
+
+	notificationsChan := make(chan PaymentNotification)
+	go svc.subscribeInvoices(ctx, notificationsChan)
+	go lndPollPayments(ctx, svc, svc.Logger, paymentIndex, notificationsChan)
+	return notificationsChan, nil
+}
+
+func (svc *LNDRestService) subscribeInvoices(ctx context.Context, notifications chan<- PaymentNotification) {
+	var settleIndex uint64
+	for {
+		stream, err := svc.stream(ctx, "GET", "/v1/invoices/subscribe?settle_index="+strconv.FormatUint(settleIndex, 10), nil)
+		if err == nil {
+			for {
+				invoice := &lnrpc.Invoice{}
+				err := stream.Recv(invoice)
+				if err != nil {
+					svc.Logger.WithError(err).Error("Invoice subscription failed")
+					break
+				}
+				if invoice.State != lnrpc.Invoice_SETTLED || invoice.SettleIndex <= settleIndex {
+					continue
+				}
+				settleIndex = invoice.SettleIndex
+				select {
+				case notifications <- PaymentNotification{
+					Type:        NIP_47_PAYMENT_RECEIVED_NOTIFICATION,
+					Transaction: *lndInvoiceToTransaction(invoice),
+				}:
+				case <-ctx.Done():
+					stream.Close()
+					return
+				}
+			}
+			stream.Close()
+		} else {
+			svc.Logger.WithError(err).Error("Failed to subscribe to invoices")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lndResubscribeDelay):
+		}
+	}
+}
+
+func NewLNDRestService(ctx context.Context, svc *Service, e *echo.Echo) (result *LNDRestService, err error) {
+	if svc.cfg.LNDAddress == "" || svc.cfg.LNDMacaroonFile == "" {
+		return nil, errors.New("LND_ADDRESS and LND_MACAROON_FILE are required for the LND REST backend")
+	}
+	// the invoice and payment streams stay open, requests are bounded by their context
+	httpClient, err := newHTTPClientWithCert(svc.cfg.LNDCertFile, 0)
+	if err != nil {
+		return nil, err
+	}
+	macaroon, err := os.ReadFile(svc.cfg.LNDMacaroonFile)
+	if err != nil {
+		return nil, err
+	}
+	address := strings.TrimSuffix(svc.cfg.LNDAddress, "/")
+	if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+		address = "https://" + address
+	}
+	lndService := &LNDRestService{
+		address:        address,
+		macaroon:       hex.EncodeToString(macaroon),
+		httpClient:     httpClient,
+		paymentOptions: newLNDPaymentOptions(svc.cfg),
+		Logger:         svc.Logger,
+		db:             svc.db,
+	}
+	info, err := lndService.GetInfo(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	// same user as the gRPC backend, so apps keep working when switching between them
+	user := &User{}
+	err = svc.db.FirstOrInit(user, User{AlbyIdentifier: "lnd"}).Error
+	if err != nil {
+		return nil, err
+	}
+	err = svc.db.Save(user).Error
+	if err != nil {
+		return nil, err
+	}
+
+	e.GET("/lnd_rest/auth", lndService.AuthHandler)
+	svc.Logger.Infof("Connected to LND REST - alias %s", info.Alias)
+
+	return lndService, nil
+}
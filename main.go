@@ -32,6 +32,10 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error loading environment variables: %v", err)
 	}
+	err = cfg.Validate()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	var db *gorm.DB
 	if strings.HasPrefix(cfg.DatabaseUri, "postgres://") || strings.HasPrefix(cfg.DatabaseUri, "postgresql://") || strings.HasPrefix(cfg.DatabaseUri, "unix://") {
@@ -57,7 +61,15 @@ func main() {
 	sqlDb.SetConnMaxLifetime(time.Duration(cfg.DatabaseConnMaxLifetime) * time.Second)
 
 	// Migrate the schema
-	err = db.AutoMigrate(&User{}, &App{}, &AppPermission{}, &NostrEvent{}, &Payment{}, &Identity{})
+	err = db.AutoMigrate(&User{}, &App{}, &AppPermission{}, &NostrEvent{}, &Payment{}, &Invoice{}, &Identity{}, &RelayCursor{}, &OutboxEvent{})
+	if err != nil {
+		log.Fatalf("Failed migrate DB %v", err)
+	}
+	err = migratePaymentStates(db)
+	if err != nil {
+		log.Fatalf("Failed migrate DB %v", err)
+	}
+	err = migratePaymentHashes(db)
 	if err != nil {
 		log.Fatalf("Failed migrate DB %v", err)
 	}
@@ -123,6 +135,30 @@ func main() {
 			svc.Logger.Fatal(err)
 		}
 		svc.lnClient = lndClient
+	case LNDRestBackendType:
+		lndClient, err := NewLNDRestService(ctx, svc, e)
+		if err != nil {
+			svc.Logger.Fatal(err)
+		}
+		svc.lnClient = lndClient
+	case CLNBackendType:
+		clnClient, err := NewCLNService(ctx, svc, e)
+		if err != nil {
+			svc.Logger.Fatal(err)
+		}
+		svc.lnClient = clnClient
+	case LNbitsBackendType:
+		lnbitsClient, err := NewLNbitsService(ctx, svc, e)
+		if err != nil {
+			svc.Logger.Fatal(err)
+		}
+		svc.lnClient = lnbitsClient
+	case PhoenixdBackendType:
+		phoenixdClient, err := NewPhoenixdService(ctx, svc, e)
+		if err != nil {
+			svc.Logger.Fatal(err)
+		}
+		svc.lnClient = phoenixdClient
 	case AlbyBackendType:
 		oauthService, err := NewAlbyOauthService(svc, e)
 		if err != nil {
@@ -148,48 +184,59 @@ func main() {
 		wg.Done()
 	}()
 
-	//connect to the relay
-	svc.Logger.Infof("Connecting to the relay: %s", cfg.Relay)
-	relay, err := nostr.RelayConnect(ctx, cfg.Relay)
-	if err != nil {
-		svc.Logger.Fatal(err)
-	}
+	//connect to the default relays and the relays of all apps
+	pool := NewRelayPool(svc.Logger)
+	svc.relayPool = pool
+	pool.Authenticate = svc.authenticateRelay
+	pool.Start(ctx, svc.getAllRelays(), svc.createFilters, func(ctx context.Context, relay *nostr.Relay) {
+		//publish event with NIP-47 info
+		err := svc.PublishNip47Info(ctx, relay)
+		if err != nil {
+			svc.Logger.WithError(err).Errorf("Could not publish NIP47 info to %s", relay.URL)
+		}
+	})
+
+	//retry the events no relay acknowledged yet
+	go svc.StartOutbox(ctx, pool)
+
+	//resolve the payments which were interrupted by a restart
+	go svc.StartPaymentReconciler(ctx)
 
-	//publish event with NIP-47 info
-	err = svc.PublishNip47Info(ctx, relay)
+	//subscribe to payment updates of the LN backend
+	notifications, err := svc.lnClient.SubscribePayments(ctx)
 	if err != nil {
-		svc.Logger.WithError(err).Error("Could not publish NIP47 info")
+		svc.Logger.WithError(err).Error("Could not subscribe to payment notifications")
+	} else {
+		go svc.PublishNotifications(ctx, pool, notifications)
 	}
 
 	//Start infinite loop which will be only broken by canceling ctx (SIGINT)
-	//TODO: we can start this loop for multiple relays
-	for {
-		svc.Logger.Info("Subscribing to events")
-		sub := relay.Subscribe(ctx, svc.createFilters())
-		err = svc.StartSubscription(ctx, sub)
-		if err != nil {
-			//err being non-nil means that we have an error on the websocket error channel. In this case we just try to reconnect.
-			svc.Logger.WithError(err).Error("Got an error from the relay. Reconnecting...")
-			relay, err = nostr.RelayConnect(ctx, cfg.Relay)
-			if err != nil {
-				svc.Logger.Fatal(err)
-			}
-			continue
-		}
-		//err being nil means that the context was canceled and we should exit the program.
-		break
-	}
-	err = relay.Close()
+	err = svc.StartSubscription(ctx, pool)
 	if err != nil {
 		svc.Logger.Error(err)
 	}
+	pool.Wait()
 	svc.Logger.Info("Graceful shutdown completed. Goodbye.")
 }
 
-func (svc *Service) createFilters() nostr.Filters {
+// createFilters subscribes to requests newer than the last request processed from the relay,
+// so requests sent while the service was offline are caught up on.
+func (svc *Service) createFilters(relayUrl string) nostr.Filters {
+	since := time.Now().Add(-time.Duration(svc.cfg.StoredEventMaxAge) * time.Second)
+	relayCursor := RelayCursor{}
+	err := svc.db.Where("url = ?", relayUrl).Limit(1).Find(&relayCursor).Error
+	if err != nil {
+		svc.Logger.WithError(err).Errorf("Failed to load relay cursor for %s", relayUrl)
+	}
+	// created_at only has a resolution of seconds and events are processed concurrently,
+	// the margin catches events that were not processed yet when the cursor moved past them
+	if cursorSince := relayCursor.LastEventAt.Add(-relayCursorMargin); cursorSince.After(since) {
+		since = cursorSince
+	}
 	filter := nostr.Filter{
 		Tags:  nostr.TagMap{"p": []string{svc.cfg.IdentityPubkey}},
 		Kinds: []int{NIP_47_REQUEST_KIND},
+		Since: &since,
 	}
 	if svc.cfg.ClientPubkey != "" {
 		filter.Authors = []string{svc.cfg.ClientPubkey}
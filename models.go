@@ -1,16 +1,32 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+const (
+	NIP_47_TRANSACTION_STATE_PENDING = "pending"
+	NIP_47_TRANSACTION_STATE_SETTLED = "settled"
+	NIP_47_TRANSACTION_STATE_EXPIRED = "expired"
+	NIP_47_TRANSACTION_STATE_FAILED  = "failed"
+)
+
 const (
 	NIP_47_INFO_EVENT_KIND            = 13194
 	NIP_47_REQUEST_KIND               = 23194
 	NIP_47_RESPONSE_KIND              = 23195
 	NIP_47_PAY_INVOICE_METHOD         = "pay_invoice"
+	NIP_47_GET_BALANCE_METHOD         = "get_balance"
+	NIP_47_MAKE_INVOICE_METHOD        = "make_invoice"
+	NIP_47_LOOKUP_INVOICE_METHOD      = "lookup_invoice"
+	NIP_47_LIST_TRANSACTIONS_METHOD   = "list_transactions"
+	NIP_47_PAY_KEYSEND_METHOD         = "pay_keysend"
+	NIP_47_MULTI_PAY_INVOICE_METHOD   = "multi_pay_invoice"
+	NIP_47_MULTI_PAY_KEYSEND_METHOD   = "multi_pay_keysend"
+	NIP_47_GET_INFO_METHOD            = "get_info"
 	NIP_47_ERROR_INTERNAL             = "INTERNAL"
 	NIP_47_ERROR_NOT_IMPLEMENTED      = "NOT_IMPLEMENTED"
 	NIP_47_ERROR_QUOTA_EXCEEDED       = "QUOTA_EXCEEDED"
@@ -18,14 +34,53 @@ const (
 	NIP_47_ERROR_UNAUTHORIZED         = "UNAUTHORIZED"
 	NIP_47_ERROR_EXPIRED              = "EXPIRED"
 	NIP_47_ERROR_RESTRICTED           = "RESTRICTED"
-	NIP_47_CAPABILITIES               = "pay_invoice"
+	NIP_47_ERROR_NOT_FOUND            = "NOT_FOUND"
+	NIP_47_ERROR_OTHER                = "OTHER"
+	NIP_47_ERROR_INVALID_EVENT        = "INVALID_EVENT"
+	NIP_47_ERROR_RATE_LIMITED         = "RATE_LIMITED"
+	NIP_47_ERROR_PAYMENT_IN_PROGRESS  = "PAYMENT_IN_PROGRESS"
+	NIP_47_ERROR_PAYMENT_FAILED       = "PAYMENT_FAILED"
+	NIP_47_CAPABILITIES               = "pay_invoice pay_keysend multi_pay_invoice multi_pay_keysend get_balance make_invoice lookup_invoice list_transactions get_info"
+	// not a NIP-47 method: allows list_transactions to return transactions not created by the app
+	NIP_47_LIST_ALL_TRANSACTIONS_PERMISSION = "list_all_transactions"
+)
+
+const (
+	NIP_47_NOTIFICATION_KIND             = 23196
+	NIP_47_PAYMENT_RECEIVED_NOTIFICATION = "payment_received"
+	NIP_47_PAYMENT_SENT_NOTIFICATION     = "payment_sent"
+	NIP_47_NOTIFICATION_TYPES            = "payment_received payment_sent"
+	// not a NIP-47 method: allows the app to receive notification events
+	NIP_47_NOTIFICATIONS_PERMISSION = "notifications"
+)
+
+const (
+	NIP_47_ENCRYPTION_NIP04    = "nip04"
+	NIP_47_ENCRYPTION_NIP44_V2 = "nip44_v2"
+	// advertised in the info event, preferred scheme first
+	NIP_47_SUPPORTED_ENCRYPTIONS        = "nip44_v2 nip04"
+	NIP_47_ERROR_UNSUPPORTED_ENCRYPTION = "UNSUPPORTED_ENCRYPTION"
 )
 
+var nip47MethodDescriptions = map[string]string{
+	NIP_47_PAY_INVOICE_METHOD:               "Send payments from your wallet",
+	NIP_47_PAY_KEYSEND_METHOD:               "Send keysend payments from your wallet",
+	NIP_47_GET_BALANCE_METHOD:               "Read your balance",
+	NIP_47_MAKE_INVOICE_METHOD:              "Create invoices",
+	NIP_47_LOOKUP_INVOICE_METHOD:            "Lookup status of invoices",
+	NIP_47_LIST_TRANSACTIONS_METHOD:         "Read transactions made through this connection",
+	NIP_47_GET_INFO_METHOD:                  "Read your node info",
+	NIP_47_LIST_ALL_TRANSACTIONS_PERMISSION: "Read the full transaction history of your wallet",
+	NIP_47_NOTIFICATIONS_PERMISSION:         "Receive notifications about payments",
+}
+
 type AlbyMe struct {
 	Identifier       string `json:"identifier"`
 	NPub             string `json:"nostr_pubkey"`
 	LightningAddress string `json:"lightning_address"`
 	Email            string `json:"email"`
+	Name             string `json:"name"`
+	KeysendPubkey    string `json:"keysend_pubkey"`
 }
 
 type User struct {
@@ -36,6 +91,7 @@ type User struct {
 	Email            string
 	Expiry           time.Time
 	LightningAddress string
+	LNbitsAdminKey   string
 	Apps             []App
 	CreatedAt        time.Time
 	UpdatedAt        time.Time
@@ -48,20 +104,26 @@ type App struct {
 	Name        string `validate:"required"`
 	Description string
 	NostrPubkey string `gorm:"index"`
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	Nip44Only   bool
+	// relays the app listens on, the default relays are used if empty
+	Relays    []string `gorm:"serializer:json"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 type AppPermission struct {
-	ID                      uint `gorm:"primaryKey"`
-	AppId                   uint `gorm:"index" validate:"required"`
-	App                     App  `gorm:"constraint:OnDelete:CASCADE"`
-	RequestMethod           string  `gorm:"index" validate:"required"`
-	MaxAmount               int
-	BudgetRenewal           string
-	ExpiresAt               time.Time
-	CreatedAt               time.Time
-	UpdatedAt               time.Time
+	ID            uint   `gorm:"primaryKey"`
+	AppId         uint   `gorm:"index" validate:"required"`
+	App           App    `gorm:"constraint:OnDelete:CASCADE"`
+	RequestMethod string `gorm:"index" validate:"required"`
+	MaxAmount     int
+	BudgetRenewal string
+	ExpiresAt     time.Time
+	// maximum number of requests, 0 for no limit
+	RateLimitPerMinute int
+	RateLimitPerHour   int
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
 }
 
 type NostrEvent struct {
@@ -69,12 +131,49 @@ type NostrEvent struct {
 	AppId     uint   `gorm:"index" validate:"required"`
 	App       App    `gorm:"constraint:OnDelete:CASCADE"`
 	NostrId   string `gorm:"uniqueIndex" validate:"required"`
+	Method    string `gorm:"index"`
 	ReplyId   string
 	Content   string
 	State     string
 	RepliedAt time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
+	// publish status of the reply per relay URL
+	RelayStatuses map[string]string `gorm:"serializer:json"`
+	// the request which paid the invoice first, if this request tried to pay the same invoice again
+	DuplicateOfId uint `gorm:"index"`
+}
+
+// OutboxEvent is a signed response or notification event,
+// it is published again until a relay acknowledged it
+type OutboxEvent struct {
+	ID uint `gorm:"primaryKey"`
+	// 0 if the request was rejected before an app was found
+	AppId uint `gorm:"index"`
+	// the request the event answers, 0 for notifications
+	NostrEventId uint   `gorm:"index"`
+	EventId      string `gorm:"uniqueIndex" validate:"required"`
+	// the signed event as JSON
+	Event         string
+	Relays        []string          `gorm:"serializer:json"`
+	RelayStatuses map[string]string `gorm:"serializer:json"`
+	// pending, published or failed
+	State       string `gorm:"index"`
+	Retries     int
+	NextRetryAt time.Time
+	PublishedAt time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// RelayCursor is the creation time of the latest request received from a relay,
+// so requests sent while the service was offline can be fetched after a restart
+type RelayCursor struct {
+	ID          uint   `gorm:"primaryKey"`
+	Url         string `gorm:"uniqueIndex" validate:"required"`
+	LastEventAt time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
 }
 
 type Payment struct {
@@ -85,20 +184,77 @@ type Payment struct {
 	NostrEvent     NostrEvent
 	Amount         uint
 	PaymentRequest string
+	PaymentHash    string `gorm:"index"`
 	Preimage       string
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
+	// "pending" until the LN backend reported the outcome, then "succeeded" or "failed"
+	State string `gorm:"index"`
+	// the transaction once the LN backend reported a final state, so it is not looked up again
+	Nip47Transaction *Nip47Transaction `gorm:"serializer:json"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+type Invoice struct {
+	ID              uint `gorm:"primaryKey"`
+	AppId           uint `gorm:"index" validate:"required"`
+	App             App  `gorm:"constraint:OnDelete:CASCADE"`
+	NostrEventId    uint `gorm:"index" validate:"required"`
+	NostrEvent      NostrEvent
+	AmountMsat      int64
+	Description     string
+	DescriptionHash string
+	PaymentRequest  string
+	PaymentHash     string `gorm:"index"`
+	ExpiresAt       time.Time
+	// the transaction once the LN backend reported a final state, so it is not looked up again
+	Nip47Transaction *Nip47Transaction `gorm:"serializer:json"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
 }
 
 type PayRequest struct {
 	Invoice string `json:"invoice"`
 }
 
+type KeysendRequest struct {
+	Amount        int64             `json:"amount"`
+	Destination   string            `json:"destination"`
+	CustomRecords map[string]string `json:"custom_records,omitempty"`
+}
+
 type PayResponse struct {
 	Preimage    string `json:"payment_preimage"`
 	PaymentHash string `json:"payment_hash"`
 }
 
+type BalanceResponse struct {
+	Balance  int64  `json:"balance"`
+	Currency string `json:"currency"`
+	Unit     string `json:"unit"`
+}
+
+type MakeInvoiceRequest struct {
+	Amount          int64  `json:"amount"`
+	Description     string `json:"description"`
+	DescriptionHash string `json:"description_hash"`
+}
+
+type AlbyInvoice struct {
+	Amount          int64     `json:"amount"`
+	CreatedAt       time.Time `json:"created_at"`
+	DescriptionHash string    `json:"description_hash"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	Memo            string    `json:"memo"`
+	PaymentHash     string    `json:"payment_hash"`
+	PaymentRequest  string    `json:"payment_request"`
+	Preimage        string    `json:"preimage"`
+	Settled         bool      `json:"settled"`
+	SettledAt       time.Time `json:"settled_at"`
+	Type            string    `json:"type"`
+	State           string    `json:"state"`
+	FeesPaid        int64     `json:"fee"`
+}
+
 type ErrorResponse struct {
 	Error   bool   `json:"error"`
 	Code    int    `json:"code"`
@@ -111,8 +267,8 @@ type Identity struct {
 }
 
 type Nip47Request struct {
-	Method string      `json:"method"`
-	Params interface{} `json:"params"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
 }
 
 type Nip47Response struct {
@@ -132,3 +288,111 @@ type Nip47PayParams struct {
 type Nip47PayResponse struct {
 	Preimage string `json:"preimage"`
 }
+
+type Nip47KeysendParams struct {
+	Amount     int64       `json:"amount"`
+	Pubkey     string      `json:"pubkey"`
+	Preimage   string      `json:"preimage"`
+	TLVRecords []TLVRecord `json:"tlv_records"`
+}
+
+type Nip47MultiPayInvoiceParams struct {
+	Invoices []Nip47MultiPayInvoiceElement `json:"invoices"`
+}
+
+type Nip47MultiPayInvoiceElement struct {
+	Nip47PayParams
+	Id string `json:"id"`
+}
+
+type Nip47MultiPayKeysendParams struct {
+	Keysends []Nip47MultiPayKeysendElement `json:"keysends"`
+}
+
+type Nip47MultiPayKeysendElement struct {
+	Nip47KeysendParams
+	Id string `json:"id"`
+}
+
+type TLVRecord struct {
+	Type  uint64 `json:"type"`
+	Value string `json:"value"`
+}
+
+type Nip47BalanceResponse struct {
+	Balance int64 `json:"balance"`
+}
+
+type Nip47MakeInvoiceParams struct {
+	Amount          int64  `json:"amount"`
+	Description     string `json:"description"`
+	DescriptionHash string `json:"description_hash"`
+	Expiry          int64  `json:"expiry"`
+}
+
+type Nip47Transaction struct {
+	Type            string      `json:"type"`
+	State           string      `json:"state,omitempty"`
+	Invoice         string      `json:"invoice"`
+	Description     string      `json:"description"`
+	DescriptionHash string      `json:"description_hash"`
+	Preimage        string      `json:"preimage"`
+	PaymentHash     string      `json:"payment_hash"`
+	Amount          int64       `json:"amount"`
+	FeesPaid        int64       `json:"fees_paid"`
+	CreatedAt       int64       `json:"created_at"`
+	ExpiresAt       int64       `json:"expires_at,omitempty"`
+	SettledAt       int64       `json:"settled_at,omitempty"`
+	Metadata        interface{} `json:"metadata,omitempty"`
+}
+
+type Nip47LookupInvoiceParams struct {
+	Invoice     string `json:"invoice"`
+	PaymentHash string `json:"payment_hash"`
+}
+
+type Nip47ListTransactionsParams struct {
+	From   uint64 `json:"from"`
+	Until  uint64 `json:"until"`
+	Limit  uint64 `json:"limit"`
+	Offset uint64 `json:"offset"`
+	Unpaid bool   `json:"unpaid"`
+	Type   string `json:"type"`
+}
+
+type Nip47ListTransactionsResponse struct {
+	Transactions []Nip47Transaction `json:"transactions"`
+}
+
+type NodeInfo struct {
+	Alias       string
+	Color       string
+	Pubkey      string
+	Network     string
+	BlockHeight uint32
+	BlockHash   string
+}
+
+type Nip47GetInfoResponse struct {
+	Alias         string   `json:"alias"`
+	Color         string   `json:"color"`
+	Pubkey        string   `json:"pubkey"`
+	Network       string   `json:"network"`
+	BlockHeight   uint32   `json:"block_height"`
+	BlockHash     string   `json:"block_hash"`
+	Methods       []string `json:"methods"`
+	Notifications []string `json:"notifications,omitempty"`
+}
+
+type Nip47Notification struct {
+	NotificationType string      `json:"notification_type"`
+	Notification     interface{} `json:"notification"`
+}
+
+// PaymentNotification is emitted by the LN backends when a payment is received or sent
+type PaymentNotification struct {
+	// the wallet owner, 0 if all apps share the same wallet (e.g. LND)
+	UserId      uint
+	Type        string
+	Transaction Nip47Transaction
+}
@@ -0,0 +1,171 @@
+// Package nip44 implements version 2 of the NIP-44 encrypted payloads.
+// go-nostr v0.13 only ships NIP-04, so this follows https://github.com/nostr-protocol/nips/blob/master/44.md
+package nip44
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	version          = 2
+	minPlaintextSize = 1
+	maxPlaintextSize = 65535
+)
+
+var (
+	ErrInvalidPayload   = errors.New("invalid payload")
+	ErrUnknownVersion   = errors.New("unknown encryption version")
+	ErrInvalidMac       = errors.New("invalid MAC")
+	ErrInvalidPadding   = errors.New("invalid padding")
+	ErrInvalidPlaintext = errors.New("plaintext has to be between 1 and 65535 bytes")
+)
+
+// GenerateConversationKey derives the conversation key from the ECDH shared x coordinate,
+// as returned by nip04.ComputeSharedSecret.
+func GenerateConversationKey(sharedX []byte) []byte {
+	return hkdf.Extract(sha256.New, sharedX, []byte("nip44-v2"))
+}
+
+// Encrypt encrypts the plaintext with a random nonce and returns the base64 payload.
+func Encrypt(plaintext string, conversationKey []byte) (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return encryptWithNonce(plaintext, conversationKey, nonce)
+}
+
+// Decrypt verifies and decrypts a base64 payload.
+func Decrypt(payload string, conversationKey []byte) (string, error) {
+	if len(payload) == 0 || payload[0] == '#' {
+		return "", ErrUnknownVersion
+	}
+	if len(payload) < 132 || len(payload) > 87472 {
+		return "", ErrInvalidPayload
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrInvalidPayload
+	}
+	if len(data) < 99 || len(data) > 65603 {
+		return "", ErrInvalidPayload
+	}
+	if data[0] != version {
+		return "", ErrUnknownVersion
+	}
+	nonce := data[1:33]
+	ciphertext := data[33 : len(data)-32]
+	mac := data[len(data)-32:]
+
+	chachaKey, chachaNonce, hmacKey, err := messageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(mac, hmacAad(hmacKey, nonce, ciphertext)) {
+		return "", ErrInvalidMac
+	}
+
+	padded, err := chacha(chachaKey, chachaNonce, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return unpad(padded)
+}
+
+func encryptWithNonce(plaintext string, conversationKey []byte, nonce []byte) (string, error) {
+	chachaKey, chachaNonce, hmacKey, err := messageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+	padded, err := pad(plaintext)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := chacha(chachaKey, chachaNonce, padded)
+	if err != nil {
+		return "", err
+	}
+	mac := hmacAad(hmacKey, nonce, ciphertext)
+
+	data := make([]byte, 0, 1+len(nonce)+len(ciphertext)+len(mac))
+	data = append(data, version)
+	data = append(data, nonce...)
+	data = append(data, ciphertext...)
+	data = append(data, mac...)
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func messageKeys(conversationKey []byte, nonce []byte) (chachaKey []byte, chachaNonce []byte, hmacKey []byte, err error) {
+	if len(conversationKey) != 32 {
+		return nil, nil, nil, errors.New("invalid conversation key length")
+	}
+	if len(nonce) != 32 {
+		return nil, nil, nil, errors.New("invalid nonce length")
+	}
+	keys := make([]byte, 76)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, conversationKey, nonce), keys); err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[0:32], keys[32:44], keys[44:76], nil
+}
+
+func chacha(key []byte, nonce []byte, input []byte) ([]byte, error) {
+	cipher, err := chacha20.NewUnauthenticatedCipher(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]byte, len(input))
+	cipher.XORKeyStream(output, input)
+	return output, nil
+}
+
+func hmacAad(key []byte, aad []byte, message []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(aad)
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+func calcPaddedLen(unpaddedLen int) int {
+	if unpaddedLen <= 32 {
+		return 32
+	}
+	nextPower := 1 << (int(math.Floor(math.Log2(float64(unpaddedLen-1)))) + 1)
+	chunk := 32
+	if nextPower > 256 {
+		chunk = nextPower / 8
+	}
+	return chunk * ((unpaddedLen-1)/chunk + 1)
+}
+
+func pad(plaintext string) ([]byte, error) {
+	unpaddedLen := len(plaintext)
+	if unpaddedLen < minPlaintextSize || unpaddedLen > maxPlaintextSize {
+		return nil, ErrInvalidPlaintext
+	}
+	padded := make([]byte, 2+calcPaddedLen(unpaddedLen))
+	binary.BigEndian.PutUint16(padded, uint16(unpaddedLen))
+	copy(padded[2:], plaintext)
+	return padded, nil
+}
+
+func unpad(padded []byte) (string, error) {
+	if len(padded) < 2 {
+		return "", ErrInvalidPadding
+	}
+	unpaddedLen := int(binary.BigEndian.Uint16(padded[0:2]))
+	if unpaddedLen < minPlaintextSize || len(padded) != 2+calcPaddedLen(unpaddedLen) {
+		return "", ErrInvalidPadding
+	}
+	return string(padded[2 : 2+unpaddedLen]), nil
+}
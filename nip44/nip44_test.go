@@ -0,0 +1,65 @@
+package nip44
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/stretchr/testify/assert"
+)
+
+// vectors from https://github.com/paulmillr/nip44/blob/main/nip44.vectors.json
+func TestConversationKey(t *testing.T) {
+	sharedX, err := nip04.ComputeSharedSecret("c2f9d9948dc8c7c38321e4b85c8558872eafa0641cd269db76848a6073e69133", "315e59ff51cb9209768cf7da80791ddcaae56ac9775eb25b6dee1234bc5d2268")
+	assert.NoError(t, err)
+	assert.Equal(t, "3dfef0ce2a4d80a25e7a328accf73448ef67096f65f79588e358d9a0eb9013f1", hex.EncodeToString(GenerateConversationKey(sharedX)))
+}
+
+func TestEncryptWithNonce(t *testing.T) {
+	pub2, err := nostr.GetPublicKey("0000000000000000000000000000000000000000000000000000000000000002")
+	assert.NoError(t, err)
+	sharedX, err := nip04.ComputeSharedSecret(pub2, "0000000000000000000000000000000000000000000000000000000000000001")
+	assert.NoError(t, err)
+	conversationKey := GenerateConversationKey(sharedX)
+	assert.Equal(t, "c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d", hex.EncodeToString(conversationKey))
+
+	nonce, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000001")
+	payload, err := encryptWithNonce("a", conversationKey, nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, "AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAABee0G5VSK0/9YypIObAtDKfYEAjD35uVkHyB0F4DwrcNaCXlCWZKaArsGrY6M9wnuTMxWfp1RTN9Xga8no+kF5Vsb", payload)
+
+	plaintext, err := Decrypt(payload, conversationKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", plaintext)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	conversationKey := GenerateConversationKey([]byte("0123456789abcdef0123456789abcdef"))
+	for _, plaintext := range []string{"hello", strings.Repeat("x", 33), strings.Repeat("🙂", 1000)} {
+		payload, err := Encrypt(plaintext, conversationKey)
+		assert.NoError(t, err)
+		decrypted, err := Decrypt(payload, conversationKey)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	}
+
+	payload, err := Encrypt("hello", conversationKey)
+	assert.NoError(t, err)
+	tampered := []byte(payload)
+	tampered[50] ^= 1
+	_, err = Decrypt(string(tampered), conversationKey)
+	assert.Error(t, err)
+
+	_, err = Encrypt("", conversationKey)
+	assert.ErrorIs(t, err, ErrInvalidPlaintext)
+	_, err = Decrypt("#"+payload, conversationKey)
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+}
+
+func TestCalcPaddedLen(t *testing.T) {
+	for unpadded, padded := range map[int]int{1: 32, 32: 32, 33: 64, 37: 64, 45: 64, 49: 64, 64: 64, 65: 96, 100: 128, 111: 128, 200: 224, 250: 256, 320: 320, 383: 384, 384: 384, 400: 448, 500: 512, 512: 512, 515: 640, 700: 768, 800: 896, 900: 1024, 1020: 1024, 65536: 65536} {
+		assert.Equal(t, padded, calcPaddedLen(unpadded), "unpadded length %d", unpadded)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// a poll fetches at most this many transactions per wallet, older payments are not notified
+	notificationsPollMaxPageSize = 50
+	notificationsPollMaxPages    = 10
+)
+
+// PublishNotifications publishes the payment notifications of the LN backend until ctx is canceled.
+func (svc *Service) PublishNotifications(ctx context.Context, pool *RelayPool, notifications <-chan PaymentNotification) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification, ok := <-notifications:
+			if !ok {
+				return
+			}
+			events, err := svc.createNotificationEvents(notification)
+			if err != nil {
+				svc.Logger.WithFields(logrus.Fields{
+					"notificationType": notification.Type,
+					"paymentHash":      notification.Transaction.PaymentHash,
+				}).Errorf("Failed to create notification events: %v", err)
+				continue
+			}
+			for _, notificationEvent := range events {
+				event := notificationEvent.event
+				outboxEvent, err := svc.createOutboxEvent(notificationEvent.app.ID, 0, event, svc.getRelays(&notificationEvent.app))
+				if err != nil {
+					svc.Logger.WithFields(logrus.Fields{
+						"notificationType": notification.Type,
+						"paymentHash":      notification.Transaction.PaymentHash,
+						"eventId":          event.ID,
+					}).Errorf("Failed to store notification event in the outbox: %v", err)
+					continue
+				}
+				status := svc.publishOutboxEvent(ctx, pool, outboxEvent)
+				svc.Logger.WithFields(logrus.Fields{
+					"notificationType": notification.Type,
+					"paymentHash":      notification.Transaction.PaymentHash,
+					"eventId":          event.ID,
+					"status":           status,
+					"relayStatuses":    outboxEvent.RelayStatuses,
+				}).Info("Published notification event")
+			}
+		}
+	}
+}
+
+type notificationEvent struct {
+	app   App
+	event *nostr.Event
+}
+
+// createNotificationEvents creates a notification event for every app of the wallet that has the notifications permission
+func (svc *Service) createNotificationEvents(notification PaymentNotification) (events []notificationEvent, err error) {
+	appPermissions := []AppPermission{}
+	err = svc.db.Preload("App").Where("request_method = ?", NIP_47_NOTIFICATIONS_PERMISSION).Find(&appPermissions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.Marshal(Nip47Notification{
+		NotificationType: notification.Type,
+		Notification:     notification.Transaction,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, appPermission := range appPermissions {
+		app := appPermission.App
+		if notification.UserId != 0 && app.UserId != notification.UserId {
+			continue
+		}
+		if !appPermission.ExpiresAt.IsZero() && appPermission.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+
+		ss, err := nip04.ComputeSharedSecret(app.NostrPubkey, svc.cfg.NostrSecretKey)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"appId": app.ID,
+			}).Errorf("Failed to compute shared secret: %v", err)
+			continue
+		}
+		// there is no request to mirror, so use NIP-04 unless the app only accepts NIP-44
+		encryption := NIP_47_ENCRYPTION_NIP04
+		if app.Nip44Only {
+			encryption = NIP_47_ENCRYPTION_NIP44_V2
+		}
+		msg, err := encryptContent(encryption, string(content), ss)
+		if err != nil {
+			return nil, err
+		}
+		event := &nostr.Event{
+			PubKey:    svc.cfg.IdentityPubkey,
+			CreatedAt: time.Now(),
+			Kind:      NIP_47_NOTIFICATION_KIND,
+			Tags:      nostr.Tags{[]string{"p", app.NostrPubkey}},
+			Content:   msg,
+		}
+		err = event.Sign(svc.cfg.NostrSecretKey)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, notificationEvent{app: app, event: event})
+	}
+	return events, nil
+}
+
+// pollUserPayments notifies the settled transactions of every wallet with an app that wants to be notified,
+// for backends with a wallet per user which cannot push payment updates.
+func pollUserPayments(ctx context.Context, db *gorm.DB, logger *logrus.Logger, lnClient LNClient, interval time.Duration, pageSize uint64, notifications chan<- PaymentNotification) {
+	// per user, the settle time of the latest payment we know about
+	lastSettledAt := make(map[uint]int64)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// only poll wallets which have an app that wants to be notified
+		appPermissions := []AppPermission{}
+		db.Preload("App").Where("request_method = ?", NIP_47_NOTIFICATIONS_PERMISSION).Find(&appPermissions)
+		polledUsers := make(map[uint]bool)
+		for _, appPermission := range appPermissions {
+			userId := appPermission.App.UserId
+			if polledUsers[userId] || (!appPermission.ExpiresAt.IsZero() && appPermission.ExpiresAt.Before(time.Now())) {
+				continue
+			}
+			polledUsers[userId] = true
+
+			since, known := lastSettledAt[userId]
+			if !known {
+				// payments before the wallet was first polled are not notified
+				lastSettledAt[userId] = time.Now().Unix()
+				continue
+			}
+
+			transactions, err := listTransactionsSince(ctx, lnClient, appPermission.App.NostrPubkey, since, pageSize)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"appId":  appPermission.App.ID,
+					"userId": userId,
+				}).Errorf("Failed to poll payments: %v", err)
+				continue
+			}
+
+			// transactions are sorted newest first, notify in chronological order
+			for i := len(transactions) - 1; i >= 0; i-- {
+				transaction := transactions[i]
+				settledAt := transaction.SettledAt
+				if settledAt == 0 {
+					settledAt = transaction.CreatedAt
+				}
+				if transaction.State != NIP_47_TRANSACTION_STATE_SETTLED || settledAt <= since {
+					continue
+				}
+				if settledAt > lastSettledAt[userId] {
+					lastSettledAt[userId] = settledAt
+				}
+				notificationType := NIP_47_PAYMENT_RECEIVED_NOTIFICATION
+				if transaction.Type == "outgoing" {
+					notificationType = NIP_47_PAYMENT_SENT_NOTIFICATION
+				}
+				select {
+				case notifications <- PaymentNotification{
+					UserId:      userId,
+					Type:        notificationType,
+					Transaction: transaction,
+				}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// listTransactionsSince returns the settled transactions of the wallet, newest first, in pages of pageSize
+// until it reaches a transaction which settled before since, so no payment is missed between two polls.
+// At most notificationsPollMaxPages pages are fetched.
+func listTransactionsSince(ctx context.Context, lnClient LNClient, senderPubkey string, since int64, pageSize uint64) (transactions []Nip47Transaction, err error) {
+	if pageSize == 0 || pageSize > notificationsPollMaxPageSize {
+		pageSize = notificationsPollMaxPageSize
+	}
+	for i := uint64(0); i < notificationsPollMaxPages; i++ {
+		page, err := lnClient.ListTransactions(ctx, senderPubkey, 0, 0, pageSize, i*pageSize, false, "")
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, page...)
+		if uint64(len(page)) < pageSize {
+			return transactions, nil
+		}
+		for _, transaction := range page {
+			settledAt := transaction.SettledAt
+			if settledAt == 0 {
+				settledAt = transaction.CreatedAt
+			}
+			if settledAt <= since {
+				return transactions, nil
+			}
+		}
+	}
+	return transactions, nil
+}
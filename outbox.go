@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	outboxPollInterval = 5 * time.Second
+	outboxBatchSize    = 50
+	// retries back off exponentially between these delays
+	outboxRetryMinDelay = 10 * time.Second
+	outboxRetryMaxDelay = 10 * time.Minute
+	// events which could not be published for this long are given up
+	outboxEventMaxAge = 24 * time.Hour
+	// published and failed events are kept this long for the delivery stats of the apps
+	outboxEventRetention = 7 * 24 * time.Hour
+	outboxPruneInterval  = time.Hour
+)
+
+// createOutboxEvent persists a signed event before it is published, so it is not lost if no relay accepts it
+func (svc *Service) createOutboxEvent(appId uint, nostrEventId uint, event *nostr.Event, relays []string) (*OutboxEvent, error) {
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	outboxEvent := &OutboxEvent{
+		AppId:        appId,
+		NostrEventId: nostrEventId,
+		EventId:      event.ID,
+		Event:        string(eventJson),
+		Relays:       relays,
+		State:        "pending",
+		// the worker must not pick up the event while its first publish is in flight
+		NextRetryAt: time.Now().Add(outboxRetryDelay(0)),
+	}
+	err = svc.db.Create(outboxEvent).Error
+	if err != nil {
+		return nil, err
+	}
+	return outboxEvent, nil
+}
+
+// publishOutboxEvent publishes the event to its relays and schedules the next retry if no relay acknowledged it
+func (svc *Service) publishOutboxEvent(ctx context.Context, pool *RelayPool, outboxEvent *OutboxEvent) nostr.Status {
+	event := nostr.Event{}
+	err := json.Unmarshal([]byte(outboxEvent.Event), &event)
+	if err != nil {
+		svc.Logger.WithError(err).Errorf("Failed to decode outbox event %d", outboxEvent.ID)
+		outboxEvent.State = "failed"
+		svc.db.Save(outboxEvent)
+		return nostr.PublishStatusFailed
+	}
+
+	statuses := pool.Publish(ctx, event, outboxEvent.Relays)
+	outboxEvent.RelayStatuses = make(map[string]string, len(statuses))
+	status := nostr.PublishStatusFailed
+	for relayUrl, relayStatus := range statuses {
+		outboxEvent.RelayStatuses[relayUrl] = relayStatus.String()
+		// the event is delivered as soon as one relay accepted it
+		if relayStatus > status {
+			status = relayStatus
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case status == nostr.PublishStatusSucceeded:
+		outboxEvent.State = "published"
+		outboxEvent.PublishedAt = now
+	case now.Sub(outboxEvent.CreatedAt) > outboxEventMaxAge:
+		outboxEvent.State = "failed"
+		svc.Logger.WithFields(logrus.Fields{
+			"outboxEventId": outboxEvent.ID,
+			"eventId":       outboxEvent.EventId,
+			"retries":       outboxEvent.Retries,
+			"appId":         outboxEvent.AppId,
+		}).Error("Giving up publishing event")
+	default:
+		outboxEvent.NextRetryAt = now.Add(outboxRetryDelay(outboxEvent.Retries))
+	}
+	err = svc.db.Save(outboxEvent).Error
+	if err != nil {
+		svc.Logger.WithError(err).Errorf("Failed to update outbox event %d", outboxEvent.ID)
+	}
+	return status
+}
+
+// StartOutbox retries the events no relay acknowledged yet until ctx is canceled.
+// Events are retried right away when one of their relays reconnects.
+func (svc *Service) StartOutbox(ctx context.Context, pool *RelayPool) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(outboxPruneInterval)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			svc.retryOutboxEvents(ctx, pool, "")
+		case relayUrl := <-pool.Connected:
+			svc.retryOutboxEvents(ctx, pool, relayUrl)
+		case <-pruneTicker.C:
+			svc.pruneOutboxEvents(time.Now().Add(-outboxEventRetention))
+		}
+	}
+}
+
+// pruneOutboxEvents deletes the published and failed events created before the given time
+func (svc *Service) pruneOutboxEvents(before time.Time) {
+	result := svc.db.Where("state IN ? AND created_at < ?", []string{"published", "failed"}, before).Delete(&OutboxEvent{})
+	if result.Error != nil {
+		svc.Logger.WithError(result.Error).Error("Failed to prune outbox events")
+		return
+	}
+	if result.RowsAffected > 0 {
+		svc.Logger.WithField("count", result.RowsAffected).Info("Pruned outbox events")
+	}
+}
+
+// retryOutboxEvents publishes the pending events which are due, or all pending events of relayUrl if it is set
+func (svc *Service) retryOutboxEvents(ctx context.Context, pool *RelayPool, relayUrl string) {
+	query := svc.db.Where("state = ?", "pending")
+	if relayUrl == "" {
+		query = query.Where("next_retry_at <= ?", time.Now())
+	}
+	outboxEvents := []OutboxEvent{}
+	err := query.Order("id").Limit(outboxBatchSize).Find(&outboxEvents).Error
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to load outbox events")
+		return
+	}
+	for i := range outboxEvents {
+		outboxEvent := &outboxEvents[i]
+		if relayUrl != "" && !containsString(outboxEvent.Relays, relayUrl) {
+			continue
+		}
+		outboxEvent.Retries++
+		status := svc.publishOutboxEvent(ctx, pool, outboxEvent)
+		svc.Logger.WithFields(logrus.Fields{
+			"outboxEventId": outboxEvent.ID,
+			"eventId":       outboxEvent.EventId,
+			"status":        status,
+			"relayStatuses": outboxEvent.RelayStatuses,
+			"retries":       outboxEvent.Retries,
+			"appId":         outboxEvent.AppId,
+		}).Info("Retried publishing event")
+		if outboxEvent.NostrEventId != 0 {
+			svc.updateReplyState(outboxEvent, status)
+		}
+	}
+}
+
+// outboxRetryDelay doubles the delay with every retry
+func outboxRetryDelay(retries int) time.Duration {
+	if retries >= 32 {
+		return outboxRetryMaxDelay
+	}
+	delay := outboxRetryMinDelay << retries
+	if delay <= 0 || delay > outboxRetryMaxDelay {
+		return outboxRetryMaxDelay
+	}
+	return delay
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	paymentReconcileInterval = time.Minute
+	// lookups which keep failing are retried less often, up to this delay
+	paymentReconcileMaxRetryDelay = 24 * time.Hour
+)
+
+// paymentReconcileRetry is the next lookup of a payment whose lookup failed
+type paymentReconcileRetry struct {
+	attempts int
+	retryAt  time.Time
+}
+
+// migratePaymentStates sets the state of the payments created before payments had a state.
+// Payments without a preimage never counted towards the budget, so they are marked as failed
+// instead of being looked up in the LN backend.
+func migratePaymentStates(db *gorm.DB) error {
+	err := db.Model(&Payment{}).Where("(state IS NULL OR state = '') AND preimage <> ''").Update("state", "succeeded").Error
+	if err != nil {
+		return err
+	}
+	return db.Model(&Payment{}).Where("state IS NULL OR state = ''").Update("state", "failed").Error
+}
+
+// migratePaymentHashes stores the payment hash of the payments created before payments had one,
+// so payments can be found by their payment hash without decoding every payment request.
+func migratePaymentHashes(db *gorm.DB) error {
+	payments := []Payment{}
+	return db.Where("(payment_hash IS NULL OR payment_hash = '') AND payment_request <> ''").FindInBatches(&payments, 100, func(tx *gorm.DB, batch int) error {
+		for _, payment := range payments {
+			paymentRequest, err := decodepay.Decodepay(payment.PaymentRequest)
+			if err != nil {
+				continue
+			}
+			err = db.Model(&Payment{}).Where("id = ?", payment.ID).Update("payment_hash", paymentRequest.PaymentHash).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+// StartPaymentReconciler resolves the pending payments at startup and then periodically until ctx is canceled.
+// Payments stay pending if the process stopped while they were sent or the LN backend did not report their outcome.
+func (svc *Service) StartPaymentReconciler(ctx context.Context) {
+	ticker := time.NewTicker(paymentReconcileInterval)
+	defer ticker.Stop()
+	for {
+		svc.reconcilePayments(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (svc *Service) reconcilePayments(ctx context.Context) {
+	payments := []Payment{}
+	err := svc.db.Preload("App").Where("state = ?", "pending").Order("id").Find(&payments).Error
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to load pending payments")
+		return
+	}
+	pending := make(map[uint]bool, len(payments))
+	for _, payment := range payments {
+		pending[payment.ID] = true
+	}
+	// forget the failed lookups of payments which were resolved in the meantime
+	svc.reconcileRetries.Range(func(key, value interface{}) bool {
+		if !pending[key.(uint)] {
+			svc.reconcileRetries.Delete(key)
+		}
+		return true
+	})
+	for i := range payments {
+		payment := &payments[i]
+		// the outcome of these is stored once the LN backend returns
+		if _, ok := svc.inFlightPayments.Load(payment.ID); ok {
+			continue
+		}
+		retry := paymentReconcileRetry{}
+		if value, ok := svc.reconcileRetries.Load(payment.ID); ok {
+			retry = value.(paymentReconcileRetry)
+			if time.Now().Before(retry.retryAt) {
+				continue
+			}
+		}
+		err = svc.reconcilePayment(ctx, payment)
+		if err != nil {
+			retry.attempts++
+			retry.retryAt = time.Now().Add(paymentReconcileRetryDelay(retry.attempts))
+			svc.reconcileRetries.Store(payment.ID, retry)
+			svc.Logger.WithFields(logrus.Fields{
+				"paymentId":   payment.ID,
+				"paymentHash": payment.PaymentHash,
+				"appId":       payment.AppId,
+				"attempts":    retry.attempts,
+				"retryAt":     retry.retryAt,
+			}).WithError(err).Error("Failed to reconcile payment")
+			continue
+		}
+		svc.reconcileRetries.Delete(payment.ID)
+	}
+}
+
+// paymentReconcileRetryDelay doubles the delay with every failed lookup
+func paymentReconcileRetryDelay(attempts int) time.Duration {
+	if attempts >= 32 {
+		return paymentReconcileMaxRetryDelay
+	}
+	delay := paymentReconcileInterval << attempts
+	if delay <= 0 || delay > paymentReconcileMaxRetryDelay {
+		return paymentReconcileMaxRetryDelay
+	}
+	return delay
+}
+
+// reconcilePayment looks up the payment in the LN backend and stores its state.
+// The payment stays pending if the backend did not finish it yet.
+// Payments without a payment hash cannot be looked up and are marked as failed,
+// these are keysend payments which failed before the backend returned the preimage it chose.
+func (svc *Service) reconcilePayment(ctx context.Context, payment *Payment) error {
+	state := ""
+	preimage := ""
+	var transaction *Nip47Transaction
+	err := ErrTransactionNotFound
+	if payment.PaymentHash != "" {
+		transaction, err = svc.lnClient.LookupInvoice(ctx, payment.App.NostrPubkey, payment.PaymentHash)
+	}
+	switch {
+	case errors.Is(err, ErrTransactionNotFound):
+		// the backend never received the payment, so no money left
+		state = "failed"
+	case err != nil:
+		return err
+	case transaction.State == NIP_47_TRANSACTION_STATE_SETTLED:
+		state = "succeeded"
+		preimage = transaction.Preimage
+	case transaction.State == NIP_47_TRANSACTION_STATE_FAILED || transaction.State == NIP_47_TRANSACTION_STATE_EXPIRED:
+		state = "failed"
+	default:
+		return nil
+	}
+
+	payment.State = state
+	if preimage != "" {
+		payment.Preimage = preimage
+	}
+	err = svc.db.Save(payment).Error
+	if err != nil {
+		return err
+	}
+	svc.Logger.WithFields(logrus.Fields{
+		"paymentId":   payment.ID,
+		"paymentHash": payment.PaymentHash,
+		"appId":       payment.AppId,
+		"state":       payment.State,
+	}).Info("Reconciled payment")
+	return nil
+}
+
+// completePayment stores the outcome of a payment the LN backend returned.
+// An error does not necessarily mean that the payment failed, e.g. if the request to the backend timed out,
+// so the payment is looked up before it is marked as failed and stays pending if its outcome is unknown.
+func (svc *Service) completePayment(ctx context.Context, payment *Payment, preimage string, paymentErr error) (string, error) {
+	if paymentErr == nil {
+		payment.State = "succeeded"
+		payment.Preimage = preimage
+		svc.db.Save(payment)
+		return preimage, nil
+	}
+
+	err := svc.reconcilePayment(ctx, payment)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"paymentId":   payment.ID,
+			"paymentHash": payment.PaymentHash,
+			"appId":       payment.AppId,
+		}).WithError(err).Error("Failed to look up failed payment, it is reconciled later")
+		return "", paymentErr
+	}
+	if payment.State == "succeeded" {
+		return payment.Preimage, nil
+	}
+	return "", paymentErr
+}
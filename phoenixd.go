@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// phoenixd returns 20 payments if no limit is given
+	phoenixdListMaxSize      = 1000
+	phoenixdResubscribeDelay = 10 * time.Second
+)
+
+// PhoenixdService uses the HTTP API of phoenixd. All apps share its wallet.
+type PhoenixdService struct {
+	address       string
+	authorization string
+	httpClient    *http.Client
+	db            *gorm.DB
+	Logger        *logrus.Logger
+}
+
+type phoenixdError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *phoenixdError) Error() string {
+	return fmt.Sprintf("phoenixd request failed: %s", err.Message)
+}
+
+type phoenixdIncomingPayment struct {
+	PaymentHash string `json:"paymentHash"`
+	Preimage    string `json:"preimage"`
+	Description string `json:"description"`
+	Invoice     string `json:"invoice"`
+	IsPaid      bool   `json:"isPaid"`
+	ReceivedSat int64  `json:"receivedSat"`
+	// msat
+	Fees int64 `json:"fees"`
+	// unix milliseconds
+	CompletedAt int64 `json:"completedAt"`
+	CreatedAt   int64 `json:"createdAt"`
+}
+
+type phoenixdOutgoingPayment struct {
+	PaymentId   string `json:"paymentId"`
+	PaymentHash string `json:"paymentHash"`
+	Preimage    string `json:"preimage"`
+	Invoice     string `json:"invoice"`
+	IsPaid      bool   `json:"isPaid"`
+	// sats including the fees
+	Sent int64 `json:"sent"`
+	// msat
+	Fees int64 `json:"fees"`
+	// unix milliseconds
+	CompletedAt int64 `json:"completedAt"`
+	CreatedAt   int64 `json:"createdAt"`
+}
+
+type phoenixdWebsocketMessage struct {
+	Type        string `json:"type"`
+	PaymentHash string `json:"paymentHash"`
+}
+
+func (svc *PhoenixdService) AuthHandler(c echo.Context) error {
+	user := &User{}
+	err := svc.db.FirstOrInit(user, User{AlbyIdentifier: "phoenixd"}).Error
+	if err != nil {
+		return err
+	}
+
+	sess, _ := session.Get(CookieName, c)
+	sess.Values["user_id"] = user.ID
+	sess.Save(c.Request(), c.Response())
+	return c.Redirect(302, "/")
+}
+
+// call sends a request to phoenixd and decodes the response into result, params are sent form encoded
+func (svc *PhoenixdService) call(ctx context.Context, method, path string, params url.Values, result interface{}) error {
+	var body io.Reader
+	if method == "GET" {
+		if len(params) > 0 {
+			path = path + "?" + params.Encode()
+		}
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, svc.address+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "NWC")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.SetBasicAuth("", svc.authorization)
+
+	resp, err := svc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		// errors are returned as plain text
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if len(message) == 0 {
+			message = []byte(fmt.Sprintf("unexpected status %d", resp.StatusCode))
+		}
+		return &phoenixdError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (svc *PhoenixdService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string) (preimage string, err error) {
+	resp := &struct {
+		PaymentHash     string `json:"paymentHash"`
+		PaymentPreimage string `json:"paymentPreimage"`
+		Reason          string `json:"reason"`
+	}{}
+	err = svc.call(ctx, "POST", "/payinvoice", url.Values{"invoice": {payReq}}, resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.PaymentPreimage == "" {
+		return "", fmt.Errorf("Payment failed: %s", resp.Reason)
+	}
+	return resp.PaymentPreimage, nil
+}
+
+func (svc *PhoenixdService) SupportsKeysend() (keysend bool, customPreimage bool) {
+	return false, false
+}
+
+func (svc *PhoenixdService) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, customRecords []TLVRecord) (respPreimage string, err error) {
+	return "", fmt.Errorf("%w: keysend payments are not supported by phoenixd", ErrNotImplemented)
+}
+
+func (svc *PhoenixdService) GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error) {
+	resp := &struct {
+		BalanceSat int64 `json:"balanceSat"`
+	}{}
+	err = svc.call(ctx, "GET", "/getbalance", nil, resp)
+	if err != nil {
+		return 0, err
+	}
+	return resp.BalanceSat * 1000, nil
+}
+
+func (svc *PhoenixdService) GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error) {
+	resp := &struct {
+		NodeId      string `json:"nodeId"`
+		Chain       string `json:"chain"`
+		BlockHeight uint32 `json:"blockHeight"`
+	}{}
+	err = svc.call(ctx, "GET", "/getinfo", nil, resp)
+	if err != nil {
+		return nil, err
+	}
+	return &NodeInfo{
+		Alias:       "phoenixd",
+		Pubkey:      resp.NodeId,
+		Network:     resp.Chain,
+		BlockHeight: resp.BlockHeight,
+	}, nil
+}
+
+func (svc *PhoenixdService) CreateInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	// amount provided in msat, but phoenixd only supports sats
+	params := url.Values{"amountSat": {strconv.FormatInt(amount/1000, 10)}}
+	if descriptionHash != "" {
+		params.Set("descriptionHash", descriptionHash)
+	} else {
+		params.Set("description", description)
+	}
+	if expiry > 0 {
+		params.Set("expirySeconds", strconv.FormatInt(expiry, 10))
+	}
+	resp := &struct {
+		PaymentHash string `json:"paymentHash"`
+		Serialized  string `json:"serialized"`
+	}{}
+	err = svc.call(ctx, "POST", "/createinvoice", params, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	transaction = &Nip47Transaction{
+		Type:            "incoming",
+		State:           NIP_47_TRANSACTION_STATE_PENDING,
+		Invoice:         resp.Serialized,
+		Description:     description,
+		DescriptionHash: descriptionHash,
+		PaymentHash:     resp.PaymentHash,
+		Amount:          amount,
+		CreatedAt:       time.Now().Unix(),
+	}
+	paymentRequest, err := decodepay.Decodepay(resp.Serialized)
+	if err == nil {
+		transaction.Amount = paymentRequest.MSatoshi
+		transaction.CreatedAt = int64(paymentRequest.CreatedAt)
+		transaction.ExpiresAt = int64(paymentRequest.CreatedAt + paymentRequest.Expiry)
+	}
+	return transaction, nil
+}
+
+func (svc *PhoenixdService) LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error) {
+	incomingPayment := &phoenixdIncomingPayment{}
+	err = svc.call(ctx, "GET", "/payments/incoming/"+url.PathEscape(paymentHash), nil, incomingPayment)
+	if err == nil {
+		return phoenixdIncomingPaymentToTransaction(incomingPayment), nil
+	}
+	var phoenixdErr *phoenixdError
+	if !errors.As(err, &phoenixdErr) || phoenixdErr.StatusCode != http.StatusNotFound {
+		return nil, err
+	}
+
+	// not one of our invoices, check if it is a payment we made
+	outgoingPayment := &phoenixdOutgoingPayment{}
+	err = svc.call(ctx, "GET", "/payments/outgoingbyhash/"+url.PathEscape(paymentHash), nil, outgoingPayment)
+	if errors.As(err, &phoenixdErr) && phoenixdErr.StatusCode == http.StatusNotFound {
+		return nil, ErrTransactionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return phoenixdOutgoingPaymentToTransaction(outgoingPayment), nil
+}
+
+func (svc *PhoenixdService) ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, transactionType string) (transactions []Nip47Transaction, err error) {
+	params := url.Values{}
+	if from != 0 {
+		params.Set("from", strconv.FormatUint(from*1000, 10))
+	}
+	if until != 0 {
+		params.Set("to", strconv.FormatUint(until*1000, 10))
+	}
+	// both lists are merged, so each needs the transactions up to offset + limit
+	listLimit := uint64(phoenixdListMaxSize)
+	if limit > 0 && offset+limit < listLimit {
+		listLimit = offset + limit
+	}
+	params.Set("limit", strconv.FormatUint(listLimit, 10))
+	params.Set("all", strconv.FormatBool(unpaid))
+
+	if transactionType != "outgoing" {
+		incomingPayments := []phoenixdIncomingPayment{}
+		err = svc.call(ctx, "GET", "/payments/incoming", params, &incomingPayments)
+		if err != nil {
+			return nil, err
+		}
+		for i := range incomingPayments {
+			transactions = append(transactions, *phoenixdIncomingPaymentToTransaction(&incomingPayments[i]))
+		}
+	}
+	if transactionType != "incoming" {
+		outgoingPayments := []phoenixdOutgoingPayment{}
+		err = svc.call(ctx, "GET", "/payments/outgoing", params, &outgoingPayments)
+		if err != nil {
+			return nil, err
+		}
+		for i := range outgoingPayments {
+			transactions = append(transactions, *phoenixdOutgoingPaymentToTransaction(&outgoingPayments[i]))
+		}
+	}
+	return filterTransactions(transactions, from, until, limit, offset, unpaid, transactionType), nil
+}
+
+// SubscribePayments notifies received payments, phoenixd does not publish sent payments
+func (svc *PhoenixdService) SubscribePayments(ctx context.Context) (notifications <-chan PaymentNotification, err error) {
+	notificationsChan := make(chan PaymentNotification)
+	go svc.subscribeWebsocket(ctx, notificationsChan)
+	return notificationsChan, nil
+}
+
+func (svc *PhoenixdService) subscribeWebsocket(ctx context.Context, notifications chan<- PaymentNotification) {
+	websocketUrl := "ws" + strings.TrimPrefix(svc.address, "http") + "/websocket"
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(":"+svc.authorization)))
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, websocketUrl, header)
+		if err == nil {
+			err = svc.readWebsocket(ctx, conn, notifications)
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		svc.Logger.WithError(err).Error("phoenixd websocket failed")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(phoenixdResubscribeDelay):
+		}
+	}
+}
+
+func (svc *PhoenixdService) readWebsocket(ctx context.Context, conn *websocket.Conn, notifications chan<- PaymentNotification) error {
+	// unblock ReadJSON when ctx is canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		message := &phoenixdWebsocketMessage{}
+		err := conn.ReadJSON(message)
+		if err != nil {
+			return err
+		}
+		if message.Type != "payment_received" {
+			continue
+		}
+		// the message only contains the amount, the full payment is looked up
+		transaction, err := svc.LookupInvoice(ctx, "", message.PaymentHash)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"paymentHash": message.PaymentHash,
+			}).WithError(err).Error("Failed to look up received payment")
+			continue
+		}
+		select {
+		case notifications <- PaymentNotification{
+			Type:        NIP_47_PAYMENT_RECEIVED_NOTIFICATION,
+			Transaction: *transaction,
+		}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func phoenixdIncomingPaymentToTransaction(payment *phoenixdIncomingPayment) *Nip47Transaction {
+	var descriptionHash string
+	var amount, expiresAt int64
+	if payment.Invoice != "" {
+		paymentRequest, err := decodepay.Decodepay(payment.Invoice)
+		if err == nil {
+			descriptionHash = paymentRequest.DescriptionHash
+			amount = paymentRequest.MSatoshi
+			expiresAt = int64(paymentRequest.CreatedAt + paymentRequest.Expiry)
+		}
+	}
+
+	state := NIP_47_TRANSACTION_STATE_PENDING
+	var preimage string
+	var settledAt int64
+	switch {
+	case payment.IsPaid:
+		state = NIP_47_TRANSACTION_STATE_SETTLED
+		preimage = payment.Preimage
+		amount = payment.ReceivedSat * 1000
+		settledAt = payment.CompletedAt / 1000
+	case expiresAt != 0 && expiresAt < time.Now().Unix():
+		state = NIP_47_TRANSACTION_STATE_EXPIRED
+	}
+
+	return &Nip47Transaction{
+		Type:            "incoming",
+		State:           state,
+		Invoice:         payment.Invoice,
+		Description:     payment.Description,
+		DescriptionHash: descriptionHash,
+		Preimage:        preimage,
+		PaymentHash:     payment.PaymentHash,
+		Amount:          amount,
+		FeesPaid:        payment.Fees,
+		CreatedAt:       payment.CreatedAt / 1000,
+		ExpiresAt:       expiresAt,
+		SettledAt:       settledAt,
+	}
+}
+
+func phoenixdOutgoingPaymentToTransaction(payment *phoenixdOutgoingPayment) *Nip47Transaction {
+	var description, descriptionHash string
+	var expiresAt int64
+	if payment.Invoice != "" {
+		paymentRequest, err := decodepay.Decodepay(payment.Invoice)
+		if err == nil {
+			description = paymentRequest.Description
+			descriptionHash = paymentRequest.DescriptionHash
+			expiresAt = int64(paymentRequest.CreatedAt + paymentRequest.Expiry)
+		}
+	}
+
+	state := NIP_47_TRANSACTION_STATE_PENDING
+	var preimage string
+	var settledAt int64
+	switch {
+	case payment.IsPaid:
+		state = NIP_47_TRANSACTION_STATE_SETTLED
+		preimage = payment.Preimage
+		settledAt = payment.CompletedAt / 1000
+	case payment.CompletedAt != 0:
+		// completed without being paid
+		state = NIP_47_TRANSACTION_STATE_FAILED
+	}
+
+	return &Nip47Transaction{
+		Type:            "outgoing",
+		State:           state,
+		Invoice:         payment.Invoice,
+		Description:     description,
+		DescriptionHash: descriptionHash,
+		Preimage:        preimage,
+		PaymentHash:     payment.PaymentHash,
+		Amount:          payment.Sent*1000 - payment.Fees,
+		FeesPaid:        payment.Fees,
+		CreatedAt:       payment.CreatedAt / 1000,
+		ExpiresAt:       expiresAt,
+		SettledAt:       settledAt,
+	}
+}
+
+func NewPhoenixdService(ctx context.Context, svc *Service, e *echo.Echo) (result *PhoenixdService, err error) {
+	phoenixdService := &PhoenixdService{
+		address:       strings.TrimSuffix(svc.cfg.PhoenixdAddress, "/"),
+		authorization: svc.cfg.PhoenixdAuthorization,
+		httpClient:    &http.Client{Timeout: 90 * time.Second},
+		Logger:        svc.Logger,
+		db:            svc.db,
+	}
+	info, err := phoenixdService.GetInfo(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	//add default user to db
+	user := &User{}
+	err = svc.db.FirstOrInit(user, User{AlbyIdentifier: "phoenixd"}).Error
+	if err != nil {
+		return nil, err
+	}
+	err = svc.db.Save(user).Error
+	if err != nil {
+		return nil, err
+	}
+
+	e.GET("/phoenixd/auth", phoenixdService.AuthHandler)
+	svc.Logger.Infof("Connected to phoenixd - node %s", info.Pubkey)
+
+	return phoenixdService, nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// reconnect attempts back off exponentially between these delays
+	relayReconnectMinDelay = 2 * time.Second
+	relayReconnectMaxDelay = 5 * time.Minute
+	// a connection that stayed up this long resets the backoff
+	relayStableConnectionDuration = time.Minute
+	// the consumer of Connected may be busy, don't hold up the subscriptions
+	relayConnectedBuffer = 16
+	// events are delivered by every relay, remember their IDs long enough to drop the duplicates
+	relaySeenEventsTTL = 10 * time.Minute
+)
+
+var ErrRelayAuthDisabled = errors.New("AUTH is not enabled for this relay")
+
+// RelayEvent is an event and the relay it was first received from
+type RelayEvent struct {
+	RelayUrl string
+	Event    *nostr.Event
+}
+
+// RelayHealth is the connection state of a relay
+type RelayHealth struct {
+	Url               string     `json:"url"`
+	Connected         bool       `json:"connected"`
+	ConnectedSince    *time.Time `json:"connected_since,omitempty"`
+	LastError         string     `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time `json:"last_error_at,omitempty"`
+	ReconnectAttempts int        `json:"reconnect_attempts"`
+	NextReconnectAt   *time.Time `json:"next_reconnect_at,omitempty"`
+}
+
+// RelayPool keeps a subscription open on every relay and merges their events.
+type RelayPool struct {
+	// de-duplicated events of all relays
+	Events chan RelayEvent
+	// the URL of a relay that sent all its stored events
+	EndOfStoredEvents chan string
+	// the URL of a relay that (re)connected
+	Connected chan string
+	// answers NIP-42 AUTH challenges, challenges are ignored if it is nil or returns ErrRelayAuthDisabled
+	Authenticate func(ctx context.Context, url string, relay *nostr.Relay, challenge string) error
+	Logger       *logrus.Logger
+
+	ctx         context.Context
+	filters     func(url string) nostr.Filters
+	onConnect   func(ctx context.Context, relay *nostr.Relay)
+	wg          sync.WaitGroup
+	urlsMutex   sync.Mutex
+	urls        map[string]context.CancelFunc
+	relaysMutex sync.RWMutex
+	relays      map[string]*nostr.Relay
+	seenMutex   sync.Mutex
+	seen        map[string]time.Time
+	lastPrune   time.Time
+	healthMutex sync.Mutex
+	health      map[string]*RelayHealth
+}
+
+func NewRelayPool(logger *logrus.Logger) *RelayPool {
+	return &RelayPool{
+		Events:            make(chan RelayEvent),
+		EndOfStoredEvents: make(chan string),
+		Connected:         make(chan string, relayConnectedBuffer),
+		Logger:            logger,
+		urls:              make(map[string]context.CancelFunc),
+		relays:            make(map[string]*nostr.Relay),
+		seen:              make(map[string]time.Time),
+		lastPrune:         time.Now(),
+		health:            make(map[string]*RelayHealth),
+	}
+}
+
+// Start subscribes on every relay added to the pool until ctx is canceled.
+// The filters of a relay and onConnect are evaluated every time it (re)connects.
+func (pool *RelayPool) Start(ctx context.Context, urls []string, filters func(url string) nostr.Filters, onConnect func(ctx context.Context, relay *nostr.Relay)) {
+	pool.ctx = ctx
+	pool.filters = filters
+	pool.onConnect = onConnect
+	pool.AddRelays(urls...)
+}
+
+// AddRelays connects to the relays the pool is not listening on yet
+func (pool *RelayPool) AddRelays(urls ...string) {
+	pool.urlsMutex.Lock()
+	defer pool.urlsMutex.Unlock()
+	for _, url := range urls {
+		if _, ok := pool.urls[url]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(pool.ctx)
+		pool.urls[url] = cancel
+		pool.healthMutex.Lock()
+		pool.health[url] = &RelayHealth{Url: url}
+		pool.healthMutex.Unlock()
+		pool.wg.Add(1)
+		go func(url string) {
+			defer pool.wg.Done()
+			pool.run(ctx, url, pool.filters, pool.onConnect)
+		}(url)
+	}
+}
+
+// RemoveRelays disconnects from the relays and stops reconnecting to them
+func (pool *RelayPool) RemoveRelays(urls ...string) {
+	pool.urlsMutex.Lock()
+	defer pool.urlsMutex.Unlock()
+	for _, url := range urls {
+		cancel, ok := pool.urls[url]
+		if !ok {
+			continue
+		}
+		cancel()
+		delete(pool.urls, url)
+		pool.healthMutex.Lock()
+		delete(pool.health, url)
+		pool.healthMutex.Unlock()
+	}
+}
+
+// Wait blocks until all relay connections are closed
+func (pool *RelayPool) Wait() {
+	pool.wg.Wait()
+}
+
+// Health returns the connection state of every relay in the pool, sorted by URL
+func (pool *RelayPool) Health() []RelayHealth {
+	pool.healthMutex.Lock()
+	defer pool.healthMutex.Unlock()
+	health := make([]RelayHealth, 0, len(pool.health))
+	for _, relayHealth := range pool.health {
+		health = append(health, *relayHealth)
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].Url < health[j].Url
+	})
+	return health
+}
+
+// Publish sends the event to the given relays and returns the status per relay URL.
+// Relays which are currently not connected are reported as failed.
+func (pool *RelayPool) Publish(ctx context.Context, event nostr.Event, urls []string) map[string]nostr.Status {
+	statuses := make(map[string]nostr.Status, len(urls))
+	var statusesMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		pool.relaysMutex.RLock()
+		relay, connected := pool.relays[url]
+		pool.relaysMutex.RUnlock()
+		if !connected {
+			statusesMutex.Lock()
+			statuses[url] = nostr.PublishStatusFailed
+			statusesMutex.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(url string, relay *nostr.Relay) {
+			defer wg.Done()
+			status := relay.Publish(ctx, event)
+			statusesMutex.Lock()
+			statuses[url] = status
+			statusesMutex.Unlock()
+		}(url, relay)
+	}
+	wg.Wait()
+	return statuses
+}
+
+func (pool *RelayPool) run(ctx context.Context, url string, filters func(url string) nostr.Filters, onConnect func(ctx context.Context, relay *nostr.Relay)) {
+	attempts := 0
+	for {
+		connectedAt := time.Now()
+		err := pool.subscribe(ctx, url, filters, onConnect)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(connectedAt) >= relayStableConnectionDuration {
+			attempts = 0
+		}
+		delay := relayReconnectDelay(attempts)
+		attempts++
+		pool.setDisconnected(url, err, attempts, delay)
+		//we just try to reconnect, the other relays keep working in the meantime
+		pool.Logger.WithFields(logrus.Fields{
+			"relay":    url,
+			"attempts": attempts,
+			"delay":    delay,
+		}).WithError(err).Error("Got an error from the relay. Reconnecting...")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// relayReconnectDelay doubles the delay with every failed attempt and adds jitter,
+// so relays are not hammered by all instances at once after an outage
+func relayReconnectDelay(attempts int) time.Duration {
+	delay := relayReconnectMaxDelay
+	if attempts < 32 {
+		delay = relayReconnectMinDelay << attempts
+	}
+	if delay <= 0 || delay > relayReconnectMaxDelay {
+		delay = relayReconnectMaxDelay
+	}
+	// wait between half and the full delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (pool *RelayPool) setConnected(url string) {
+	pool.healthMutex.Lock()
+	defer pool.healthMutex.Unlock()
+	relayHealth, ok := pool.health[url]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	relayHealth.Connected = true
+	relayHealth.ConnectedSince = &now
+	relayHealth.NextReconnectAt = nil
+}
+
+func (pool *RelayPool) setDisconnected(url string, err error, attempts int, delay time.Duration) {
+	pool.healthMutex.Lock()
+	defer pool.healthMutex.Unlock()
+	relayHealth, ok := pool.health[url]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	nextReconnectAt := now.Add(delay)
+	relayHealth.Connected = false
+	relayHealth.ConnectedSince = nil
+	relayHealth.ReconnectAttempts = attempts
+	relayHealth.NextReconnectAt = &nextReconnectAt
+	if err != nil {
+		relayHealth.LastError = err.Error()
+		relayHealth.LastErrorAt = &now
+	}
+}
+
+func (pool *RelayPool) subscribe(ctx context.Context, url string, filters func(url string) nostr.Filters, onConnect func(ctx context.Context, relay *nostr.Relay)) error {
+	pool.Logger.Infof("Connecting to the relay: %s", url)
+	relay, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		return err
+	}
+	pool.relaysMutex.Lock()
+	pool.relays[url] = relay
+	pool.relaysMutex.Unlock()
+	defer func() {
+		pool.relaysMutex.Lock()
+		// the relay may have been removed and added again in the meantime
+		if pool.relays[url] == relay {
+			delete(pool.relays, url)
+		}
+		pool.relaysMutex.Unlock()
+		relay.Close()
+	}()
+
+	pool.setConnected(url)
+
+	if onConnect != nil {
+		onConnect(ctx, relay)
+	}
+	select {
+	case pool.Connected <- url:
+	default:
+	}
+
+	pool.Logger.Infof("Subscribing to events on %s", url)
+	sub := relay.Subscribe(ctx, filters(url))
+	for {
+		select {
+		case notice := <-relay.Notices:
+			pool.Logger.Infof("Received a notice from %s: %s", url, notice)
+		case challenge := <-relay.Challenges:
+			if pool.Authenticate == nil {
+				continue
+			}
+			err := pool.Authenticate(ctx, url, relay, challenge)
+			if errors.Is(err, ErrRelayAuthDisabled) {
+				pool.Logger.Infof("Ignoring AUTH challenge from %s", url)
+				continue
+			}
+			if err != nil {
+				pool.Logger.WithFields(logrus.Fields{
+					"relay": url,
+				}).WithError(err).Error("Failed to authenticate to the relay")
+				continue
+			}
+			pool.Logger.Infof("Authenticated to %s", url)
+			// the relay may have refused the subscription and publishes before the authentication
+			sub.Unsub()
+			if onConnect != nil {
+				onConnect(ctx, relay)
+			}
+			select {
+			case pool.Connected <- url:
+			default:
+			}
+			sub = relay.Subscribe(ctx, filters(url))
+		case conErr := <-relay.ConnectionError:
+			return conErr
+		case <-ctx.Done():
+			return nil
+		case <-sub.EndOfStoredEvents:
+			select {
+			case pool.EndOfStoredEvents <- url:
+			case <-ctx.Done():
+				return nil
+			}
+		case event := <-sub.Events:
+			// a forged copy must not hide the authentic event from other relays
+			if err := verifyEvent(event); err != nil {
+				pool.Logger.WithFields(logrus.Fields{
+					"relay":   url,
+					"eventId": event.ID,
+				}).WithError(err).Warn("Dropping forged event")
+				continue
+			}
+			if !pool.markSeen(event.ID) {
+				continue
+			}
+			select {
+			case pool.Events <- RelayEvent{RelayUrl: url, Event: event}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// markSeen returns false if the event was already received from another relay
+func (pool *RelayPool) markSeen(eventId string) bool {
+	pool.seenMutex.Lock()
+	defer pool.seenMutex.Unlock()
+	now := time.Now()
+	if now.Sub(pool.lastPrune) > relaySeenEventsTTL {
+		for id, seenAt := range pool.seen {
+			if now.Sub(seenAt) > relaySeenEventsTTL {
+				delete(pool.seen, id)
+			}
+		}
+		pool.lastPrune = now
+	}
+	if _, ok := pool.seen[eventId]; ok {
+		return false
+	}
+	pool.seen[eventId] = now
+	return true
+}
@@ -4,29 +4,39 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip04"
-	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/nbd-wtf/go-nostr/nip42"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
+// requests are fetched again from slightly before the relay cursor, see createFilters
+const relayCursorMargin = time.Minute
+
 type Service struct {
-	cfg         *Config
-	db          *gorm.DB
-	lnClient    LNClient
-	ReceivedEOS bool
-	Logger      *logrus.Logger
+	cfg           *Config
+	db            *gorm.DB
+	lnClient      LNClient
+	Logger        *logrus.Logger
+	relayPool     *RelayPool
+	paymentsMutex sync.Mutex
+	// IDs of the payments which are being sent by this process
+	inFlightPayments sync.Map
+	// payment IDs and the paymentReconcileRetry of the payments whose lookup failed
+	reconcileRetries sync.Map
 }
 
 func (svc *Service) GetUser(c echo.Context) (user *User, err error) {
 	sess, _ := session.Get(CookieName, c)
 	userID := sess.Values["user_id"]
-	if svc.cfg.LNBackendType == LNDBackendType {
+	if svc.cfg.SingleUser() {
 		//if we self-host, there is always only one user
 		userID = 1
 	}
@@ -44,78 +54,280 @@ func (svc *Service) GetUser(c echo.Context) (user *User, err error) {
 	return
 }
 
-func (svc *Service) StartSubscription(ctx context.Context, sub *nostr.Subscription) error {
+// getRelays returns the relays an app is reached on
+func (svc *Service) getRelays(app *App) []string {
+	if len(app.Relays) > 0 {
+		return app.Relays
+	}
+	return svc.cfg.Relays
+}
+
+// getRelaysForPubkey returns the relays of the app with the given pubkey, or the default relays for unknown pubkeys
+func (svc *Service) getRelaysForPubkey(pubkey string) []string {
+	app := App{}
+	findAppResult := svc.db.Limit(1).Find(&app, &App{
+		NostrPubkey: pubkey,
+	})
+	if findAppResult.RowsAffected == 0 {
+		return svc.cfg.Relays
+	}
+	return svc.getRelays(&app)
+}
+
+// authenticateRelay answers a NIP-42 AUTH challenge with the identity key, if AUTH is enabled for the relay
+func (svc *Service) authenticateRelay(ctx context.Context, relayUrl string, relay *nostr.Relay, challenge string) error {
+	if !containsString(svc.cfg.AuthRelays, relayUrl) {
+		return ErrRelayAuthDisabled
+	}
+	authEvent, err := svc.createAuthEvent(relay.URL, challenge)
+	if err != nil {
+		return err
+	}
+	status := relay.Auth(ctx, *authEvent)
+	if status != nostr.PublishStatusSucceeded {
+		return fmt.Errorf("AUTH was not accepted by the relay: %s", status)
+	}
+	return nil
+}
+
+func (svc *Service) createAuthEvent(relayUrl string, challenge string) (*nostr.Event, error) {
+	authEvent := nip42.CreateUnsignedAuthEvent(challenge, svc.cfg.IdentityPubkey, relayUrl)
+	err := authEvent.Sign(svc.cfg.NostrSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	return &authEvent, nil
+}
+
+// getAllRelays returns the union of the default relays and the relays of all apps
+func (svc *Service) getAllRelays() []string {
+	relays := append([]string{}, svc.cfg.Relays...)
+	known := make(map[string]bool)
+	for _, relay := range relays {
+		known[relay] = true
+	}
+	apps := []App{}
+	svc.db.Find(&apps)
+	for _, app := range apps {
+		for _, relay := range app.Relays {
+			if !known[relay] {
+				known[relay] = true
+				relays = append(relays, relay)
+			}
+		}
+	}
+	return relays
+}
+
+// getUnusedRelays returns the relays which are neither a default relay nor used by an app
+func (svc *Service) getUnusedRelays(relays []string) (unused []string) {
+	allRelays := svc.getAllRelays()
+	for _, relay := range relays {
+		if !containsString(allRelays, relay) {
+			unused = append(unused, relay)
+		}
+	}
+	return unused
+}
+
+// StartSubscription hands the incoming requests to a fixed number of workers until ctx is canceled.
+// Requests are queued per app, an app whose queue is full gets a RATE_LIMITED response.
+// Requests of unknown pubkeys share a single queue, they are rejected by the workers anyway.
+func (svc *Service) StartSubscription(ctx context.Context, pool *RelayPool) error {
+	queue := newEventQueue(svc.cfg.EventQueueSize, svc.cfg.EventQueueTotalSize)
+	var wg sync.WaitGroup
+	for i := 0; i < svc.cfg.EventWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				relayEvent, ok := queue.pop(ctx)
+				if !ok {
+					return
+				}
+				svc.processEvent(ctx, pool, relayEvent)
+			}
+		}()
+	}
+	defer wg.Wait()
+
+	// rejections are published concurrently, but not at any cost
+	rateLimitedReplies := make(chan struct{}, svc.cfg.EventWorkers)
 	for {
 		select {
-		case notice := <-sub.Relay.Notices:
-			svc.Logger.Infof("Received a notice %s", notice)
-		case conErr := <-sub.Relay.ConnectionError:
-			return conErr
 		case <-ctx.Done():
 			svc.Logger.Info("Exiting subscription.")
 			return nil
-		case <-sub.EndOfStoredEvents:
-			svc.Logger.Info("Received EOS")
-			svc.ReceivedEOS = true
-		case event := <-sub.Events:
-			go func() {
-				resp, err := svc.HandleEvent(ctx, event)
-				if err != nil {
-					svc.Logger.Error(err)
-				}
-				if resp != nil {
-					status := sub.Relay.Publish(ctx, *resp)
-					nostrEvent := NostrEvent{}
-					result := svc.db.Where("nostr_id = ?", event.ID).First(&nostrEvent)
-					if result.Error != nil {
-						svc.Logger.Error(result.Error)
+		case relayUrl := <-pool.EndOfStoredEvents:
+			svc.Logger.Infof("Received EOS from %s", relayUrl)
+		case relayEvent := <-pool.Events:
+			event := relayEvent.Event
+			if time.Since(event.CreatedAt) > time.Duration(svc.cfg.StoredEventMaxAge)*time.Second {
+				svc.Logger.WithFields(logrus.Fields{
+					"eventId":   event.ID,
+					"eventKind": event.Kind,
+					"relay":     relayEvent.RelayUrl,
+				}).Warn("Ignoring event older than the maximum age")
+				continue
+			}
+			if queue.push(svc.getEventQueueKey(event.PubKey), relayEvent) {
+				continue
+			}
+			svc.Logger.WithFields(logrus.Fields{
+				"eventId":   event.ID,
+				"eventKind": event.Kind,
+				"pubkey":    event.PubKey,
+			}).Warn("Event queue of the app is full")
+			select {
+			case rateLimitedReplies <- struct{}{}:
+				go func() {
+					defer func() { <-rateLimitedReplies }()
+					resp, err := svc.createRateLimitedResponse(event)
+					if err != nil {
+						svc.Logger.WithError(err).Errorf("Failed to create rate limited response for %s", event.ID)
 						return
 					}
-					nostrEvent.ReplyId = resp.ID
-					// https://github.com/nbd-wtf/go-nostr/blob/master/relay.go#L321
-					if status == nostr.PublishStatusSucceeded {
-						nostrEvent.State = "replied"
-						nostrEvent.RepliedAt = time.Now()
-						svc.db.Save(&nostrEvent)
-						svc.Logger.WithFields(logrus.Fields{
-							"nostrEventId": nostrEvent.ID,
-							"eventId":      event.ID,
-							"status":       status,
-							"replyEventId": resp.ID,
-							"appId":        nostrEvent.AppId,
-						}).Info("Published reply")
-					} else if status == nostr.PublishStatusFailed {
-						nostrEvent.State = "failed"
-						svc.db.Save(&nostrEvent)
-						svc.Logger.WithFields(logrus.Fields{
-							"nostrEventId": nostrEvent.ID,
-							"eventId":      event.ID,
-							"status":       status,
-							"replyEventId": resp.ID,
-							"appId":        nostrEvent.AppId,
-						}).Info("Failed to publish reply")
-					} else {
-						nostrEvent.State = "sent"
-						svc.db.Save(&nostrEvent)
-						svc.Logger.WithFields(logrus.Fields{
-							"nostrEventId": nostrEvent.ID,
-							"eventId":      event.ID,
-							"status":       status,
-							"replyEventId": resp.ID,
-							"appId":        nostrEvent.AppId,
-						}).Info("Reply sent but no response from relay (timeout)")
-					}
-				}
-			}()
+					svc.publishResponse(ctx, pool, event, resp)
+				}()
+			default:
+			}
 		}
 	}
 }
 
-func (svc *Service) HandleEvent(ctx context.Context, event *nostr.Event) (result *nostr.Event, err error) {
-	//don't process historical events
-	if !svc.ReceivedEOS {
-		return nil, nil
+// getEventQueueKey returns the pubkey if it belongs to an app, or the key of the shared queue of unknown pubkeys
+func (svc *Service) getEventQueueKey(pubkey string) string {
+	var appsCount int64
+	err := svc.db.Model(&App{}).Where("nostr_pubkey = ?", pubkey).Count(&appsCount).Error
+	if err != nil || appsCount == 0 {
+		return unknownAppQueueKey
 	}
+	return pubkey
+}
+
+func (svc *Service) processEvent(ctx context.Context, pool *RelayPool, relayEvent RelayEvent) {
+	event := relayEvent.Event
+	responses, err := svc.HandleEvent(ctx, event)
+	if err != nil {
+		svc.Logger.Error(err)
+	}
+	for _, resp := range responses {
+		svc.publishResponse(ctx, pool, event, resp)
+	}
+	svc.updateRelayCursor(relayEvent.RelayUrl, event.CreatedAt)
+}
+
+// createRateLimitedResponse rejects a request which could not be queued.
+// Forged requests are dropped, so they cannot be used to make the service publish events.
+func (svc *Service) createRateLimitedResponse(event *nostr.Event) (*nostr.Event, error) {
+	err := verifyEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := nip04.ComputeSharedSecret(event.PubKey, svc.cfg.NostrSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	return svc.createResponse(event, Nip47Response{
+		Error: &Nip47Error{
+			Code:    NIP_47_ERROR_RATE_LIMITED,
+			Message: "Too many requests, try again later",
+		},
+	}, nostr.Tags{}, ss)
+}
+
+// updateRelayCursor moves the relay cursor forward to the creation time of a processed event
+func (svc *Service) updateRelayCursor(relayUrl string, eventCreatedAt time.Time) {
+	relayCursor := RelayCursor{}
+	err := svc.db.FirstOrCreate(&relayCursor, RelayCursor{Url: relayUrl}).Error
+	if err != nil {
+		svc.Logger.WithError(err).Errorf("Failed to load relay cursor for %s", relayUrl)
+		return
+	}
+	// events are processed concurrently, never move the cursor backwards
+	err = svc.db.Model(&RelayCursor{}).Where("id = ? AND last_event_at < ?", relayCursor.ID, eventCreatedAt).Update("last_event_at", eventCreatedAt).Error
+	if err != nil {
+		svc.Logger.WithError(err).Errorf("Failed to update relay cursor for %s", relayUrl)
+	}
+}
+
+// publishResponse stores the response in the outbox and publishes it,
+// responses no relay acknowledged are retried by the outbox worker
+func (svc *Service) publishResponse(ctx context.Context, pool *RelayPool, event *nostr.Event, resp *nostr.Event) {
+	// requests rejected before an app was found are not stored
+	nostrEvent := NostrEvent{}
+	svc.db.Limit(1).Find(&nostrEvent, &NostrEvent{NostrId: event.ID})
+	if nostrEvent.ID != 0 {
+		svc.db.Model(&nostrEvent).Update("reply_id", resp.ID)
+	}
+
+	relays := svc.getRelaysForPubkey(event.PubKey)
+	outboxEvent, err := svc.createOutboxEvent(nostrEvent.AppId, nostrEvent.ID, resp, relays)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":      event.ID,
+			"replyEventId": resp.ID,
+		}).Errorf("Failed to store reply in the outbox: %v", err)
+		pool.Publish(ctx, *resp, relays)
+		return
+	}
+	status := svc.publishOutboxEvent(ctx, pool, outboxEvent)
+	if nostrEvent.ID != 0 {
+		svc.updateReplyState(outboxEvent, status)
+	}
+}
+
+// updateReplyState records the publish status of a reply on its request
+func (svc *Service) updateReplyState(outboxEvent *OutboxEvent, status nostr.Status) {
+	nostrEvent := NostrEvent{}
+	result := svc.db.First(&nostrEvent, outboxEvent.NostrEventId)
+	if result.Error != nil {
+		svc.Logger.Error(result.Error)
+		return
+	}
+	nostrEvent.ReplyId = outboxEvent.EventId
+	nostrEvent.RelayStatuses = outboxEvent.RelayStatuses
+	// https://github.com/nbd-wtf/go-nostr/blob/master/relay.go#L321
+	if status == nostr.PublishStatusSucceeded {
+		nostrEvent.State = "replied"
+		nostrEvent.RepliedAt = time.Now()
+		svc.db.Save(&nostrEvent)
+		svc.Logger.WithFields(logrus.Fields{
+			"nostrEventId":  nostrEvent.ID,
+			"eventId":       nostrEvent.NostrId,
+			"status":        status,
+			"relayStatuses": nostrEvent.RelayStatuses,
+			"replyEventId":  outboxEvent.EventId,
+			"appId":         nostrEvent.AppId,
+		}).Info("Published reply")
+	} else if status == nostr.PublishStatusFailed {
+		nostrEvent.State = "failed"
+		svc.db.Save(&nostrEvent)
+		svc.Logger.WithFields(logrus.Fields{
+			"nostrEventId":  nostrEvent.ID,
+			"eventId":       nostrEvent.NostrId,
+			"status":        status,
+			"relayStatuses": nostrEvent.RelayStatuses,
+			"replyEventId":  outboxEvent.EventId,
+			"appId":         nostrEvent.AppId,
+		}).Info("Failed to publish reply")
+	} else {
+		nostrEvent.State = "sent"
+		svc.db.Save(&nostrEvent)
+		svc.Logger.WithFields(logrus.Fields{
+			"nostrEventId":  nostrEvent.ID,
+			"eventId":       nostrEvent.NostrId,
+			"status":        status,
+			"relayStatuses": nostrEvent.RelayStatuses,
+			"replyEventId":  outboxEvent.EventId,
+			"appId":         nostrEvent.AppId,
+		}).Info("Reply sent but no response from relay (timeout)")
+	}
+}
+
+// HandleEvent processes a NIP-47 request and returns the response events to publish.
+// Most methods have a single response, the multi_* methods reply once per item.
+func (svc *Service) HandleEvent(ctx context.Context, event *nostr.Event) (responses []*nostr.Event, err error) {
 	svc.Logger.WithFields(logrus.Fields{
 		"eventId":   event.ID,
 		"eventKind": event.Kind,
@@ -131,6 +343,38 @@ func (svc *Service) HandleEvent(ctx context.Context, event *nostr.Event) (result
 		return nil, nil
 	}
 
+	// forged events are dropped, stale events of the app are answered
+	err = verifyEvent(event)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+		}).Errorf("Dropping forged event: %v", err)
+		return nil, nil
+	}
+	validationErr := validateEvent(event, time.Duration(svc.cfg.EventTimeWindow)*time.Second, time.Now())
+	if validationErr != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"createdAt": event.CreatedAt,
+		}).Errorf("Rejecting invalid event: %v", validationErr)
+		ss, err := nip04.ComputeSharedSecret(event.PubKey, svc.cfg.NostrSecretKey)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := svc.createResponse(event, Nip47Response{
+			Error: &Nip47Error{
+				Code:    NIP_47_ERROR_INVALID_EVENT,
+				Message: validationErr.Error(),
+			},
+		}, nostr.Tags{}, ss)
+		if err != nil {
+			return nil, err
+		}
+		return []*nostr.Event{resp}, nil
+	}
+
 	app := App{}
 	err = svc.db.Preload("User").First(&app, &App{
 		NostrPubkey: event.PubKey,
@@ -145,8 +389,8 @@ func (svc *Service) HandleEvent(ctx context.Context, event *nostr.Event) (result
 				Code:    NIP_47_ERROR_UNAUTHORIZED,
 				Message: "The public key does not have a wallet connected.",
 			},
-		}, ss)
-		return resp, err
+		}, nostr.Tags{}, ss)
+		return []*nostr.Event{resp}, err
 	}
 
 	svc.Logger.WithFields(logrus.Fields{
@@ -160,17 +404,43 @@ func (svc *Service) HandleEvent(ctx context.Context, event *nostr.Event) (result
 	if err != nil {
 		return nil, err
 	}
-	payload, err := nip04.Decrypt(event.Content, ss)
+	encryption := getEncryption(event)
+	if app.Nip44Only && encryption != NIP_47_ENCRYPTION_NIP44_V2 {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":    event.ID,
+			"eventKind":  event.Kind,
+			"appId":      app.ID,
+			"encryption": encryption,
+		}).Error("App only accepts NIP-44 encrypted requests")
+		resp, err := svc.createResponse(event, Nip47Response{
+			Error: &Nip47Error{
+				Code:    NIP_47_ERROR_UNSUPPORTED_ENCRYPTION,
+				Message: "This app only accepts NIP-44 encrypted requests",
+			},
+		}, nostr.Tags{}, ss)
+		if err != nil {
+			return nil, err
+		}
+		return []*nostr.Event{resp}, nil
+	}
+	payload, err := decryptContent(encryption, event.Content, ss)
 	if err != nil {
 		svc.Logger.WithFields(logrus.Fields{
-			"eventId":   event.ID,
-			"eventKind": event.Kind,
-			"appId":     app.ID,
+			"eventId":    event.ID,
+			"eventKind":  event.Kind,
+			"appId":      app.ID,
+			"encryption": encryption,
 		}).Errorf("Failed to decrypt content: %v", err)
 		return nil, err
 	}
 
-	nostrEvent = NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
+	nip47Request := &Nip47Request{}
+	err = json.Unmarshal([]byte(payload), nip47Request)
+	if err != nil {
+		return nil, err
+	}
+
+	nostrEvent = NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received", Method: nip47Request.Method}
 	insertNostrEventResult := svc.db.Create(&nostrEvent)
 	if insertNostrEventResult.Error != nil {
 		svc.Logger.WithFields(logrus.Fields{
@@ -181,97 +451,45 @@ func (svc *Service) HandleEvent(ctx context.Context, event *nostr.Event) (result
 		return nil, insertNostrEventResult.Error
 	}
 
-	var bolt11 string
-	payParams := &Nip47PayParams{}
-	nip47Request := &Nip47Request{
-		Params: payParams,
-	}
-	err = json.Unmarshal([]byte(payload), nip47Request)
-	if err != nil {
-		return nil, err
-	}
-	if nip47Request.Method != NIP_47_PAY_INVOICE_METHOD {
-		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
+	var resp *nostr.Event
+	switch nip47Request.Method {
+	case NIP_47_MULTI_PAY_INVOICE_METHOD:
+		return svc.HandleMultiPayInvoiceEvent(ctx, nip47Request, event, app, ss)
+	case NIP_47_MULTI_PAY_KEYSEND_METHOD:
+		return svc.HandleMultiPayKeysendEvent(ctx, nip47Request, event, app, ss)
+	case NIP_47_PAY_INVOICE_METHOD:
+		resp, err = svc.HandlePayInvoiceEvent(ctx, nip47Request, event, app, ss)
+	case NIP_47_PAY_KEYSEND_METHOD:
+		resp, err = svc.HandlePayKeysendEvent(ctx, nip47Request, event, app, ss)
+	case NIP_47_GET_BALANCE_METHOD:
+		resp, err = svc.HandleGetBalanceEvent(ctx, nip47Request, event, app, ss)
+	case NIP_47_MAKE_INVOICE_METHOD:
+		resp, err = svc.HandleMakeInvoiceEvent(ctx, nip47Request, event, app, ss)
+	case NIP_47_LOOKUP_INVOICE_METHOD:
+		resp, err = svc.HandleLookupInvoiceEvent(ctx, nip47Request, event, app, ss)
+	case NIP_47_LIST_TRANSACTIONS_METHOD:
+		resp, err = svc.HandleListTransactionsEvent(ctx, nip47Request, event, app, ss)
+	case NIP_47_GET_INFO_METHOD:
+		resp, err = svc.HandleGetInfoEvent(ctx, nip47Request, event, app, ss)
+	default:
+		resp, err = svc.createResponse(event, Nip47Response{Error: &Nip47Error{
 			Code:    NIP_47_ERROR_NOT_IMPLEMENTED,
 			Message: fmt.Sprintf("Unknown method: %s", nip47Request.Method),
-		}}, ss)
+		}}, nostr.Tags{}, ss)
 	}
-	bolt11 = payParams.Invoice
-	paymentRequest, err := decodepay.Decodepay(bolt11)
-	if err != nil {
-		svc.Logger.WithFields(logrus.Fields{
-			"eventId":   event.ID,
-			"eventKind": event.Kind,
-			"appId":     app.ID,
-			"bolt11":    bolt11,
-		}).Errorf("Failed to decode bolt11 invoice: %v", err)
-		//todo: create & send response
+	if resp == nil {
 		return nil, err
 	}
-
-	hasPermission, code, message := svc.hasPermission(&app, event, nip47Request.Method, &paymentRequest)
-
-	if !hasPermission {
-		svc.Logger.WithFields(logrus.Fields{
-			"eventId":   event.ID,
-			"eventKind": event.Kind,
-			"appId":     app.ID,
-		}).Errorf("App does not have permission: %s %s", code, message)
-
-		return svc.createResponse(event, Nip47Response{Error: &Nip47Error{
-			Code:    code,
-			Message: message,
-		}}, ss)
-	}
-
-	payment := Payment{App: app, NostrEvent: nostrEvent, PaymentRequest: bolt11, Amount: uint(paymentRequest.MSatoshi / 1000)}
-	insertPaymentResult := svc.db.Create(&payment)
-	if insertPaymentResult.Error != nil {
-		return nil, insertPaymentResult.Error
-	}
-
-	svc.Logger.WithFields(logrus.Fields{
-		"eventId":   event.ID,
-		"eventKind": event.Kind,
-		"appId":     app.ID,
-		"bolt11":    bolt11,
-	}).Info("Sending payment")
-
-	preimage, err := svc.lnClient.SendPaymentSync(ctx, event.PubKey, bolt11)
-	if err != nil {
-		svc.Logger.WithFields(logrus.Fields{
-			"eventId":   event.ID,
-			"eventKind": event.Kind,
-			"appId":     app.ID,
-			"bolt11":    bolt11,
-		}).Infof("Failed to send payment: %v", err)
-		nostrEvent.State = "error"
-		svc.db.Save(&nostrEvent)
-		return svc.createResponse(event, Nip47Response{
-			Error: &Nip47Error{
-				Code:    NIP_47_ERROR_INTERNAL,
-				Message: fmt.Sprintf("Something went wrong while paying invoice: %s", err.Error()),
-			},
-		}, ss)
-	}
-	payment.Preimage = preimage
-	nostrEvent.State = "executed"
-	svc.db.Save(&nostrEvent)
-	svc.db.Save(&payment)
-	return svc.createResponse(event, Nip47Response{
-		ResultType: NIP_47_PAY_INVOICE_METHOD,
-		Result: Nip47PayResponse{
-			Preimage: preimage,
-		},
-	}, ss)
+	return []*nostr.Event{resp}, err
 }
 
-func (svc *Service) createResponse(initialEvent *nostr.Event, content interface{}, ss []byte) (result *nostr.Event, err error) {
+func (svc *Service) createResponse(initialEvent *nostr.Event, content interface{}, tags nostr.Tags, ss []byte) (result *nostr.Event, err error) {
 	payloadBytes, err := json.Marshal(content)
 	if err != nil {
 		return nil, err
 	}
-	msg, err := nip04.Encrypt(string(payloadBytes), ss)
+	// reply with the same encryption scheme the request used
+	msg, err := encryptContent(getEncryption(initialEvent), string(payloadBytes), ss)
 	if err != nil {
 		return nil, err
 	}
@@ -279,7 +497,7 @@ func (svc *Service) createResponse(initialEvent *nostr.Event, content interface{
 		PubKey:    svc.cfg.IdentityPubkey,
 		CreatedAt: time.Now(),
 		Kind:      NIP_47_RESPONSE_KIND,
-		Tags:      nostr.Tags{[]string{"p", initialEvent.PubKey}, []string{"e", initialEvent.ID}},
+		Tags:      append(nostr.Tags{[]string{"p", initialEvent.PubKey}, []string{"e", initialEvent.ID}}, tags...),
 		Content:   msg,
 	}
 	err = resp.Sign(svc.cfg.NostrSecretKey)
@@ -329,7 +547,7 @@ func GetEndOfBudget(budget_type string, createdAt time.Time) time.Time {
 	}
 }
 
-func (svc *Service) hasPermission(app *App, event *nostr.Event, requestMethod string, paymentRequest *decodepay.Bolt11) (result bool, code string, message string) {
+func (svc *Service) hasPermission(app *App, event *nostr.Event, requestMethod string, amount int64) (result bool, code string, message string) {
 	// find all permissions for the app
 	appPermissions := []AppPermission{}
 	findPermissionsResult := svc.db.Find(&appPermissions, &AppPermission{
@@ -355,31 +573,122 @@ func (svc *Service) hasPermission(app *App, event *nostr.Event, requestMethod st
 		return false, NIP_47_ERROR_EXPIRED, "This app has expired"
 	}
 
+	if rateLimited, message := svc.isRateLimited(app, &appPermission); rateLimited {
+		return false, NIP_47_ERROR_RATE_LIMITED, message
+	}
+
 	maxAmount := appPermission.MaxAmount
 	if maxAmount != 0 {
 		budgetUsage := svc.GetBudgetUsage(&appPermission)
 
-		if budgetUsage+paymentRequest.MSatoshi/1000 > int64(maxAmount) {
+		if budgetUsage+amount/1000 > int64(maxAmount) {
 			return false, NIP_47_ERROR_QUOTA_EXCEEDED, "Insufficient budget remaining to make payment"
 		}
 	}
 	return true, "", ""
 }
 
+// isRateLimited checks the requests of the app in the last minute and hour against the limits of the permission.
+// The current request is already stored, so it counts towards the limits.
+func (svc *Service) isRateLimited(app *App, appPermission *AppPermission) (result bool, message string) {
+	limits := []struct {
+		limit  int
+		window time.Duration
+		name   string
+	}{
+		{appPermission.RateLimitPerMinute, time.Minute, "minute"},
+		{appPermission.RateLimitPerHour, time.Hour, "hour"},
+	}
+	for _, limit := range limits {
+		if limit.limit <= 0 {
+			continue
+		}
+		var requestsCount int64
+		svc.db.Model(&NostrEvent{}).
+			Where("app_id = ? AND method IN ? AND created_at > ?", app.ID, getPermissionMethods(appPermission.RequestMethod), time.Now().Add(-limit.window)).
+			Count(&requestsCount)
+		if requestsCount > int64(limit.limit) {
+			return true, fmt.Sprintf("This app may only request %s %d times per %s", appPermission.RequestMethod, limit.limit, limit.name)
+		}
+	}
+	return false, ""
+}
+
+// getPermissionMethods returns the request methods covered by a permission
+func getPermissionMethods(requestMethod string) []string {
+	switch requestMethod {
+	case NIP_47_PAY_INVOICE_METHOD:
+		return []string{NIP_47_PAY_INVOICE_METHOD, NIP_47_MULTI_PAY_INVOICE_METHOD}
+	case NIP_47_PAY_KEYSEND_METHOD:
+		return []string{NIP_47_PAY_KEYSEND_METHOD, NIP_47_MULTI_PAY_KEYSEND_METHOD}
+	}
+	return []string{requestMethod}
+}
+
+// GetPermittedMethods returns the NIP-47 methods the app is allowed to request
+func (svc *Service) GetPermittedMethods(app *App) []string {
+	appPermissions := []AppPermission{}
+	svc.db.Find(&appPermissions, &AppPermission{
+		AppId: app.ID,
+	})
+	capabilities := strings.Fields(NIP_47_CAPABILITIES)
+	if len(appPermissions) == 0 {
+		// No permissions created for this app. It can do anything
+		return capabilities
+	}
+
+	permitted := make(map[string]bool)
+	for _, appPermission := range appPermissions {
+		if !appPermission.ExpiresAt.IsZero() && appPermission.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+		permitted[appPermission.RequestMethod] = true
+	}
+	// multi_pay_* requests are checked against the pay_* permissions
+	permitted[NIP_47_MULTI_PAY_INVOICE_METHOD] = permitted[NIP_47_PAY_INVOICE_METHOD]
+	permitted[NIP_47_MULTI_PAY_KEYSEND_METHOD] = permitted[NIP_47_PAY_KEYSEND_METHOD]
+
+	methods := []string{}
+	for _, capability := range capabilities {
+		if permitted[capability] {
+			methods = append(methods, capability)
+		}
+	}
+	return methods
+}
+
+// hasExplicitPermission returns true if the app was granted the permission,
+// unlike hasPermission it is false for apps without any permissions
+func (svc *Service) hasExplicitPermission(app *App, requestMethod string) bool {
+	appPermission := AppPermission{}
+	findPermissionResult := svc.db.Limit(1).Find(&appPermission, &AppPermission{
+		AppId:         app.ID,
+		RequestMethod: requestMethod,
+	})
+	if findPermissionResult.RowsAffected == 0 {
+		return false
+	}
+	return appPermission.ExpiresAt.IsZero() || appPermission.ExpiresAt.After(time.Now())
+}
+
 func (svc *Service) GetBudgetUsage(appPermission *AppPermission) int64 {
 	var result struct {
 		Sum uint
 	}
-	svc.db.Table("payments").Select("SUM(amount) as sum").Where("app_id = ? AND preimage IS NOT NULL AND created_at > ?", appPermission.AppId, GetStartOfBudget(appPermission.BudgetRenewal, appPermission.App.CreatedAt)).Scan(&result)
+	svc.db.Table("payments").Select("SUM(amount) as sum").Where("app_id = ? AND state IN ? AND created_at > ?", appPermission.AppId, []string{"pending", "succeeded"}, GetStartOfBudget(appPermission.BudgetRenewal, appPermission.App.CreatedAt)).Scan(&result)
 	return int64(result.Sum)
 }
 
 func (svc *Service) PublishNip47Info(ctx context.Context, relay *nostr.Relay) error {
 	ev := &nostr.Event{}
 	ev.Kind = NIP_47_INFO_EVENT_KIND
-	ev.Content = NIP_47_CAPABILITIES
+	ev.Content = NIP_47_CAPABILITIES + " " + NIP_47_NOTIFICATIONS_PERMISSION
 	ev.CreatedAt = time.Now()
 	ev.PubKey = svc.cfg.IdentityPubkey
+	ev.Tags = nostr.Tags{
+		[]string{"encryption", NIP_47_SUPPORTED_ENCRYPTIONS},
+		[]string{"notifications", NIP_47_NOTIFICATION_TYPES},
+	}
 	err := ev.Sign(svc.cfg.NostrSecretKey)
 	if err != nil {
 		return err
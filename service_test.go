@@ -2,16 +2,38 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/getAlby/nostr-wallet-connect/nip44"
 	"github.com/glebarez/sqlite"
+	"github.com/gorilla/sessions"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/nbd-wtf/go-nostr/nip42"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gorm.io/gorm"
 )
 
@@ -27,12 +49,107 @@ const nip47PayJson = `
 `
 const nip47PayWrongMethodJson = `
 {
-	"method": "get_balance",
+	"method": "non_existing_method",
     "params": {
         "invoice": "lntb1230n1pjypux0pp5xgxzcks5jtx06k784f9dndjh664wc08ucrganpqn52d0ftrh9n8sdqyw3jscqzpgxqyz5vqsp5rkx7cq252p3frx8ytjpzc55rkgyx2mfkzzraa272dqvr2j6leurs9qyyssqhutxa24r5hqxstchz5fxlslawprqjnarjujp5sm3xj7ex73s32sn54fthv2aqlhp76qmvrlvxppx9skd3r5ut5xutgrup8zuc6ay73gqmra29m"
 	}
 }
 `
+const nip47GetBalanceJson = `
+{
+	"method": "get_balance"
+}
+`
+const nip47MakeInvoiceJson = `
+{
+	"method": "make_invoice",
+	"params": {
+		"amount": 1000,
+		"description": "Hello, world",
+		"expiry": 3600
+	}
+}
+`
+const nip47LookupInvoiceJson = `
+{
+	"method": "lookup_invoice",
+	"params": {
+		"payment_hash": "320c2c5a1492ccfd5bc7aa4ad9b657d6aaec3cfcc0d1d9842ba29af4ac772ccf"
+	}
+}
+`
+const nip47LookupUnknownInvoiceJson = `
+{
+	"method": "lookup_invoice",
+	"params": {
+		"payment_hash": "0000000000000000000000000000000000000000000000000000000000000000"
+	}
+}
+`
+const nip47ListTransactionsJson = `
+{
+	"method": "list_transactions",
+	"params": {
+		"limit": 10
+	}
+}
+`
+const nip47KeysendJson = `
+{
+	"method": "pay_keysend",
+	"params": {
+		"amount": 50000,
+		"pubkey": "03cbd788f5b22bd56e2714bff756372d2293504c064e03250ed16a4dd80ad70e2c",
+		"preimage": "f00dbabef00dbabef00dbabef00dbabef00dbabef00dbabef00dbabef00dbabe",
+		"tlv_records": [
+			{
+				"type": 7629169,
+				"value": "7b22616374696f6e223a22626f6f7374227d"
+			}
+		]
+	}
+}
+`
+const nip47MultiPayInvoiceJson = `
+{
+	"method": "multi_pay_invoice",
+	"params": {
+		"invoices": [
+			{
+				"id": "invoice_1",
+				"invoice": "lntb1230n1pjypux0pp5xgxzcks5jtx06k784f9dndjh664wc08ucrganpqn52d0ftrh9n8sdqyw3jscqzpgxqyz5vqsp5rkx7cq252p3frx8ytjpzc55rkgyx2mfkzzraa272dqvr2j6leurs9qyyssqhutxa24r5hqxstchz5fxlslawprqjnarjujp5sm3xj7ex73s32sn54fthv2aqlhp76qmvrlvxppx9skd3r5ut5xutgrup8zuc6ay73gqmra29m"
+			},
+			{
+				"id": "invoice_2",
+				"invoice": "lntb1invalid"
+			}
+		]
+	}
+}
+`
+const nip47MultiPayKeysendJson = `
+{
+	"method": "multi_pay_keysend",
+	"params": {
+		"keysends": [
+			{
+				"id": "keysend_1",
+				"amount": 50000,
+				"pubkey": "03cbd788f5b22bd56e2714bff756372d2293504c064e03250ed16a4dd80ad70e2c"
+			},
+			{
+				"amount": 50000,
+				"pubkey": "02e89ca9e8da72b33d896bae51d20e7e6675aa971f7557500b6591b15429e717f1"
+			}
+		]
+	}
+}
+`
+const nip47GetInfoJson = `
+{
+	"method": "get_info"
+}
+`
 const nip47PayJsonNoInvoice = `
 {
 	"method": "pay_invoice",
@@ -46,15 +163,6 @@ func TestHandleEvent(t *testing.T) {
 	ctx := context.TODO()
 	svc, _ := createTestService(t)
 	defer os.Remove(testDB)
-	//test not yet receivedEOS
-	res, err := svc.HandleEvent(ctx, &nostr.Event{
-		Kind: NIP_47_REQUEST_KIND,
-	})
-	assert.Nil(t, res)
-	assert.Nil(t, err)
-	//now signal that we are ready to receive events
-	svc.ReceivedEOS = true
-
 	senderPrivkey := nostr.GeneratePrivateKey()
 	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
 	assert.NoError(t, err)
@@ -63,16 +171,15 @@ func TestHandleEvent(t *testing.T) {
 	assert.NoError(t, err)
 	payload, err := nip04.Encrypt(nip47PayJson, ss)
 	assert.NoError(t, err)
-	res, err = svc.HandleEvent(ctx, &nostr.Event{
-		ID:      "test_event_1",
+	res, err := svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
 		Kind:    NIP_47_REQUEST_KIND,
 		PubKey:  senderPubkey,
 		Content: payload,
-	})
+	}, senderPrivkey))
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
 	received := &Nip47Response{}
-	decrypted, err := nip04.Decrypt(res.Content, ss)
+	decrypted, err := nip04.Decrypt(res[0].Content, ss)
 	assert.NoError(t, err)
 	err = json.Unmarshal([]byte(decrypted), received)
 	assert.NoError(t, err)
@@ -87,26 +194,24 @@ func TestHandleEvent(t *testing.T) {
 	err = svc.db.Model(&user).Association("Apps").Append(&app)
 	assert.NoError(t, err)
 	//test old payload
-	res, err = svc.HandleEvent(ctx, &nostr.Event{
-		ID:      "test_event_2",
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
 		Kind:    NIP_47_REQUEST_KIND,
 		PubKey:  senderPubkey,
 		Content: payload,
-	})
+	}, senderPrivkey))
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
 	//test new payload
 	newPayload, err := nip04.Encrypt(nip47PayJson, ss)
 	assert.NoError(t, err)
-	res, err = svc.HandleEvent(ctx, &nostr.Event{
-		ID:      "test_event_3",
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
 		Kind:    NIP_47_REQUEST_KIND,
 		PubKey:  senderPubkey,
 		Content: newPayload,
-	})
+	}, senderPrivkey))
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
-	decrypted, err = nip04.Decrypt(res.Content, ss)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
 	assert.NoError(t, err)
 	received = &Nip47Response{
 		Result: &Nip47PayResponse{},
@@ -116,22 +221,20 @@ func TestHandleEvent(t *testing.T) {
 	assert.Equal(t, received.Result.(*Nip47PayResponse).Preimage, "123preimage")
 	malformedPayload, err := nip04.Encrypt(nip47PayJsonNoInvoice, ss)
 	assert.NoError(t, err)
-	res, err = svc.HandleEvent(ctx, &nostr.Event{
-		ID:      "test_event_4",
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
 		Kind:    NIP_47_REQUEST_KIND,
 		PubKey:  senderPubkey,
 		Content: malformedPayload,
-	})
+	}, senderPrivkey))
 	assert.Error(t, err)
 	//test wrong method
 	wrongMethodPayload, err := nip04.Encrypt(nip47PayWrongMethodJson, ss)
 	assert.NoError(t, err)
-	res, err = svc.HandleEvent(ctx, &nostr.Event{
-		ID:      "test_event_5",
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
 		Kind:    NIP_47_REQUEST_KIND,
 		PubKey:  senderPubkey,
 		Content: wrongMethodPayload,
-	})
+	}, senderPrivkey))
 	assert.NoError(t, err)
 	//add app permissions
 	maxAmount := 1000
@@ -148,15 +251,16 @@ func TestHandleEvent(t *testing.T) {
 	err = svc.db.Create(appPermission).Error
 	assert.NoError(t, err)
 	// permissions: no limitations
-	res, err = svc.HandleEvent(ctx, &nostr.Event{
-		ID:      "test_event_6",
+	newPayload, err = nip04.Encrypt(nip47PayJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
 		Kind:    NIP_47_REQUEST_KIND,
 		PubKey:  senderPubkey,
 		Content: newPayload,
-	})
+	}, senderPrivkey))
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
-	decrypted, err = nip04.Decrypt(res.Content, ss)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
 	assert.NoError(t, err)
 	received = &Nip47Response{
 		Result: &Nip47PayResponse{},
@@ -168,16 +272,17 @@ func TestHandleEvent(t *testing.T) {
 	newMaxAmount := 100
 	err = svc.db.Model(&AppPermission{}).Where("app_id = ?", app.ID).Update("max_amount", newMaxAmount).Error
 
-	res, err = svc.HandleEvent(ctx, &nostr.Event{
-		ID:      "test_event_7",
+	newPayload, err = nip04.Encrypt(nip47PayJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
 		Kind:    NIP_47_REQUEST_KIND,
 		PubKey:  senderPubkey,
 		Content: newPayload,
-	})
+	}, senderPrivkey))
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
 
-	decrypted, err = nip04.Decrypt(res.Content, ss)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
 	assert.NoError(t, err)
 	received = &Nip47Response{}
 	err = json.Unmarshal([]byte(decrypted), received)
@@ -188,16 +293,17 @@ func TestHandleEvent(t *testing.T) {
 	newExpiry := time.Now().Add(-24 * time.Hour)
 	err = svc.db.Model(&AppPermission{}).Where("app_id = ?", app.ID).Update("expires_at", newExpiry).Error
 
-	res, err = svc.HandleEvent(ctx, &nostr.Event{
-		ID:      "test_event_8",
+	newPayload, err = nip04.Encrypt(nip47PayJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
 		Kind:    NIP_47_REQUEST_KIND,
 		PubKey:  senderPubkey,
 		Content: newPayload,
-	})
+	}, senderPrivkey))
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
 
-	decrypted, err = nip04.Decrypt(res.Content, ss)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
 	assert.NoError(t, err)
 	received = &Nip47Response{}
 	err = json.Unmarshal([]byte(decrypted), received)
@@ -207,49 +313,2150 @@ func TestHandleEvent(t *testing.T) {
 	// permissions: no request method
 	err = svc.db.Model(&AppPermission{}).Where("app_id = ?", app.ID).Update("request_method", nil).Error
 
-	res, err = svc.HandleEvent(ctx, &nostr.Event{
-		ID:      "test_event_9",
+	newPayload, err = nip04.Encrypt(nip47PayJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
 		Kind:    NIP_47_REQUEST_KIND,
 		PubKey:  senderPubkey,
 		Content: newPayload,
-	})
+	}, senderPrivkey))
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
 
-	decrypted, err = nip04.Decrypt(res.Content, ss)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
 	assert.NoError(t, err)
 	received = &Nip47Response{}
 	err = json.Unmarshal([]byte(decrypted), received)
 	assert.NoError(t, err)
 	assert.Equal(t, received.Error.Code, NIP_47_ERROR_RESTRICTED)
 	assert.NotNil(t, res)
+
+	// requests older than the time window are rejected
+	newPayload, err = nip04.Encrypt(nip47PayJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:      NIP_47_REQUEST_KIND,
+		PubKey:    senderPubkey,
+		Content:   newPayload,
+		CreatedAt: time.Now().Add(-time.Hour),
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_ERROR_INVALID_EVENT, received.Error.Code)
+	assert.Equal(t, ErrEventTooOld.Error(), received.Error.Message)
+
+	// forged requests are dropped without a reply
+	forged := signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: newPayload,
+	}, senderPrivkey)
+	forged.Sig = strings.Repeat("0", 128)
+	res, err = svc.HandleEvent(ctx, forged)
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+	var forgedCount int64
+	svc.db.Model(&NostrEvent{}).Where("nostr_id = ?", forged.ID).Count(&forgedCount)
+	assert.Equal(t, int64(0), forgedCount)
 }
 
-func createTestService(t *testing.T) (svc *Service, ln *MockLn) {
-	db, err := gorm.Open(sqlite.Open(testDB), &gorm.Config{})
+func TestHandleNip44Event(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
 	assert.NoError(t, err)
-	err = db.AutoMigrate(&User{}, &App{}, &AppPermission{}, &NostrEvent{}, &Payment{}, &Identity{})
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
 	assert.NoError(t, err)
-	ln = &MockLn{}
-	sk := nostr.GeneratePrivateKey()
-	pk, err := nostr.GetPublicKey(sk)
+	conversationKey := nip44.GenerateConversationKey(ss)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
 	assert.NoError(t, err)
-	return &Service{
-		cfg: &Config{
-			NostrSecretKey: sk,
-			IdentityPubkey: pk,
-		},
-		db:          db,
-		lnClient:    ln,
-		ReceivedEOS: false,
-		Logger:      &logrus.Logger{},
-	}, ln
+	app := App{Name: "test", NostrPubkey: senderPubkey, Nip44Only: true}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+
+	// NIP-44 requests are answered with NIP-44
+	payload, err := nip44.Encrypt(nip47GetBalanceJson, conversationKey)
+	assert.NoError(t, err)
+	res, err := svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+		Tags:    nostr.Tags{[]string{"encryption", NIP_47_ENCRYPTION_NIP44_V2}},
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err := nip44.Decrypt(res[0].Content, conversationKey)
+	assert.NoError(t, err)
+	received := &Nip47Response{
+		Result: &Nip47BalanceResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21000), received.Result.(*Nip47BalanceResponse).Balance)
+
+	// NIP-04 requests are rejected for apps restricted to NIP-44
+	payload, err = nip04.Encrypt(nip47GetBalanceJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_ERROR_UNSUPPORTED_ENCRYPTION, received.Error.Code)
 }
 
-type MockLn struct {
+func TestHandleGetBalanceEvent(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(nip47GetBalanceJson, ss)
+	assert.NoError(t, err)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+
+	// no permissions: the app can do anything
+	res, err := svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err := nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{
+		Result: &Nip47BalanceResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_GET_BALANCE_METHOD, received.ResultType)
+	assert.Equal(t, int64(21000), received.Result.(*Nip47BalanceResponse).Balance)
+
+	// permissions only for pay_invoice
+	appPermission := &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_PAY_INVOICE_METHOD,
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+	payload, err = nip04.Encrypt(nip47GetBalanceJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+
+	// permission for get_balance
+	appPermission = &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_GET_BALANCE_METHOD,
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+	payload, err = nip04.Encrypt(nip47GetBalanceJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{
+		Result: &Nip47BalanceResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21000), received.Result.(*Nip47BalanceResponse).Balance)
 }
 
-func (mln *MockLn) SendPaymentSync(ctx context.Context, senderPubkey string, payReq string) (preimage string, err error) {
-	//todo more advanced behaviour
-	return "123preimage", nil
+func TestRateLimit(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	appPermission := &AppPermission{
+		AppId:              app.ID,
+		App:                app,
+		RequestMethod:      NIP_47_GET_BALANCE_METHOD,
+		RateLimitPerMinute: 2,
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+
+	errorCodes := []string{}
+	for i := 0; i < 3; i++ {
+		payload, err := nip04.Encrypt(nip47GetBalanceJson, ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		}, senderPrivkey))
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res[0].Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		errorCode := ""
+		if received.Error != nil {
+			errorCode = received.Error.Code
+		}
+		errorCodes = append(errorCodes, errorCode)
+	}
+	assert.Equal(t, []string{"", "", NIP_47_ERROR_RATE_LIMITED}, errorCodes)
+
+	// requests older than a minute do not count
+	err = svc.db.Model(&NostrEvent{}).Where("app_id = ?", app.ID).Update("created_at", time.Now().Add(-2*time.Minute)).Error
+	assert.NoError(t, err)
+	rateLimited, _ := svc.isRateLimited(&app, appPermission)
+	assert.False(t, rateLimited)
+
+	assert.Equal(t, "max. 2 per minute", getRateLimitString(appPermission))
+}
+
+func TestHandleGetInfoEvent(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(nip47GetInfoJson, ss)
+	assert.NoError(t, err)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	for _, requestMethod := range []string{NIP_47_GET_INFO_METHOD, NIP_47_PAY_INVOICE_METHOD} {
+		err = svc.db.Create(&AppPermission{
+			AppId:         app.ID,
+			App:           app,
+			RequestMethod: requestMethod,
+		}).Error
+		assert.NoError(t, err)
+	}
+
+	res, err := svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err := nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{
+		Result: &Nip47GetInfoResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_GET_INFO_METHOD, received.ResultType)
+	info := received.Result.(*Nip47GetInfoResponse)
+	assert.Equal(t, mockNodeInfo.Alias, info.Alias)
+	assert.Equal(t, mockNodeInfo.Pubkey, info.Pubkey)
+	assert.Equal(t, mockNodeInfo.Network, info.Network)
+	assert.Equal(t, mockNodeInfo.BlockHeight, info.BlockHeight)
+	assert.Equal(t, []string{NIP_47_PAY_INVOICE_METHOD, NIP_47_MULTI_PAY_INVOICE_METHOD, NIP_47_GET_INFO_METHOD}, info.Methods)
+}
+
+func TestHandleMakeInvoiceEvent(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(nip47MakeInvoiceJson, ss)
+	assert.NoError(t, err)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	appPermission := &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_MAKE_INVOICE_METHOD,
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+
+	res, err := svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err := nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{
+		Result: &Nip47Transaction{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_MAKE_INVOICE_METHOD, received.ResultType)
+	assert.Equal(t, mockTransaction.Invoice, received.Result.(*Nip47Transaction).Invoice)
+	assert.Equal(t, mockTransaction.PaymentHash, received.Result.(*Nip47Transaction).PaymentHash)
+
+	invoice := Invoice{}
+	err = svc.db.Where("app_id = ?", app.ID).First(&invoice).Error
+	assert.NoError(t, err)
+	assert.Equal(t, mockTransaction.PaymentHash, invoice.PaymentHash)
+	assert.Equal(t, int64(1000), invoice.AmountMsat)
+}
+
+func TestHandleLookupInvoiceEvent(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	appPermission := &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_LOOKUP_INVOICE_METHOD,
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+
+	// the invoice was not created by the app
+	payload, err := nip04.Encrypt(nip47LookupInvoiceJson, ss)
+	assert.NoError(t, err)
+	res, err := svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err := nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_ERROR_NOT_FOUND, received.Error.Code)
+
+	err = svc.db.Create(&Invoice{App: app, NostrEventId: 1, PaymentHash: mockTransaction.PaymentHash}).Error
+	assert.NoError(t, err)
+	payload, err = nip04.Encrypt(nip47LookupInvoiceJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{
+		Result: &Nip47Transaction{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_LOOKUP_INVOICE_METHOD, received.ResultType)
+	assert.Equal(t, mockTransaction.Invoice, received.Result.(*Nip47Transaction).Invoice)
+	assert.Equal(t, mockTransaction.State, received.Result.(*Nip47Transaction).State)
+
+	// apps which may list all transactions can look up every transaction of the wallet
+	err = svc.db.Create(&AppPermission{App: app, RequestMethod: NIP_47_LIST_ALL_TRANSACTIONS_PERMISSION}).Error
+	assert.NoError(t, err)
+	payload, err = nip04.Encrypt(nip47LookupUnknownInvoiceJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_ERROR_NOT_FOUND, received.Error.Code)
+}
+
+func TestHandleListTransactionsEvent(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(nip47ListTransactionsJson, ss)
+	assert.NoError(t, err)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	appPermission := &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_LIST_TRANSACTIONS_METHOD,
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+	// the app created one of the mocked transactions
+	err = svc.db.Create(&Invoice{AppId: app.ID, PaymentHash: mockTransaction.PaymentHash}).Error
+	assert.NoError(t, err)
+
+	// only transactions created by the app
+	res, err := svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err := nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{
+		Result: &Nip47ListTransactionsResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_LIST_TRANSACTIONS_METHOD, received.ResultType)
+	transactions := received.Result.(*Nip47ListTransactionsResponse).Transactions
+	assert.Equal(t, 1, len(transactions))
+	assert.Equal(t, mockTransaction.PaymentHash, transactions[0].PaymentHash)
+
+	// the settled transaction is stored and not looked up again
+	invoice := Invoice{}
+	err = svc.db.Where("payment_hash = ?", mockTransaction.PaymentHash).First(&invoice).Error
+	assert.NoError(t, err)
+	assert.Equal(t, mockTransaction, invoice.Nip47Transaction)
+	err = svc.db.Model(&invoice).Updates(&Invoice{Nip47Transaction: &Nip47Transaction{Type: "incoming", State: NIP_47_TRANSACTION_STATE_SETTLED, PaymentHash: "stored"}}).Error
+	assert.NoError(t, err)
+	transactions, err = svc.listAppTransactions(ctx, &app, &nostr.Event{PubKey: senderPubkey}, &Nip47ListTransactionsParams{Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(transactions))
+	assert.Equal(t, "stored", transactions[0].PaymentHash)
+
+	// all transactions of the wallet
+	appPermission = &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_LIST_ALL_TRANSACTIONS_PERMISSION,
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+	payload, err = nip04.Encrypt(nip47ListTransactionsJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{
+		Result: &Nip47ListTransactionsResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(received.Result.(*Nip47ListTransactionsResponse).Transactions))
+
+	// apps without any permissions only see their own transactions
+	otherPrivkey := nostr.GeneratePrivateKey()
+	otherPubkey, err := nostr.GetPublicKey(otherPrivkey)
+	assert.NoError(t, err)
+	otherApp := App{Name: "other", NostrPubkey: otherPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&otherApp)
+	assert.NoError(t, err)
+	ss, err = nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, otherPrivkey)
+	assert.NoError(t, err)
+	payload, err = nip04.Encrypt(nip47ListTransactionsJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  otherPubkey,
+		Content: payload,
+	}, otherPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{
+		Result: &Nip47ListTransactionsResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(received.Result.(*Nip47ListTransactionsResponse).Transactions))
+}
+
+func TestHandlePayKeysendEvent(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(nip47KeysendJson, ss)
+	assert.NoError(t, err)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	appPermission := &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_PAY_KEYSEND_METHOD,
+		MaxAmount:     60,
+		BudgetRenewal: "never",
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+
+	res, err := svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err := nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{
+		Result: &Nip47PayResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_PAY_KEYSEND_METHOD, received.ResultType)
+	assert.Equal(t, "f00dbabef00dbabef00dbabef00dbabef00dbabef00dbabef00dbabef00dbabe", received.Result.(*Nip47PayResponse).Preimage)
+
+	payment := Payment{}
+	err = svc.db.Where("app_id = ?", app.ID).First(&payment).Error
+	assert.NoError(t, err)
+	assert.Equal(t, uint(50), payment.Amount)
+	assert.Equal(t, "7fb735459fa51835e249e6c54c6073a0d2f6ef1c5ff9e2e32bfd34f649db3262", payment.PaymentHash)
+
+	// the second payment exceeds the budget
+	payload, err = nip04.Encrypt(nip47KeysendJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	decrypted, err = nip04.Decrypt(res[0].Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_ERROR_QUOTA_EXCEEDED, received.Error.Code)
+}
+
+func TestPayKeysendWithoutPreimage(t *testing.T) {
+	ctx := context.TODO()
+	svc, ln := createTestService(t)
+	defer os.Remove(testDB)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: "xxx"}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	nostrEvent := NostrEvent{App: app, NostrId: "xxx", State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	assert.NoError(t, err)
+	keysendParams := &Nip47KeysendParams{Amount: 50000, Pubkey: "03cbd788f5b22bd56e2714bff756372d2293504c064e03250ed16a4dd80ad70e2c"}
+	appPermission := &AppPermission{App: app, AppId: app.ID, RequestMethod: NIP_47_PAY_KEYSEND_METHOD, BudgetRenewal: "never"}
+
+	// the preimage is chosen before sending, so the payment can be looked up
+	preimage, err := svc.payKeysend(ctx, app, nostrEvent, &nostr.Event{PubKey: "xxx"}, keysendParams)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{preimage}, ln.KeysendPreimages)
+	payment := Payment{}
+	err = svc.db.Last(&payment).Error
+	assert.NoError(t, err)
+	paymentHash, err := preimageToPaymentHash(preimage)
+	assert.NoError(t, err)
+	assert.Equal(t, paymentHash, payment.PaymentHash)
+	assert.Equal(t, "succeeded", payment.State)
+
+	// the backend chooses the preimage and the payment fails before it returned one
+	ln.NoCustomPreimage = true
+	ln.KeysendErr = errors.New("no route")
+	_, err = svc.payKeysend(ctx, app, nostrEvent, &nostr.Event{PubKey: "xxx"}, keysendParams)
+	assert.EqualError(t, err, "no route")
+	assert.Equal(t, "", ln.KeysendPreimages[1])
+	payment = Payment{}
+	err = svc.db.Last(&payment).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "", payment.PaymentHash)
+	assert.Equal(t, "failed", payment.State)
+	assert.Equal(t, int64(50), svc.GetBudgetUsage(appPermission))
+
+	// payments the backend cannot send are not recorded
+	_, err = svc.payKeysend(ctx, app, nostrEvent, &nostr.Event{PubKey: "xxx"}, &Nip47KeysendParams{Amount: 50000, Pubkey: keysendParams.Pubkey, Preimage: "f00dbabef00dbabef00dbabef00dbabef00dbabef00dbabef00dbabef00dbabe"})
+	assert.ErrorIs(t, err, ErrNotImplemented)
+	ln.NoKeysend = true
+	_, err = svc.payKeysend(ctx, app, nostrEvent, &nostr.Event{PubKey: "xxx"}, keysendParams)
+	assert.ErrorIs(t, err, ErrNotImplemented)
+	assert.Equal(t, NIP_47_ERROR_NOT_IMPLEMENTED, getPaymentErrorCode(err))
+	var paymentsCount int64
+	svc.db.Model(&Payment{}).Count(&paymentsCount)
+	assert.Equal(t, int64(2), paymentsCount)
+
+	// pending payments without a payment hash are not kept pending forever
+	payment = Payment{App: app, NostrEvent: nostrEvent, Amount: 50, State: "pending"}
+	err = svc.db.Create(&payment).Error
+	assert.NoError(t, err)
+	svc.reconcilePayments(ctx)
+	err = svc.db.First(&payment, payment.ID).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "failed", payment.State)
+}
+
+func TestHandleMultiPayInvoiceEvent(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(nip47MultiPayInvoiceJson, ss)
+	assert.NoError(t, err)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+
+	res, err := svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res))
+	for _, resp := range res {
+		decrypted, err := nip04.Decrypt(resp.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{
+			Result: &Nip47PayResponse{},
+		}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		assert.Equal(t, NIP_47_MULTI_PAY_INVOICE_METHOD, received.ResultType)
+		switch resp.Tags.GetFirst([]string{"d"}).Value() {
+		case "invoice_1":
+			assert.Equal(t, "123preimage", received.Result.(*Nip47PayResponse).Preimage)
+		case "invoice_2":
+			assert.Equal(t, NIP_47_ERROR_OTHER, received.Error.Code)
+		default:
+			t.Errorf("unexpected d tag on response: %v", resp.Tags)
+		}
+	}
+}
+
+func TestHandleMultiPayKeysendEvent(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(nip47MultiPayKeysendJson, ss)
+	assert.NoError(t, err)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	appPermission := &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_PAY_KEYSEND_METHOD,
+		MaxAmount:     150,
+		BudgetRenewal: "never",
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+
+	requestEvent := signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey)
+	res, err := svc.HandleEvent(ctx, requestEvent)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res))
+	nostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", requestEvent.ID).First(&nostrEvent).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "executed", nostrEvent.State)
+	dTags := []string{}
+	for _, resp := range res {
+		decrypted, err := nip04.Decrypt(resp.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{
+			Result: &Nip47PayResponse{},
+		}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		assert.Nil(t, received.Error)
+		assert.NotEmpty(t, received.Result.(*Nip47PayResponse).Preimage)
+		dTags = append(dTags, resp.Tags.GetFirst([]string{"d"}).Value())
+	}
+	assert.ElementsMatch(t, []string{"keysend_1", "02e89ca9e8da72b33d896bae51d20e7e6675aa971f7557500b6591b15429e717f1"}, dTags)
+
+	var paymentCount int64
+	svc.db.Model(&Payment{}).Where("app_id = ?", app.ID).Count(&paymentCount)
+	assert.Equal(t, int64(2), paymentCount)
+
+	// the whole batch is rejected when it does not fit in the remaining budget
+	payload, err = nip04.Encrypt(nip47MultiPayKeysendJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res))
+	for _, resp := range res {
+		decrypted, err := nip04.Decrypt(resp.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		assert.Equal(t, NIP_47_ERROR_QUOTA_EXCEEDED, received.Error.Code)
+	}
+	svc.db.Model(&Payment{}).Where("app_id = ?", app.ID).Count(&paymentCount)
+	assert.Equal(t, int64(2), paymentCount)
+}
+
+func TestCreateNotificationEvents(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+	otherUser := &User{AlbyIdentifier: "other"}
+	err = svc.db.Create(otherUser).Error
+	assert.NoError(t, err)
+
+	// only apps of the wallet owner with the notifications permission are notified
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	otherPubkey, err := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	assert.NoError(t, err)
+	apps := []App{
+		{Name: "notified", NostrPubkey: senderPubkey, UserId: user.ID},
+		{Name: "no permission", NostrPubkey: otherPubkey, UserId: user.ID},
+		{Name: "other user", NostrPubkey: otherPubkey, UserId: otherUser.ID},
+	}
+	for i := range apps {
+		err = svc.db.Create(&apps[i]).Error
+		assert.NoError(t, err)
+	}
+	for _, app := range []App{apps[0], apps[2]} {
+		err = svc.db.Create(&AppPermission{App: app, RequestMethod: NIP_47_NOTIFICATIONS_PERMISSION}).Error
+		assert.NoError(t, err)
+	}
+	err = svc.db.Create(&AppPermission{App: apps[1], RequestMethod: NIP_47_GET_BALANCE_METHOD}).Error
+	assert.NoError(t, err)
+
+	events, err := svc.createNotificationEvents(PaymentNotification{
+		UserId:      user.ID,
+		Type:        NIP_47_PAYMENT_RECEIVED_NOTIFICATION,
+		Transaction: *mockTransaction,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, apps[0].ID, events[0].app.ID)
+	assert.Equal(t, NIP_47_NOTIFICATION_KIND, events[0].event.Kind)
+	assert.Equal(t, senderPubkey, events[0].event.Tags.GetFirst([]string{"p"}).Value())
+
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	decrypted, err := nip04.Decrypt(events[0].event.Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Notification{
+		Notification: &Nip47Transaction{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_PAYMENT_RECEIVED_NOTIFICATION, received.NotificationType)
+	assert.Equal(t, mockTransaction.PaymentHash, received.Notification.(*Nip47Transaction).PaymentHash)
+
+	// backends with a single wallet notify the apps of every user
+	events, err = svc.createNotificationEvents(PaymentNotification{
+		Type:        NIP_47_PAYMENT_SENT_NOTIFICATION,
+		Transaction: *mockTransaction,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(events))
+}
+
+func TestAppRelays(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	lookupRelayHost = func(host string) ([]net.IP, error) {
+		if host == "internal.example.com" {
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		}
+		return []net.IP{net.ParseIP("93.184.216.34")}, nil
+	}
+	defer func() { lookupRelayHost = net.LookupIP }()
+	relays, err := parseRelays("wss://relay1.example.com, wss://relay2.example.com\nwss://relay3.example.com:7000")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"wss://relay1.example.com", "wss://relay2.example.com", "wss://relay3.example.com:7000"}, relays)
+	for _, relay := range []string{"https://relay.example.com", "ws://relay.example.com", "wss://localhost:7000", "wss://127.0.0.1", "wss://[::1]", "wss://169.254.169.254", "wss://192.168.1.1", "wss://internal.example.com"} {
+		_, err = parseRelays(relay)
+		assert.Error(t, err, relay)
+	}
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	apps := []App{
+		{Name: "own relays", NostrPubkey: "pubkey1", UserId: user.ID, Relays: []string{"wss://relay1.example.com", "wss://relay.example.com"}},
+		{Name: "default relays", NostrPubkey: "pubkey2", UserId: user.ID},
+	}
+	for i := range apps {
+		err = svc.db.Create(&apps[i]).Error
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"wss://relay1.example.com", "wss://relay.example.com"}, svc.getRelaysForPubkey("pubkey1"))
+	assert.Equal(t, []string{"wss://relay.example.com"}, svc.getRelaysForPubkey("pubkey2"))
+	assert.Equal(t, []string{"wss://relay.example.com"}, svc.getRelaysForPubkey("unknown"))
+	assert.Equal(t, []string{"wss://relay.example.com", "wss://relay1.example.com"}, svc.getAllRelays())
+
+	err = svc.db.Delete(&apps[0]).Error
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"wss://relay1.example.com"}, svc.getUnusedRelays(apps[0].Relays))
+}
+
+func TestRelayPoolMarkSeen(t *testing.T) {
+	pool := NewRelayPool(logrus.New())
+	assert.True(t, pool.markSeen("event_1"))
+	assert.False(t, pool.markSeen("event_1"))
+	assert.True(t, pool.markSeen("event_2"))
+}
+
+func TestRelayCursor(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.cfg.StoredEventMaxAge = 300
+
+	// without a cursor, stored events up to the maximum age are fetched
+	filters := svc.createFilters("wss://relay.example.com")
+	assert.Equal(t, 1, len(filters))
+	assert.WithinDuration(t, time.Now().Add(-5*time.Minute), *filters[0].Since, 5*time.Second)
+
+	lastEventAt := time.Now().Add(-2 * time.Minute).Truncate(time.Second)
+	svc.updateRelayCursor("wss://relay.example.com", lastEventAt)
+	// the cursor never moves backwards
+	svc.updateRelayCursor("wss://relay.example.com", lastEventAt.Add(-time.Minute))
+
+	relayCursor := RelayCursor{}
+	err := svc.db.Where("url = ?", "wss://relay.example.com").First(&relayCursor).Error
+	assert.NoError(t, err)
+	assert.True(t, lastEventAt.Equal(relayCursor.LastEventAt))
+
+	filters = svc.createFilters("wss://relay.example.com")
+	assert.True(t, lastEventAt.Add(-relayCursorMargin).Equal(*filters[0].Since))
+	filters = svc.createFilters("wss://relay1.example.com")
+	assert.WithinDuration(t, time.Now().Add(-5*time.Minute), *filters[0].Since, 5*time.Second)
+}
+
+func TestPublishResponseWithoutRelays(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: "pubkey", UserId: user.ID}
+	err = svc.db.Create(&app).Error
+	assert.NoError(t, err)
+	err = svc.db.Create(&NostrEvent{App: app, NostrId: "test_publish_event_1", State: "executed"}).Error
+	assert.NoError(t, err)
+
+	// no relay is connected, so the reply cannot be delivered
+	pool := NewRelayPool(svc.Logger)
+	svc.publishResponse(ctx, pool, &nostr.Event{ID: "test_publish_event_1"}, &nostr.Event{ID: "reply_1"})
+
+	nostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", "test_publish_event_1").First(&nostrEvent).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "failed", nostrEvent.State)
+	assert.Equal(t, "reply_1", nostrEvent.ReplyId)
+	assert.Equal(t, map[string]string{"wss://relay.example.com": "failed"}, nostrEvent.RelayStatuses)
+
+	// the reply is kept in the outbox and retried
+	outboxEvent := OutboxEvent{}
+	err = svc.db.Where("event_id = ?", "reply_1").First(&outboxEvent).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "pending", outboxEvent.State)
+	assert.Equal(t, app.ID, outboxEvent.AppId)
+	assert.Equal(t, nostrEvent.ID, outboxEvent.NostrEventId)
+	assert.Equal(t, 0, outboxEvent.Retries)
+	assert.True(t, outboxEvent.NextRetryAt.After(time.Now()))
+
+	// not due yet
+	svc.retryOutboxEvents(ctx, pool, "")
+	err = svc.db.First(&outboxEvent, outboxEvent.ID).Error
+	assert.NoError(t, err)
+	assert.Equal(t, 0, outboxEvent.Retries)
+
+	// a reconnected relay gets its pending events right away
+	svc.retryOutboxEvents(ctx, pool, "wss://relay.example.com")
+	err = svc.db.First(&outboxEvent, outboxEvent.ID).Error
+	assert.NoError(t, err)
+	assert.Equal(t, 1, outboxEvent.Retries)
+	assert.Equal(t, "pending", outboxEvent.State)
+
+	// events are given up after the maximum age
+	err = svc.db.Model(&outboxEvent).Updates(map[string]interface{}{"created_at": time.Now().Add(-outboxEventMaxAge - time.Minute), "next_retry_at": time.Now()}).Error
+	assert.NoError(t, err)
+	svc.retryOutboxEvents(ctx, pool, "")
+	err = svc.db.First(&outboxEvent, outboxEvent.ID).Error
+	assert.NoError(t, err)
+	assert.Equal(t, 2, outboxEvent.Retries)
+	assert.Equal(t, "failed", outboxEvent.State)
+}
+
+func TestOutboxRetryDelay(t *testing.T) {
+	assert.Equal(t, outboxRetryMinDelay, outboxRetryDelay(0))
+	assert.Equal(t, 4*outboxRetryMinDelay, outboxRetryDelay(2))
+	assert.Equal(t, outboxRetryMaxDelay, outboxRetryDelay(10))
+	assert.Equal(t, outboxRetryMaxDelay, outboxRetryDelay(100))
+}
+
+func TestPruneOutboxEvents(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	old := time.Now().Add(-2 * outboxEventRetention)
+	outboxEvents := []OutboxEvent{
+		{EventId: "published", State: "published", CreatedAt: old},
+		{EventId: "failed", State: "failed", CreatedAt: old},
+		{EventId: "pending", State: "pending", CreatedAt: old},
+		{EventId: "recent", State: "published"},
+	}
+	for i := range outboxEvents {
+		err := svc.db.Create(&outboxEvents[i]).Error
+		assert.NoError(t, err)
+	}
+
+	svc.pruneOutboxEvents(time.Now().Add(-outboxEventRetention))
+	eventIds := []string{}
+	svc.db.Model(&OutboxEvent{}).Order("id").Pluck("event_id", &eventIds)
+	assert.Equal(t, []string{"pending", "recent"}, eventIds)
+}
+
+func TestAuthenticateRelay(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	// AUTH is opt-in per relay
+	err := svc.authenticateRelay(ctx, "wss://relay.example.com", &nostr.Relay{URL: "wss://relay.example.com"}, "challenge")
+	assert.ErrorIs(t, err, ErrRelayAuthDisabled)
+
+	authEvent, err := svc.createAuthEvent("wss://relay.example.com", "challenge")
+	assert.NoError(t, err)
+	pubkey, ok := nip42.ValidateAuthEvent(authEvent, "challenge", "wss://relay.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, svc.cfg.IdentityPubkey, pubkey)
+}
+
+func TestEventQueue(t *testing.T) {
+	ctx := context.TODO()
+	queue := newEventQueue(2, 3)
+	assert.True(t, queue.push("app1", RelayEvent{Event: &nostr.Event{ID: "app1_event_1"}}))
+	assert.True(t, queue.push("app1", RelayEvent{Event: &nostr.Event{ID: "app1_event_2"}}))
+	// the queue of app1 is full, app2 is not affected
+	assert.False(t, queue.push("app1", RelayEvent{Event: &nostr.Event{ID: "app1_event_3"}}))
+	assert.True(t, queue.push("app2", RelayEvent{Event: &nostr.Event{ID: "app2_event_1"}}))
+	// the whole queue is full
+	assert.False(t, queue.push("app3", RelayEvent{Event: &nostr.Event{ID: "app3_event_1"}}))
+
+	// apps are served in turns
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		relayEvent, ok := queue.pop(ctx)
+		assert.True(t, ok)
+		ids = append(ids, relayEvent.Event.ID)
+	}
+	assert.Equal(t, []string{"app1_event_1", "app2_event_1", "app1_event_2"}, ids)
+	assert.True(t, queue.push("app3", RelayEvent{Event: &nostr.Event{ID: "app3_event_1"}}))
+	relayEvent, ok := queue.pop(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "app3_event_1", relayEvent.Event.ID)
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, ok = queue.pop(canceledCtx)
+	assert.False(t, ok)
+}
+
+func TestGetEventQueueKey(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	app := App{Name: "test", NostrPubkey: "pubkey1"}
+	err := svc.db.Create(&app).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "pubkey1", svc.getEventQueueKey("pubkey1"))
+	assert.Equal(t, unknownAppQueueKey, svc.getEventQueueKey("unknown1"))
+	assert.Equal(t, unknownAppQueueKey, svc.getEventQueueKey("unknown2"))
+}
+
+func TestCreateRateLimitedResponse(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(nip47GetBalanceJson, ss)
+	assert.NoError(t, err)
+	event := signTestEvent(t, &nostr.Event{
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	}, senderPrivkey)
+
+	resp, err := svc.createRateLimitedResponse(event)
+	assert.NoError(t, err)
+	decrypted, err := nip04.Decrypt(resp.Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_ERROR_RATE_LIMITED, received.Error.Code)
+
+	// forged requests are not answered
+	event.Content = "forged"
+	_, err = svc.createRateLimitedResponse(event)
+	assert.Error(t, err)
+}
+
+func TestRelayReconnectDelay(t *testing.T) {
+	assert.GreaterOrEqual(t, relayReconnectDelay(0), relayReconnectMinDelay/2)
+	assert.LessOrEqual(t, relayReconnectDelay(0), relayReconnectMinDelay)
+	assert.GreaterOrEqual(t, relayReconnectDelay(3), 4*relayReconnectMinDelay)
+	assert.LessOrEqual(t, relayReconnectDelay(3), 8*relayReconnectMinDelay)
+	assert.GreaterOrEqual(t, relayReconnectDelay(100), relayReconnectMaxDelay/2)
+	assert.LessOrEqual(t, relayReconnectDelay(100), relayReconnectMaxDelay)
+}
+
+func TestRelayPoolHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool := NewRelayPool(logrus.New())
+	pool.Start(ctx, []string{"wss://relay2.example.com", "wss://relay1.example.com"}, func(url string) nostr.Filters {
+		return nostr.Filters{}
+	}, nil)
+	pool.Wait()
+
+	health := pool.Health()
+	assert.Equal(t, 2, len(health))
+	assert.Equal(t, "wss://relay1.example.com", health[0].Url)
+	assert.False(t, health[0].Connected)
+	assert.Equal(t, "wss://relay2.example.com", health[1].Url)
+	assert.False(t, health[1].Connected)
+
+	pool.RemoveRelays("wss://relay1.example.com", "wss://unknown.example.com")
+	health = pool.Health()
+	assert.Equal(t, 1, len(health))
+	assert.Equal(t, "wss://relay2.example.com", health[0].Url)
+}
+
+func TestHealthHandler(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	user := &User{AlbyIdentifier: "dummy"}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+	err = svc.db.Create(&App{UserId: user.ID, Name: "test", Relays: []string{"wss://app.example.com"}}).Error
+	assert.NoError(t, err)
+	otherUser := &User{AlbyIdentifier: "other"}
+	err = svc.db.Create(otherUser).Error
+	assert.NoError(t, err)
+	err = svc.db.Create(&App{UserId: otherUser.ID, Name: "other", Relays: []string{"wss://other.example.com"}}).Error
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	svc.relayPool = NewRelayPool(logrus.New())
+	svc.relayPool.Start(ctx, []string{"wss://relay.example.com", "wss://app.example.com", "wss://other.example.com"}, func(url string) nostr.Filters {
+		return nostr.Filters{}
+	}, nil)
+	svc.relayPool.Wait()
+
+	e := echo.New()
+	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secret"))))
+	e.GET("/api/health", svc.HealthHandler)
+	getHealth := func() map[string]interface{} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		health := map[string]interface{}{}
+		err := json.Unmarshal(rec.Body.Bytes(), &health)
+		assert.NoError(t, err)
+		return health
+	}
+
+	// the relays are not shown publicly
+	health := getHealth()
+	assert.Equal(t, false, health["healthy"])
+	assert.Equal(t, float64(0), health["relays_connected"])
+	assert.Equal(t, float64(3), health["relays_total"])
+	assert.NotContains(t, health, "relays")
+
+	// a user only sees the default relays and the relays of their apps
+	svc.cfg.LNBackendType = LNDBackendType
+	health = getHealth()
+	relays := health["relays"].([]interface{})
+	assert.Equal(t, 2, len(relays))
+	assert.Equal(t, "wss://app.example.com", relays[0].(map[string]interface{})["url"])
+	assert.Equal(t, "wss://relay.example.com", relays[1].(map[string]interface{})["url"])
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := &Config{StoredEventMaxAge: 300, EventTimeWindow: 300, EventWorkers: 5, EventQueueSize: 10, EventQueueTotalSize: 1000}
+	assert.NoError(t, cfg.Validate())
+	cfg.StoredEventMaxAge = 600
+	assert.Error(t, cfg.Validate())
+	cfg.StoredEventMaxAge = 300
+	cfg.EventWorkers = 0
+	assert.Error(t, cfg.Validate())
+}
+
+func TestValidateEvent(t *testing.T) {
+	privkey := nostr.GeneratePrivateKey()
+	pubkey, err := nostr.GetPublicKey(privkey)
+	assert.NoError(t, err)
+	now := time.Now()
+	window := 5 * time.Minute
+
+	event := signTestEvent(t, &nostr.Event{Kind: NIP_47_REQUEST_KIND, PubKey: pubkey, Content: "content", CreatedAt: now}, privkey)
+	assert.NoError(t, validateEvent(event, window, now))
+
+	forged := *event
+	forged.Content = "forged"
+	assert.ErrorIs(t, validateEvent(&forged, window, now), ErrInvalidEventId)
+	forged.ID = forged.GetID()
+	assert.ErrorIs(t, validateEvent(&forged, window, now), ErrInvalidEventSignature)
+
+	event = signTestEvent(t, &nostr.Event{Kind: NIP_47_REQUEST_KIND, PubKey: pubkey, CreatedAt: now.Add(-10 * time.Minute)}, privkey)
+	assert.ErrorIs(t, validateEvent(event, window, now), ErrEventTooOld)
+	event = signTestEvent(t, &nostr.Event{Kind: NIP_47_REQUEST_KIND, PubKey: pubkey, CreatedAt: now.Add(10 * time.Minute)}, privkey)
+	assert.ErrorIs(t, validateEvent(event, window, now), ErrEventInTheFuture)
+
+	event = signTestEvent(t, &nostr.Event{Kind: NIP_47_REQUEST_KIND, PubKey: pubkey, CreatedAt: now, Tags: nostr.Tags{
+		[]string{"expiration", strconv.FormatInt(now.Add(time.Minute).Unix(), 10)},
+	}}, privkey)
+	assert.NoError(t, validateEvent(event, window, now))
+	event = signTestEvent(t, &nostr.Event{Kind: NIP_47_REQUEST_KIND, PubKey: pubkey, CreatedAt: now, Tags: nostr.Tags{
+		[]string{"expiration", strconv.FormatInt(now.Add(-time.Second).Unix(), 10)},
+	}}, privkey)
+	assert.ErrorIs(t, validateEvent(event, window, now), ErrEventExpired)
+	event = signTestEvent(t, &nostr.Event{Kind: NIP_47_REQUEST_KIND, PubKey: pubkey, CreatedAt: now, Tags: nostr.Tags{
+		[]string{"expiration", "soon"},
+	}}, privkey)
+	assert.ErrorIs(t, validateEvent(event, window, now), ErrEventExpired)
+}
+
+func TestDuplicatePayment(t *testing.T) {
+	ctx := context.TODO()
+	svc, ln := createTestService(t)
+	defer os.Remove(testDB)
+	user := &User{AlbyIdentifier: "dummy"}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+
+	payInvoice := func() (*Nip47Response, *nostr.Event) {
+		payload, err := nip04.Encrypt(nip47PayJson, ss)
+		assert.NoError(t, err)
+		event := signTestEvent(t, &nostr.Event{
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		}, senderPrivkey)
+		res, err := svc.HandleEvent(ctx, event)
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res[0].Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{
+			Result: &Nip47PayResponse{},
+		}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received, event
+	}
+
+	received, firstEvent := payInvoice()
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "123preimage", received.Result.(*Nip47PayResponse).Preimage)
+	firstNostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", firstEvent.ID).First(&firstNostrEvent).Error
+	assert.NoError(t, err)
+
+	// the invoice is not paid again, the preimage of the first payment is returned
+	received, secondEvent := payInvoice()
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "123preimage", received.Result.(*Nip47PayResponse).Preimage)
+	assert.Equal(t, 1, ln.SentPayments)
+	var paymentsCount int64
+	svc.db.Model(&Payment{}).Count(&paymentsCount)
+	assert.Equal(t, int64(1), paymentsCount)
+	secondNostrEvent := NostrEvent{}
+	err = svc.db.Where("nostr_id = ?", secondEvent.ID).First(&secondNostrEvent).Error
+	assert.NoError(t, err)
+	assert.Equal(t, firstNostrEvent.ID, secondNostrEvent.DuplicateOfId)
+	assert.Equal(t, "executed", secondNostrEvent.State)
+
+	// the first payment is still in flight
+	err = svc.db.Model(&Payment{}).Where("nostr_event_id = ?", firstNostrEvent.ID).Updates(map[string]interface{}{"preimage": "", "state": "pending"}).Error
+	assert.NoError(t, err)
+	received, _ = payInvoice()
+	assert.Equal(t, NIP_47_ERROR_PAYMENT_IN_PROGRESS, received.Error.Code)
+
+	// the first payment failed
+	err = svc.db.Model(&Payment{}).Where("nostr_event_id = ?", firstNostrEvent.ID).Update("state", "failed").Error
+	assert.NoError(t, err)
+	received, _ = payInvoice()
+	assert.Equal(t, NIP_47_ERROR_PAYMENT_FAILED, received.Error.Code)
+	assert.Equal(t, 1, ln.SentPayments)
+
+	// other users pay their own invoices
+	otherUser := &User{AlbyIdentifier: "other"}
+	err = svc.db.Create(otherUser).Error
+	assert.NoError(t, err)
+	senderPrivkey = nostr.GeneratePrivateKey()
+	senderPubkey, err = nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	err = svc.db.Model(&otherUser).Association("Apps").Append(&App{Name: "other", NostrPubkey: senderPubkey})
+	assert.NoError(t, err)
+	ss, err = nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	received, _ = payInvoice()
+	assert.Nil(t, received.Error)
+	assert.Equal(t, 2, ln.SentPayments)
+}
+
+func TestReconcilePayments(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	user := &User{AlbyIdentifier: "dummy"}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: "xxx"}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	nostrEvent := NostrEvent{App: app, NostrId: "xxx", State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	assert.NoError(t, err)
+	unknownPaymentHash := "0000000000000000000000000000000000000000000000000000000000000000"
+	createPayment := func(paymentHash, preimage, state string) *Payment {
+		payment := &Payment{App: app, NostrEvent: nostrEvent, PaymentHash: paymentHash, Preimage: preimage, Amount: 100, State: state}
+		err := svc.db.Create(payment).Error
+		assert.NoError(t, err)
+		return payment
+	}
+	getState := func(payment *Payment) string {
+		err := svc.db.First(payment, payment.ID).Error
+		assert.NoError(t, err)
+		return payment.State
+	}
+
+	// payments created before payments had a state
+	oldSucceeded := createPayment(unknownPaymentHash, "123preimage", "")
+	oldUnknown := createPayment(mockTransaction.PaymentHash, "", "")
+	err = migratePaymentStates(svc.db)
+	assert.NoError(t, err)
+	assert.Equal(t, "succeeded", getState(oldSucceeded))
+	assert.Equal(t, "failed", getState(oldUnknown))
+
+	// payments created before the payment hash was stored
+	oldWithoutHash := &Payment{App: app, NostrEvent: nostrEvent, PaymentRequest: mockTransaction.Invoice, Amount: 100, State: "failed"}
+	err = svc.db.Create(oldWithoutHash).Error
+	assert.NoError(t, err)
+	err = migratePaymentHashes(svc.db)
+	assert.NoError(t, err)
+	err = svc.db.First(oldWithoutHash, oldWithoutHash.ID).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "320c2c5a1492ccfd5bc7aa4ad9b657d6aaec3cfcc0d1d98413a29af4ac772ccf", oldWithoutHash.PaymentHash)
+
+	found := createPayment(mockTransaction.PaymentHash, "", "pending")
+	notFound := createPayment(unknownPaymentHash, "", "pending")
+	inFlight := createPayment(unknownPaymentHash, "", "pending")
+	svc.inFlightPayments.Store(inFlight.ID, true)
+	svc.reconcilePayments(ctx)
+	assert.Equal(t, "succeeded", getState(found))
+	assert.Equal(t, mockTransaction.Preimage, found.Preimage)
+	assert.Equal(t, "failed", getState(notFound))
+	assert.Equal(t, "pending", getState(inFlight))
+
+	// failed payments do not count towards the budget, pending payments might still succeed
+	appPermission := &AppPermission{App: app, AppId: app.ID, RequestMethod: NIP_47_PAY_INVOICE_METHOD, BudgetRenewal: "never"}
+	assert.Equal(t, int64(300), svc.GetBudgetUsage(appPermission))
+
+	// the backend returned an error but the payment went through
+	payment := createPayment(mockTransaction.PaymentHash, "", "pending")
+	preimage, err := svc.completePayment(ctx, payment, "", errors.New("timeout"))
+	assert.NoError(t, err)
+	assert.Equal(t, mockTransaction.Preimage, preimage)
+	assert.Equal(t, "succeeded", getState(payment))
+	payment = createPayment(unknownPaymentHash, "", "pending")
+	_, err = svc.completePayment(ctx, payment, "", errors.New("no route"))
+	assert.EqualError(t, err, "no route")
+	assert.Equal(t, "failed", getState(payment))
+
+	// lookups which keep failing are retried less often
+	assert.Equal(t, 2*paymentReconcileInterval, paymentReconcileRetryDelay(1))
+	assert.Equal(t, paymentReconcileMaxRetryDelay, paymentReconcileRetryDelay(20))
+	assert.Equal(t, paymentReconcileMaxRetryDelay, paymentReconcileRetryDelay(100))
+}
+
+func TestCLNService(t *testing.T) {
+	ctx := context.TODO()
+	calls := map[string]map[string]interface{}{}
+	responses := map[string]string{
+		"pay":          `{"payment_preimage": "123preimage", "status": "complete"}`,
+		"getinfo":      `{"id": "03cbd788f5b22bd56e2714bff756372d2293504c064e03250ed16a4dd80ad70e2c", "alias": "bob", "color": "3399ff", "network": "bitcoin", "blockheight": 12}`,
+		"listfunds":    `{"channels": [{"state": "CHANNELD_NORMAL", "our_amount_msat": 21000}, {"state": "ONCHAIN", "our_amount_msat": 1000}]}`,
+		"invoice":      `{"bolt11": "lnbc1", "payment_hash": "` + mockTransaction.PaymentHash + `", "expires_at": 1693240872}`,
+		"listinvoices": `{"invoices": []}`,
+		"listpays":     `{"pays": [{"bolt11": "` + mockTransaction.Invoice + `", "payment_hash": "` + mockTransaction.PaymentHash + `", "status": "complete", "preimage": "123preimage", "amount_msat": 123000, "amount_sent_msat": 123500, "created_at": 1693237472, "completed_at": 1693237480}]}`,
+		"wait":         `{"subsystem": "sendpays", "updated": 7, "details": {"status": "complete", "payment_hash": "` + mockTransaction.PaymentHash + `"}}`,
+	}
+	var callsMutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callsMutex.Lock()
+		defer callsMutex.Unlock()
+		method := strings.TrimPrefix(r.URL.Path, "/v1/")
+		if r.Header.Get("Rune") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code": 1501, "message": "Not authorized"}`))
+			return
+		}
+		params := map[string]interface{}{}
+		err := json.NewDecoder(r.Body).Decode(&params)
+		assert.NoError(t, err)
+		calls[method] = params
+		w.Write([]byte(responses[method]))
+	}))
+	defer server.Close()
+	cln := &CLNService{address: server.URL, rune: "secret", httpClient: server.Client(), Logger: &logrus.Logger{}}
+
+	preimage, err := cln.SendPaymentSync(ctx, "", mockTransaction.Invoice)
+	assert.NoError(t, err)
+	assert.Equal(t, "123preimage", preimage)
+	assert.Equal(t, mockTransaction.Invoice, calls["pay"]["bolt11"])
+
+	info, err := cln.GetInfo(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", info.Alias)
+	assert.Equal(t, "mainnet", info.Network)
+	assert.Equal(t, uint32(12), info.BlockHeight)
+
+	balance, err := cln.GetBalance(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21000), balance)
+
+	transaction, err := cln.CreateInvoice(ctx, "", 1000, "Hello, world", "", 3600)
+	assert.NoError(t, err)
+	assert.Equal(t, mockTransaction.PaymentHash, transaction.PaymentHash)
+	assert.Equal(t, float64(1000), calls["invoice"]["amount_msat"])
+	assert.Equal(t, "Hello, world", calls["invoice"]["description"])
+	_, err = cln.CreateInvoice(ctx, "", 1000, "", "a1b2", 3600)
+	assert.Error(t, err)
+	// the description hash must match the description
+	_, err = cln.CreateInvoice(ctx, "", 1000, "Hello, world", "a1b2", 3600)
+	assert.EqualError(t, err, "The description hash must be the SHA256 hash of the description")
+	descriptionHash := sha256.Sum256([]byte("Hello, world"))
+	_, err = cln.CreateInvoice(ctx, "", 1000, "Hello, world", hex.EncodeToString(descriptionHash[:]), 3600)
+	assert.NoError(t, err)
+	assert.Equal(t, true, calls["invoice"]["deschashonly"])
+
+	// completed payments are notified once
+	subscribeCtx, cancel := context.WithCancel(ctx)
+	notifications, err := cln.SubscribePayments(subscribeCtx)
+	assert.NoError(t, err)
+	notification := <-notifications
+	cancel()
+	assert.Equal(t, NIP_47_PAYMENT_SENT_NOTIFICATION, notification.Type)
+	assert.Equal(t, mockTransaction.PaymentHash, notification.Transaction.PaymentHash)
+	callsMutex.Lock()
+	assert.Equal(t, "sendpays", calls["wait"]["subsystem"])
+	assert.Equal(t, float64(8), calls["wait"]["nextvalue"])
+	assert.Equal(t, "complete", calls["listpays"]["status"])
+	callsMutex.Unlock()
+
+	// not an invoice of the node, but a payment it made
+	transaction, err = cln.LookupInvoice(ctx, "", mockTransaction.PaymentHash)
+	assert.NoError(t, err)
+	assert.Equal(t, "outgoing", transaction.Type)
+	assert.Equal(t, NIP_47_TRANSACTION_STATE_SETTLED, transaction.State)
+	assert.Equal(t, int64(500), transaction.FeesPaid)
+	assert.Equal(t, mockTransaction.PaymentHash, calls["listpays"]["payment_hash"])
+	responses["listpays"] = `{"pays": []}`
+	_, err = cln.LookupInvoice(ctx, "", mockTransaction.PaymentHash)
+	assert.ErrorIs(t, err, ErrTransactionNotFound)
+
+	cln.rune = "wrong"
+	_, err = cln.GetBalance(ctx, "")
+	assert.EqualError(t, err, "CLN listfunds failed: Not authorized")
+}
+
+func TestLNbitsService(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	payment := `{"checking_id": "` + mockTransaction.PaymentHash + `", "pending": false, "amount": -123000, "fee": -500, "memo": "Hello, world", "time": 1693237472, "bolt11": "` + mockTransaction.Invoice + `", "preimage": "123preimage", "payment_hash": "` + mockTransaction.PaymentHash + `", "expiry": 1693240872}`
+	requests := map[string]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "adminkey" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"detail": "Invalid key"}`))
+			return
+		}
+		params := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&params)
+		requests[r.Method+" "+r.URL.Path] = params
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/wallet":
+			w.Write([]byte(`{"id": "wallet1", "name": "test", "balance": 21000}`))
+		case "POST /api/v1/payments":
+			if params["out"] == true {
+				w.Write([]byte(`{"payment_hash": "` + mockTransaction.PaymentHash + `"}`))
+				return
+			}
+			w.Write([]byte(`{"payment_hash": "` + mockTransaction.PaymentHash + `", "payment_request": "` + mockTransaction.Invoice + `"}`))
+		case "GET /api/v1/payments/" + mockTransaction.PaymentHash:
+			w.Write([]byte(`{"paid": true, "preimage": "123preimage", "details": ` + payment + `}`))
+		case "GET /api/v1/payments":
+			w.Write([]byte(`[` + payment + `]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"detail": "Payment does not exist."}`))
+		}
+	}))
+	defer server.Close()
+	svc.cfg.LNbitsURL = server.URL
+	lnbits := &LNbitsService{cfg: svc.cfg, httpClient: server.Client(), db: svc.db, Logger: svc.Logger}
+
+	// every user has their own wallet
+	user := &User{AlbyIdentifier: "lnbits:wallet1", LNbitsAdminKey: "adminkey"}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+	err = svc.db.Model(&user).Association("Apps").Append(&App{Name: "test", NostrPubkey: "xxx"})
+	assert.NoError(t, err)
+	otherUser := &User{AlbyIdentifier: "other"}
+	err = svc.db.Create(otherUser).Error
+	assert.NoError(t, err)
+	err = svc.db.Model(&otherUser).Association("Apps").Append(&App{Name: "other", NostrPubkey: "yyy"})
+	assert.NoError(t, err)
+
+	preimage, err := lnbits.SendPaymentSync(ctx, "xxx", mockTransaction.Invoice)
+	assert.NoError(t, err)
+	assert.Equal(t, "123preimage", preimage)
+	assert.Equal(t, mockTransaction.Invoice, requests["POST /api/v1/payments"]["bolt11"])
+	_, err = lnbits.SendPaymentSync(ctx, "yyy", mockTransaction.Invoice)
+	assert.ErrorIs(t, err, ErrLNbitsWalletNotConnected)
+
+	balance, err := lnbits.GetBalance(ctx, "xxx")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21000), balance)
+
+	transaction, err := lnbits.CreateInvoice(ctx, "xxx", 123000, "Hello, world", "", 3600)
+	assert.NoError(t, err)
+	assert.Equal(t, mockTransaction.Invoice, transaction.Invoice)
+	assert.Equal(t, float64(123), requests["POST /api/v1/payments"]["amount"])
+
+	transaction, err = lnbits.LookupInvoice(ctx, "xxx", mockTransaction.PaymentHash)
+	assert.NoError(t, err)
+	assert.Equal(t, "outgoing", transaction.Type)
+	assert.Equal(t, NIP_47_TRANSACTION_STATE_SETTLED, transaction.State)
+	assert.Equal(t, int64(123000), transaction.Amount)
+	assert.Equal(t, int64(500), transaction.FeesPaid)
+	_, err = lnbits.LookupInvoice(ctx, "xxx", "0000000000000000000000000000000000000000000000000000000000000000")
+	assert.ErrorIs(t, err, ErrTransactionNotFound)
+
+	transactions, err := lnbits.ListTransactions(ctx, "xxx", 0, 0, 10, 0, false, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(transactions))
+	assert.Equal(t, int64(1693237472), transactions[0].CreatedAt)
+
+	_, err = lnbits.SendKeysend(ctx, "xxx", 1000, "03abc", "", nil)
+	assert.ErrorIs(t, err, ErrNotImplemented)
+
+	// newer versions return dates
+	lnbitsPayment := lnbitsPayment{}
+	err = json.Unmarshal([]byte(`{"time": "2023-08-28T15:44:32.000000", "status": "pending", "pending": true}`), &lnbitsPayment)
+	assert.NoError(t, err)
+	assert.Equal(t, lnbitsTime(1693237472), lnbitsPayment.Time)
+	assert.Equal(t, NIP_47_TRANSACTION_STATE_PENDING, lnbitsPaymentToTransaction(&lnbitsPayment).State)
+}
+
+func TestLNDServiceSendPayment(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	gracePeriod := lndPaymentPendingGracePeriod
+	lndPaymentPendingGracePeriod = 50 * time.Millisecond
+	defer func() { lndPaymentPendingGracePeriod = gracePeriod }()
+	router := &mockLNDRouterClient{}
+	lnd := &LNDService{
+		routerClient:   router,
+		paymentOptions: lndPaymentOptions{timeoutSeconds: 0, feeLimitPpm: 10000, feeLimitMinMsat: 10000},
+		db:             svc.db,
+		Logger:         svc.Logger,
+	}
+
+	assert.Equal(t, int64(10000), lnd.paymentOptions.feeLimitMsat(123000))
+	assert.Equal(t, int64(50000), lnd.paymentOptions.feeLimitMsat(5000000))
+
+	router.updates = []*lnrpc.Payment{{Status: lnrpc.Payment_IN_FLIGHT}, {Status: lnrpc.Payment_SUCCEEDED, PaymentPreimage: "123preimage"}}
+	preimage, err := lnd.SendPaymentSync(ctx, "xxx", mockTransaction.Invoice)
+	assert.NoError(t, err)
+	assert.Equal(t, "123preimage", preimage)
+	assert.Equal(t, mockTransaction.Invoice, router.request.PaymentRequest)
+	assert.Equal(t, int64(10000), router.request.FeeLimitMsat)
+
+	router.updates = []*lnrpc.Payment{{Status: lnrpc.Payment_FAILED, FailureReason: lnrpc.PaymentFailureReason_FAILURE_REASON_NO_ROUTE}}
+	_, err = lnd.SendPaymentSync(ctx, "xxx", mockTransaction.Invoice)
+	assert.EqualError(t, err, "Payment failed: FAILURE_REASON_NO_ROUTE")
+
+	// the HTLC is still pending after the timeout
+	router.updates = []*lnrpc.Payment{{Status: lnrpc.Payment_IN_FLIGHT, Htlcs: []*lnrpc.HTLCAttempt{{Status: lnrpc.HTLCAttempt_IN_FLIGHT}}}}
+	_, err = lnd.SendKeysend(ctx, "xxx", 1000, "03abc0", "0123456789abcdef", nil)
+	assert.ErrorIs(t, err, ErrPaymentPending)
+	assert.Equal(t, NIP_47_ERROR_PAYMENT_IN_PROGRESS, getPaymentErrorCode(err))
+	assert.Equal(t, int64(1000), router.request.AmtMsat)
+}
+
+func TestLNDServiceGetBalance(t *testing.T) {
+	ctx := context.TODO()
+	client := &mockLNDLightningClient{}
+	lnd := &LNDService{client: client}
+
+	client.channelBalance = &lnrpc.ChannelBalanceResponse{LocalBalance: &lnrpc.Amount{Msat: 21000}}
+	balance, err := lnd.GetBalance(ctx, "xxx")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21000), balance)
+
+	// LND leaves out empty amounts
+	client.channelBalance = &lnrpc.ChannelBalanceResponse{}
+	balance, err = lnd.GetBalance(ctx, "xxx")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), balance)
+}
+
+func TestLNDRestService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	paymentHashBytes, _ := hex.DecodeString(mockTransaction.PaymentHash)
+	paymentHash := base64.StdEncoding.EncodeToString(paymentHashBytes)
+	outgoingPaymentHash := strings.Repeat("ab", 32)
+	outgoingPaymentHashBytes, _ := hex.DecodeString(outgoingPaymentHash)
+	invoice := `{"memo": "Hello, world", "r_preimage": "` + base64.StdEncoding.EncodeToString([]byte("preimage")) + `", "r_hash": "` + paymentHash + `", "value_msat": "123000", "creation_date": "1693237472", "settle_date": "1693237500", "payment_request": "` + mockTransaction.Invoice + `", "expiry": "3600", "state": "SETTLED", "settle_index": "1"}`
+	payment := `{"payment_hash": "` + outgoingPaymentHash + `", "value_msat": "123000", "fee_msat": "1000", "payment_preimage": "456preimage", "status": "SUCCEEDED", "creation_time_ns": "1693237400000000000", "payment_index": "1"}`
+	requests := map[string]map[string]interface{}{}
+	failPayments := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Grpc-Metadata-macaroon") != "abcd" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"code": 2, "message": "verification failed: signature mismatch after caveat verification", "details": []}`))
+			return
+		}
+		params := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&params)
+		requests[r.Method+" "+r.URL.Path] = params
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v1/getinfo":
+			w.Write([]byte(`{"alias": "bob", "identity_pubkey": "03abc", "block_height": 800000, "chains": [{"chain": "bitcoin", "network": "mainnet"}]}`))
+		case "GET /v1/balance/channels":
+			w.Write([]byte(`{"local_balance": {"sat": "21", "msat": "21000"}}`))
+		case "POST /v2/router/send":
+			w.Write([]byte(`{"result": {"payment_hash": "` + outgoingPaymentHash + `", "status": "IN_FLIGHT"}}` + "\n"))
+			switch {
+			case failPayments:
+				w.Write([]byte(`{"result": {"payment_hash": "` + outgoingPaymentHash + `", "status": "FAILED", "failure_reason": "FAILURE_REASON_NO_ROUTE"}}` + "\n"))
+			case params["payment_request"] == mockTransaction.Invoice:
+				w.Write([]byte(`{"result": {"payment_hash": "` + outgoingPaymentHash + `", "status": "SUCCEEDED", "payment_preimage": "123preimage"}}` + "\n"))
+			case params["dest"] == base64.StdEncoding.EncodeToString([]byte{0x03, 0xab, 0xc1}):
+				// the HTLCs are stuck
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			default:
+				w.Write([]byte(`{"result": {"payment_hash": "` + outgoingPaymentHash + `", "status": "SUCCEEDED", "payment_preimage": "456preimage"}}` + "\n"))
+			}
+		case "POST /v1/invoices":
+			w.Write([]byte(`{"r_hash": "` + paymentHash + `", "payment_request": "` + mockTransaction.Invoice + `", "add_index": "1"}`))
+		case "GET /v1/invoice/" + mockTransaction.PaymentHash:
+			w.Write([]byte(invoice))
+		case "GET /v1/invoices":
+			w.Write([]byte(`{"invoices": [` + invoice + `], "first_index_offset": "1", "last_index_offset": "1"}`))
+		case "GET /v1/payments":
+			w.Write([]byte(`{"payments": [` + payment + `], "first_index_offset": "1", "last_index_offset": "1"}`))
+		case "GET /v2/router/track/" + base64.URLEncoding.EncodeToString(outgoingPaymentHashBytes):
+			w.Write([]byte(`{"result": ` + payment + `}` + "\n"))
+		case "GET /v1/invoices/subscribe":
+			w.Write([]byte(`{"result": ` + invoice + `}` + "\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code": 5, "message": "unable to locate invoice", "details": []}`))
+		}
+	}))
+	defer server.Close()
+	lnd := &LNDRestService{address: server.URL, macaroon: "abcd", httpClient: server.Client(), db: svc.db, Logger: svc.Logger}
+
+	info, err := lnd.GetInfo(ctx, "xxx")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", info.Alias)
+	assert.Equal(t, "mainnet", info.Network)
+	assert.Equal(t, uint32(800000), info.BlockHeight)
+
+	balance, err := lnd.GetBalance(ctx, "xxx")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21000), balance)
+
+	lnd.paymentOptions = lndPaymentOptions{timeoutSeconds: 50, feeLimitPpm: 10000, feeLimitMinMsat: 10000}
+	preimage, err := lnd.SendPaymentSync(ctx, "xxx", mockTransaction.Invoice)
+	assert.NoError(t, err)
+	assert.Equal(t, "123preimage", preimage)
+	assert.Equal(t, float64(50), requests["POST /v2/router/send"]["timeout_seconds"])
+	assert.Equal(t, "10000", requests["POST /v2/router/send"]["fee_limit_msat"])
+	failPayments = true
+	_, err = lnd.SendPaymentSync(ctx, "xxx", mockTransaction.Invoice)
+	assert.EqualError(t, err, "Payment failed: FAILURE_REASON_NO_ROUTE")
+	failPayments = false
+
+	preimage, err = lnd.SendKeysend(ctx, "xxx", 1000, "03abc0", "0123456789abcdef", []TLVRecord{{Type: 696969, Value: "010203"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "456preimage", preimage)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte{1, 2, 3}), requests["POST /v2/router/send"]["dest_custom_records"].(map[string]interface{})["696969"])
+
+	// the payment is still in flight after the timeout
+	lnd.paymentOptions.timeoutSeconds = 0
+	gracePeriod := lndPaymentPendingGracePeriod
+	lndPaymentPendingGracePeriod = 50 * time.Millisecond
+	_, err = lnd.SendKeysend(ctx, "xxx", 1000, "03abc1", "0123456789abcdef", nil)
+	lndPaymentPendingGracePeriod = gracePeriod
+	assert.ErrorIs(t, err, ErrPaymentPending)
+
+	// the preimage is chosen by the caller
+	_, err = lnd.SendKeysend(ctx, "xxx", 1000, "03abc0", "", nil)
+	assert.Error(t, err)
+
+	transaction, err := lnd.CreateInvoice(ctx, "xxx", 123000, "Hello, world", "", 3600)
+	assert.NoError(t, err)
+	assert.Equal(t, mockTransaction.PaymentHash, transaction.PaymentHash)
+	assert.Equal(t, "123000", requests["POST /v1/invoices"]["value_msat"])
+	assert.Equal(t, "Hello, world", requests["POST /v1/invoices"]["memo"])
+
+	transaction, err = lnd.LookupInvoice(ctx, "xxx", mockTransaction.PaymentHash)
+	assert.NoError(t, err)
+	assert.Equal(t, "incoming", transaction.Type)
+	assert.Equal(t, NIP_47_TRANSACTION_STATE_SETTLED, transaction.State)
+	assert.Equal(t, int64(123000), transaction.Amount)
+	assert.Equal(t, int64(1693237500), transaction.SettledAt)
+	transaction, err = lnd.LookupInvoice(ctx, "xxx", outgoingPaymentHash)
+	assert.NoError(t, err)
+	assert.Equal(t, "outgoing", transaction.Type)
+	assert.Equal(t, int64(1000), transaction.FeesPaid)
+	assert.Equal(t, "456preimage", transaction.Preimage)
+	_, err = lnd.LookupInvoice(ctx, "xxx", strings.Repeat("00", 32))
+	assert.ErrorIs(t, err, ErrTransactionNotFound)
+
+	transactions, err := lnd.ListTransactions(ctx, "xxx", 0, 0, 10, 0, false, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(transactions))
+	assert.Equal(t, "incoming", transactions[0].Type)
+	assert.Equal(t, "outgoing", transactions[1].Type)
+
+	notifications, err := lnd.SubscribePayments(ctx)
+	assert.NoError(t, err)
+	select {
+	case notification := <-notifications:
+		assert.Equal(t, NIP_47_PAYMENT_RECEIVED_NOTIFICATION, notification.Type)
+		assert.Equal(t, mockTransaction.PaymentHash, notification.Transaction.PaymentHash)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no payment notification received")
+	}
+
+	lnd.macaroon = "invalid"
+	_, err = lnd.GetBalance(ctx, "xxx")
+	assert.EqualError(t, err, "LND request failed: verification failed: signature mismatch after caveat verification")
+}
+
+func TestPhoenixdService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	incomingPayment := `{"paymentHash": "` + mockTransaction.PaymentHash + `", "preimage": "123preimage", "description": "Hello, world", "invoice": "` + mockTransaction.Invoice + `", "isPaid": true, "receivedSat": 123, "fees": 0, "completedAt": 1693237500000, "createdAt": 1693237472000}`
+	outgoingPayment := `{"paymentId": "abc", "paymentHash": "outgoinghash", "preimage": "456preimage", "invoice": "` + mockTransaction.Invoice + `", "isPaid": true, "sent": 124, "fees": 1000, "completedAt": 1693237500000, "createdAt": 1693237400000}`
+	upgrader := websocket.Upgrader{}
+	requests := map[string]url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, password, _ := r.BasicAuth()
+		if password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		requests[r.Method+" "+r.URL.Path] = r.Form
+		switch r.Method + " " + r.URL.Path {
+		case "GET /getinfo":
+			w.Write([]byte(`{"nodeId": "03abc", "chain": "mainnet", "blockHeight": 800000}`))
+		case "GET /getbalance":
+			w.Write([]byte(`{"balanceSat": 21, "feeCreditSat": 0}`))
+		case "POST /payinvoice":
+			if r.Form.Get("invoice") != mockTransaction.Invoice {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Invalid parameter invoice\n"))
+				return
+			}
+			w.Write([]byte(`{"recipientAmountSat": 123, "routingFeeSat": 1, "paymentId": "abc", "paymentHash": "` + mockTransaction.PaymentHash + `", "paymentPreimage": "123preimage"}`))
+		case "POST /createinvoice":
+			w.Write([]byte(`{"amountSat": 123, "paymentHash": "` + mockTransaction.PaymentHash + `", "serialized": "` + mockTransaction.Invoice + `"}`))
+		case "GET /payments/incoming/" + mockTransaction.PaymentHash:
+			w.Write([]byte(incomingPayment))
+		case "GET /payments/outgoingbyhash/outgoinghash":
+			w.Write([]byte(outgoingPayment))
+		case "GET /payments/incoming":
+			w.Write([]byte(`[` + incomingPayment + `]`))
+		case "GET /payments/outgoing":
+			w.Write([]byte(`[` + outgoingPayment + `]`))
+		case "GET /websocket":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.WriteJSON(map[string]interface{}{"type": "payment_received", "amountSat": 123, "paymentHash": mockTransaction.PaymentHash})
+			conn.ReadMessage()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	phoenixd := &PhoenixdService{address: server.URL, authorization: "secret", httpClient: server.Client(), db: svc.db, Logger: svc.Logger}
+
+	info, err := phoenixd.GetInfo(ctx, "xxx")
+	assert.NoError(t, err)
+	assert.Equal(t, "03abc", info.Pubkey)
+	assert.Equal(t, "mainnet", info.Network)
+
+	balance, err := phoenixd.GetBalance(ctx, "xxx")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21000), balance)
+
+	preimage, err := phoenixd.SendPaymentSync(ctx, "xxx", mockTransaction.Invoice)
+	assert.NoError(t, err)
+	assert.Equal(t, "123preimage", preimage)
+	_, err = phoenixd.SendPaymentSync(ctx, "xxx", "lnbc1invalid")
+	assert.EqualError(t, err, "phoenixd request failed: Invalid parameter invoice")
+
+	transaction, err := phoenixd.CreateInvoice(ctx, "xxx", 123000, "Hello, world", "", 3600)
+	assert.NoError(t, err)
+	assert.Equal(t, mockTransaction.Invoice, transaction.Invoice)
+	assert.Equal(t, "123", requests["POST /createinvoice"].Get("amountSat"))
+	assert.Equal(t, "3600", requests["POST /createinvoice"].Get("expirySeconds"))
+
+	transaction, err = phoenixd.LookupInvoice(ctx, "xxx", mockTransaction.PaymentHash)
+	assert.NoError(t, err)
+	assert.Equal(t, "incoming", transaction.Type)
+	assert.Equal(t, NIP_47_TRANSACTION_STATE_SETTLED, transaction.State)
+	assert.Equal(t, int64(123000), transaction.Amount)
+	assert.Equal(t, int64(1693237500), transaction.SettledAt)
+	transaction, err = phoenixd.LookupInvoice(ctx, "xxx", "outgoinghash")
+	assert.NoError(t, err)
+	assert.Equal(t, "outgoing", transaction.Type)
+	assert.Equal(t, int64(123000), transaction.Amount)
+	assert.Equal(t, int64(1000), transaction.FeesPaid)
+	assert.Equal(t, "456preimage", transaction.Preimage)
+	_, err = phoenixd.LookupInvoice(ctx, "xxx", "unknownhash")
+	assert.ErrorIs(t, err, ErrTransactionNotFound)
+
+	transactions, err := phoenixd.ListTransactions(ctx, "xxx", 1693237000, 0, 10, 0, false, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(transactions))
+	assert.Equal(t, "incoming", transactions[0].Type)
+	assert.Equal(t, "1693237000000", requests["GET /payments/outgoing"].Get("from"))
+	assert.Equal(t, "10", requests["GET /payments/outgoing"].Get("limit"))
+	transactions, err = phoenixd.ListTransactions(ctx, "xxx", 0, 0, 10, 0, false, "outgoing")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(transactions))
+	assert.Equal(t, "outgoing", transactions[0].Type)
+
+	_, err = phoenixd.SendKeysend(ctx, "xxx", 1000, "03abc", "", nil)
+	assert.ErrorIs(t, err, ErrNotImplemented)
+
+	notifications, err := phoenixd.SubscribePayments(ctx)
+	assert.NoError(t, err)
+	select {
+	case notification := <-notifications:
+		assert.Equal(t, NIP_47_PAYMENT_RECEIVED_NOTIFICATION, notification.Type)
+		assert.Equal(t, mockTransaction.PaymentHash, notification.Transaction.PaymentHash)
+		assert.Equal(t, NIP_47_TRANSACTION_STATE_SETTLED, notification.Transaction.State)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no payment notification received")
+	}
+}
+
+func TestFilterTransactions(t *testing.T) {
+	transactions := []Nip47Transaction{
+		{Type: "incoming", State: NIP_47_TRANSACTION_STATE_SETTLED, PaymentHash: "a", CreatedAt: 100},
+		{Type: "outgoing", State: NIP_47_TRANSACTION_STATE_SETTLED, PaymentHash: "b", CreatedAt: 300},
+		{Type: "incoming", State: NIP_47_TRANSACTION_STATE_PENDING, PaymentHash: "c", CreatedAt: 200},
+		{Type: "incoming", State: NIP_47_TRANSACTION_STATE_SETTLED, PaymentHash: "d", CreatedAt: 400},
+	}
+
+	result := filterTransactions(transactions, 0, 0, 0, 0, false, "")
+	assert.Equal(t, 3, len(result))
+	assert.Equal(t, "d", result[0].PaymentHash)
+	assert.Equal(t, "a", result[2].PaymentHash)
+
+	result = filterTransactions(transactions, 0, 0, 0, 0, true, "incoming")
+	assert.Equal(t, 3, len(result))
+	assert.Equal(t, "c", result[1].PaymentHash)
+
+	result = filterTransactions(transactions, 150, 350, 0, 0, true, "")
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, "b", result[0].PaymentHash)
+
+	result = filterTransactions(transactions, 0, 0, 1, 1, false, "")
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, "b", result[0].PaymentHash)
+
+	result = filterTransactions(transactions, 0, 0, 10, 10, false, "")
+	assert.Equal(t, 0, len(result))
+}
+
+func TestListTransactionsSince(t *testing.T) {
+	transactions := []Nip47Transaction{}
+	for i := 0; i < 5; i++ {
+		transactions = append(transactions, Nip47Transaction{State: NIP_47_TRANSACTION_STATE_SETTLED, CreatedAt: int64(100 + i), SettledAt: int64(200 + i)})
+	}
+	ln := &pagedMockLn{transactions: transactions}
+
+	// pages are fetched until the last notified transaction is reached
+	result, err := listTransactionsSince(context.TODO(), ln, "", 201, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(result))
+	assert.Equal(t, 2, ln.calls)
+
+	// or until the history ends
+	ln.calls = 0
+	result, err = listTransactionsSince(context.TODO(), ln, "", 0, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(result))
+	assert.Equal(t, 3, ln.calls)
+
+	// but a poll never fetches the whole history
+	for i := 0; i < notificationsPollMaxPages*notificationsPollMaxPageSize; i++ {
+		ln.transactions = append(ln.transactions, Nip47Transaction{State: NIP_47_TRANSACTION_STATE_SETTLED, CreatedAt: int64(1000 + i)})
+	}
+	ln.calls = 0
+	result, err = listTransactionsSince(context.TODO(), ln, "", 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, notificationsPollMaxPages*notificationsPollMaxPageSize, len(result))
+	assert.Equal(t, notificationsPollMaxPages, ln.calls)
+}
+
+// pagedMockLn lists its transactions like a backend with a long payment history
+type pagedMockLn struct {
+	MockLn
+	transactions []Nip47Transaction
+	calls        int
+}
+
+func (mln *pagedMockLn) ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, transactionType string) (transactions []Nip47Transaction, err error) {
+	mln.calls++
+	return filterTransactions(mln.transactions, from, until, limit, offset, unpaid, transactionType), nil
+}
+
+func createTestService(t *testing.T) (svc *Service, ln *MockLn) {
+	db, err := gorm.Open(sqlite.Open(testDB), &gorm.Config{})
+	assert.NoError(t, err)
+	// like in main, SQLite is limited to one connection
+	sqlDb, err := db.DB()
+	assert.NoError(t, err)
+	sqlDb.SetMaxOpenConns(1)
+	err = db.AutoMigrate(&User{}, &App{}, &AppPermission{}, &NostrEvent{}, &Payment{}, &Invoice{}, &Identity{}, &RelayCursor{}, &OutboxEvent{})
+	assert.NoError(t, err)
+	ln = &MockLn{}
+	sk := nostr.GeneratePrivateKey()
+	pk, err := nostr.GetPublicKey(sk)
+	assert.NoError(t, err)
+	return &Service{
+		cfg: &Config{
+			NostrSecretKey:  sk,
+			IdentityPubkey:  pk,
+			Relays:          []string{"wss://relay.example.com"},
+			EventTimeWindow: 300,
+		},
+		db:       db,
+		lnClient: ln,
+		Logger:   &logrus.Logger{},
+	}, ln
+}
+
+// signTestEvent signs the request like a client would, the ID is derived from the event
+func signTestEvent(t *testing.T, event *nostr.Event, privkey string) *nostr.Event {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	err := event.Sign(privkey)
+	assert.NoError(t, err)
+	return event
+}
+
+var mockTransaction = &Nip47Transaction{
+	Type:        "incoming",
+	State:       NIP_47_TRANSACTION_STATE_SETTLED,
+	Invoice:     "lntb1230n1pjypux0pp5xgxzcks5jtx06k784f9dndjh664wc08ucrganpqn52d0ftrh9n8sdqyw3jscqzpgxqyz5vqsp5rkx7cq252p3frx8ytjpzc55rkgyx2mfkzzraa272dqvr2j6leurs9qyyssqhutxa24r5hqxstchz5fxlslawprqjnarjujp5sm3xj7ex73s32sn54fthv2aqlhp76qmvrlvxppx9skd3r5ut5xutgrup8zuc6ay73gqmra29m",
+	Description: "Hello, world",
+	Preimage:    "123preimage",
+	PaymentHash: "320c2c5a1492ccfd5bc7aa4ad9b657d6aaec3cfcc0d1d9842ba29af4ac772ccf",
+	Amount:      1000,
+	CreatedAt:   1693237472,
+	ExpiresAt:   1693240872,
+}
+
+var mockNodeInfo = &NodeInfo{
+	Alias:       "bob",
+	Color:       "#3399FF",
+	Pubkey:      "03cbd788f5b22bd56e2714bff756372d2293504c064e03250ed16a4dd80ad70e2c",
+	Network:     "testnet",
+	BlockHeight: 12,
+	BlockHash:   "123blockhash",
+}
+
+type MockLn struct {
+	// number of invoices paid with SendPaymentSync
+	SentPayments int
+	// the backend cannot send keysend payments
+	NoKeysend bool
+	// the backend chooses the preimage of keysend payments
+	NoCustomPreimage bool
+	// keysend payments fail with this error if set
+	KeysendErr error
+	// the preimages keysend payments were sent with
+	KeysendPreimages []string
+}
+
+func (mln *MockLn) SendPaymentSync(ctx context.Context, senderPubkey string, payReq string) (preimage string, err error) {
+	//todo more advanced behaviour
+	mln.SentPayments++
+	return "123preimage", nil
+}
+
+func (mln *MockLn) GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error) {
+	return mockNodeInfo, nil
+}
+
+func (mln *MockLn) SubscribePayments(ctx context.Context) (notifications <-chan PaymentNotification, err error) {
+	return make(chan PaymentNotification), nil
+}
+
+func (mln *MockLn) GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error) {
+	return 21000, nil
+}
+
+func (mln *MockLn) CreateInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	return mockTransaction, nil
+}
+
+func (mln *MockLn) LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error) {
+	if paymentHash != mockTransaction.PaymentHash {
+		return nil, ErrTransactionNotFound
+	}
+	return mockTransaction, nil
+}
+
+func (mln *MockLn) ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, transactionType string) (transactions []Nip47Transaction, err error) {
+	appTransaction := *mockTransaction
+	appTransaction.CreatedAt = time.Now().Unix()
+	otherTransaction := *mockTransaction
+	otherTransaction.PaymentHash = "0000000000000000000000000000000000000000000000000000000000000000"
+	otherTransaction.CreatedAt = time.Now().Unix()
+	return filterTransactions([]Nip47Transaction{appTransaction, otherTransaction}, from, until, limit, offset, unpaid, transactionType), nil
+}
+
+func (mln *MockLn) SupportsKeysend() (keysend bool, customPreimage bool) {
+	return !mln.NoKeysend, !mln.NoKeysend && !mln.NoCustomPreimage
+}
+
+func (mln *MockLn) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, customRecords []TLVRecord) (respPreimage string, err error) {
+	mln.KeysendPreimages = append(mln.KeysendPreimages, preimage)
+	if mln.KeysendErr != nil {
+		return "", mln.KeysendErr
+	}
+	if preimage == "" {
+		return generatePreimage()
+	}
+	return preimage, nil
+}
+
+type mockLNDLightningClient struct {
+	lnrpc.LightningClient
+	channelBalance *lnrpc.ChannelBalanceResponse
+}
+
+func (client *mockLNDLightningClient) ChannelBalance(ctx context.Context, req *lnrpc.ChannelBalanceRequest, opts ...grpc.CallOption) (*lnrpc.ChannelBalanceResponse, error) {
+	return client.channelBalance, nil
+}
+
+// mockLNDRouterClient streams the updates of a payment, then blocks until the request is canceled
+type mockLNDRouterClient struct {
+	routerrpc.RouterClient
+	request *routerrpc.SendPaymentRequest
+	updates []*lnrpc.Payment
+}
+
+func (router *mockLNDRouterClient) SendPaymentV2(ctx context.Context, req *routerrpc.SendPaymentRequest, opts ...grpc.CallOption) (routerrpc.Router_SendPaymentV2Client, error) {
+	router.request = req
+	return &mockLNDPaymentStream{ctx: ctx, updates: router.updates}, nil
+}
+
+type mockLNDPaymentStream struct {
+	routerrpc.Router_SendPaymentV2Client
+	ctx     context.Context
+	updates []*lnrpc.Payment
+}
+
+func (stream *mockLNDPaymentStream) Recv() (*lnrpc.Payment, error) {
+	if len(stream.updates) > 0 {
+		update := stream.updates[0]
+		stream.updates = stream.updates[1:]
+		return update, nil
+	}
+	<-stream.ctx.Done()
+	return nil, status.Error(codes.DeadlineExceeded, stream.ctx.Err().Error())
 }
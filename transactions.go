@@ -0,0 +1,43 @@
+package main
+
+import "sort"
+
+// matchesTransactionFilter applies the NIP-47 list_transactions filters to a single transaction.
+func matchesTransactionFilter(transaction *Nip47Transaction, from, until uint64, unpaid bool, transactionType string) bool {
+	if from != 0 && transaction.CreatedAt < int64(from) {
+		return false
+	}
+	if until != 0 && transaction.CreatedAt > int64(until) {
+		return false
+	}
+	if !unpaid && transaction.State != NIP_47_TRANSACTION_STATE_SETTLED {
+		return false
+	}
+	if transactionType != "" && transaction.Type != transactionType {
+		return false
+	}
+	return true
+}
+
+// filterTransactions returns the matching transactions, newest first, with offset and limit applied.
+// A limit of 0 returns all matching transactions.
+func filterTransactions(transactions []Nip47Transaction, from, until, limit, offset uint64, unpaid bool, transactionType string) []Nip47Transaction {
+	result := []Nip47Transaction{}
+	for i := range transactions {
+		if matchesTransactionFilter(&transactions[i], from, until, unpaid, transactionType) {
+			result = append(result, transactions[i])
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].CreatedAt > result[j].CreatedAt
+	})
+
+	if offset >= uint64(len(result)) {
+		return []Nip47Transaction{}
+	}
+	result = result[offset:]
+	if limit > 0 && limit < uint64(len(result)) {
+		result = result[:limit]
+	}
+	return result
+}